@@ -4,6 +4,11 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
 	"github.com/knightfall22/nin/transmission"
 	"github.com/spf13/cobra"
 )
@@ -22,6 +27,11 @@ var listenCmd = &cobra.Command{
 
 		transmission.Debug = debug
 
+		asJSON, err := jsonOutput(cmd)
+		if err != nil {
+			return err
+		}
+
 		senderAddr, err := cmd.Flags().GetString("sender")
 		if err != nil {
 			return err
@@ -37,14 +47,122 @@ var listenCmd = &cobra.Command{
 			return err
 		}
 
+		code, err := cmd.Flags().GetString("code")
+		if err != nil {
+			return err
+		}
+
+		window, err := cmd.Flags().GetInt("window")
+		if err != nil {
+			return err
+		}
+
+		connections, err := cmd.Flags().GetInt("connections")
+		if err != nil {
+			return err
+		}
+
+		relay, err := cmd.Flags().GetBool("relay")
+		if err != nil {
+			return err
+		}
+
+		peers, err := cmd.Flags().GetStringSlice("peer")
+		if err != nil {
+			return err
+		}
+
+		include, err := cmd.Flags().GetStringArray("include")
+		if err != nil {
+			return err
+		}
+
+		exclude, err := cmd.Flags().GetStringArray("exclude")
+		if err != nil {
+			return err
+		}
+
+		pick, err := cmd.Flags().GetBool("pick")
+		if err != nil {
+			return err
+		}
+
+		var picker func([]transmission.FileInfo) ([]string, error)
+		if pick {
+			picker = pickFiles
+		}
+
+		toStdout, err := cmd.Flags().GetBool("stdout")
+		if err != nil {
+			return err
+		}
+
+		if toStdout && asJSON {
+			return fmt.Errorf("--stdout cannot be combined with --output json")
+		}
+
+		var output io.Writer
+		if toStdout {
+			output = os.Stdout
+		}
+
+		manifest, err := cmd.Flags().GetString("manifest")
+		if err != nil {
+			return err
+		}
+
+		preallocate, err := cmd.Flags().GetBool("preallocate")
+		if err != nil {
+			return err
+		}
+
+		//Interrupting saves the progress, so listening again resumes the download
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+
+		//Keep stdout for the received data or the json records
+		human := humanOutput(asJSON || toStdout)
+
+		var observer transmission.Observer = &terminalObserver{listener: true, out: human}
+		var records *jsonObserver
+		if asJSON {
+			records = newJSONObserver(os.Stdout, true, "")
+			observer = observers{&terminalObserver{listener: true, out: human, quiet: true}, records}
+		}
+
 		l := new(transmission.Peer)
-		err = l.Listen(transmission.Options{
+		err = l.ListenContext(ctx, transmission.Options{
 			DownloadFilePath: path,
 			MaxPieceRetries:  retries,
 			SenderAddress:    senderAddr,
+			Code:             code,
+			RequestWindow:    window,
+			Connections:      connections,
+			Relay:            relay,
+			Peers:            peers,
+			Include:          include,
+			Exclude:          exclude,
+			PickFiles:        picker,
+			Output:           output,
+			Observer:         observer,
+			Preallocate:      preallocate,
 		})
+		if records != nil {
+			if serr := records.summary(l.Metadata, err); err == nil {
+				err = serr
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		//Keep the checksums so the download can be checked again with nin verify
+		if manifest != "" {
+			return transmission.WriteManifest(manifest, l.Metadata.Manifest())
+		}
 
-		return err
+		return nil
 	},
 }
 
@@ -59,6 +177,17 @@ func init() {
 	listenCmd.PersistentFlags().Int("maxretry", 4, "Amount of retires of a piece before it download cancels")
 	listenCmd.PersistentFlags().String("path", "", "path to store the files")
 	listenCmd.PersistentFlags().Int("debug", 0, "debug level(default=0)")
+	listenCmd.PersistentFlags().String("code", "", "code phrase printed by the sender")
+	listenCmd.PersistentFlags().Int("window", transmission.DEFAULT_REQUEST_WINDOW, "number of piece requests kept in flight per connection(default=8)")
+	listenCmd.PersistentFlags().Int("connections", 1, "number of connections to open to the sender(default=1)")
+	listenCmd.PersistentFlags().Bool("relay", false, "serve downloaded pieces to other listeners until idle(default=false)")
+	listenCmd.PersistentFlags().StringSlice("peer", nil, "address of another sender or relay to download pieces from, can be repeated")
+	listenCmd.PersistentFlags().StringArray("include", nil, "only download files of a shared folder matching the pattern, e.g. 'docs/**', can be repeated")
+	listenCmd.PersistentFlags().StringArray("exclude", nil, "skip files of a shared folder matching the pattern, e.g. '*.mp4', can be repeated")
+	listenCmd.PersistentFlags().Bool("stdout", false, "write a single file or stream to stdout in order(default=false)")
+	listenCmd.PersistentFlags().Bool("pick", false, "choose the files to download from a list(default=false)")
+	listenCmd.PersistentFlags().String("manifest", "", "save the checksums of the download to this file for nin verify")
+	listenCmd.PersistentFlags().Bool("preallocate", false, "reserve disk space for every file before downloading(default=false)")
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// listenCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/knightfall22/nin/transmission"
+	"github.com/spf13/cobra"
+)
+
+// Machine readable description of what a sender offers, printed by `nin ls --json`.
+// It includes the manifest, so the output can be given to nin verify.
+type listing struct {
+	transmission.Manifest
+	ContentID  string `json:"content_id"`
+	PieceCount int    `json:"piece_count"`
+}
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:          "ls",
+	SilenceUsage: true,
+	Aliases:      []string{"list"},
+	Short:        "Show what a sender is offering without downloading it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, err := cmd.Flags().GetInt("debug")
+		if err != nil {
+			return err
+		}
+
+		transmission.Debug = debug
+
+		senderAddr, err := cmd.Flags().GetString("sender")
+		if err != nil {
+			return err
+		}
+
+		code, err := cmd.Flags().GetString("code")
+		if err != nil {
+			return err
+		}
+
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		l := new(transmission.Peer)
+		meta, err := l.Inspect(transmission.Options{
+			SenderAddress: senderAddr,
+			Code:          code,
+		})
+		if err != nil {
+			return err
+		}
+
+		out := listing{
+			Manifest:   *meta.Manifest(),
+			ContentID:  meta.ContentID(),
+			PieceCount: meta.NumPieces(),
+		}
+
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		}
+
+		printListing(out)
+		return nil
+	},
+}
+
+// Print the files as a tree, directories are shown once before their contents
+func printListing(l listing) {
+	fmt.Printf("%s (%s in %d files)\n", l.Name, formatSize(l.TotalSize), len(l.Files))
+
+	if !l.Single {
+		var previous []string
+		for _, f := range l.Files {
+			parts := strings.Split(f.Path, "/")
+			dirs := parts[:len(parts)-1]
+
+			//Skip the directories shared with the previous file
+			common := 0
+			for common < len(dirs) && common < len(previous) && dirs[common] == previous[common] {
+				common++
+			}
+
+			for i := common; i < len(dirs); i++ {
+				fmt.Printf("%s%s/\n", strings.Repeat("  ", i+1), dirs[i])
+			}
+
+			fmt.Printf("%s%s  %s\n", strings.Repeat("  ", len(dirs)+1), parts[len(parts)-1], formatSize(f.Size))
+			previous = dirs
+		}
+	}
+
+	fmt.Printf("Pieces: %d of %s (%s)\n", l.PieceCount, formatSize(int64(l.PieceLength)), l.Hash)
+	fmt.Printf("Content ID: %s\n", l.ContentID)
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	lsCmd.PersistentFlags().String("sender", "", "Address of the sender")
+	lsCmd.PersistentFlags().String("code", "", "code phrase printed by the sender")
+	lsCmd.PersistentFlags().Bool("json", false, "print the listing as JSON(default=false)")
+	lsCmd.PersistentFlags().Int("debug", 0, "debug level(default=0)")
+}
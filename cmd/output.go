@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/knightfall22/nin/transmission"
+	"github.com/spf13/cobra"
+)
+
+// Version of the records written by --output json. Fields may be added to a record without changing it,
+// renaming or removing a field or changing its meaning does. The schema is described in the readme.
+const JSON_OUTPUT_VERSION = 1
+
+// Least time between two progress records
+const PROGRESS_INTERVAL = time.Second
+
+// Read the global --output flag. Returns true for json.
+func jsonOutput(cmd *cobra.Command) (bool, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return false, err
+	}
+
+	switch output {
+	case "text":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unknown output format %q, expected text or json", output)
+}
+
+// Where messages meant for people go. With json output stdout only holds records.
+func humanOutput(asJSON bool) io.Writer {
+	if asJSON {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// Fields every record starts with
+type jsonHeader struct {
+	Version int       `json:"v"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+}
+
+type jsonReady struct {
+	jsonHeader
+	Address string `json:"address"`
+	Code    string `json:"code,omitempty"`
+}
+
+type jsonPeer struct {
+	jsonHeader
+	PeerID  string `json:"peer_id"`
+	Address string `json:"address"`
+}
+
+type jsonQueued struct {
+	jsonHeader
+	Position int `json:"position"`
+}
+
+type jsonMetadata struct {
+	jsonHeader
+	PeerID     string `json:"peer_id"`
+	Name       string `json:"name"`
+	TotalBytes int64  `json:"total_bytes"`
+	Files      int    `json:"files"`
+	Hash       string `json:"hash"`
+	ContentID  string `json:"content_id"`
+}
+
+type jsonFile struct {
+	jsonHeader
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Checksum string `json:"checksum"`
+	OK       bool   `json:"ok"`
+}
+
+type jsonPieceFailed struct {
+	jsonHeader
+	PeerID string `json:"peer_id"`
+	Piece  int    `json:"piece"`
+	Error  string `json:"error"`
+}
+
+type jsonProgress struct {
+	jsonHeader
+	Bytes          int64 `json:"bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+type jsonSummary struct {
+	jsonHeader
+	OK              bool                   `json:"ok"`
+	Error           string                 `json:"error,omitempty"`
+	DurationSeconds float64                `json:"duration_seconds"`
+	Bytes           int64                  `json:"bytes"`
+	BytesPerSecond  int64                  `json:"bytes_per_second"`
+	Listeners       *int                   `json:"listeners,omitempty"`
+	ContentID       string                 `json:"content_id,omitempty"`
+	Content         *transmission.Manifest `json:"content,omitempty"`
+}
+
+// Passes every event to each observer in turn
+type observers []transmission.Observer
+
+func (obs observers) Observe(e transmission.Event) {
+	for _, o := range obs {
+		o.Observe(e)
+	}
+}
+
+// Writes the events of `nin send` and `nin listen` to stdout as newline delimited json
+type jsonObserver struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	//Set on a listener, where pieces sent while relaying do not count towards the download
+	listener bool
+	//Code phrase listeners must provide, reported with the address
+	code string
+
+	start time.Time
+	//Bytes sent to every listener, or received and saved, and the total wanted. -1 when unknown.
+	bytes int64
+	total int64
+	//Listeners that reported finishing
+	finished int
+
+	reported      time.Time
+	reportedBytes int64
+}
+
+func newJSONObserver(w io.Writer, listener bool, code string) *jsonObserver {
+	now := time.Now()
+
+	return &jsonObserver{
+		enc:      json.NewEncoder(w),
+		listener: listener,
+		code:     code,
+		start:    now,
+		total:    -1,
+		reported: now,
+	}
+}
+
+func (o *jsonObserver) header(kind string, at time.Time) jsonHeader {
+	return jsonHeader{Version: JSON_OUTPUT_VERSION, Type: kind, Time: at.UTC()}
+}
+
+func (o *jsonObserver) Observe(e transmission.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch e.Kind {
+	case transmission.EventReady:
+		o.enc.Encode(jsonReady{o.header("ready", e.Time), e.Address, o.code})
+
+	case transmission.EventListenerConnected:
+		o.enc.Encode(jsonPeer{o.header("listener_joined", e.Time), e.PeerID, e.Address})
+
+	case transmission.EventListenerFinished:
+		o.finished++
+		o.enc.Encode(jsonPeer{o.header("listener_finished", e.Time), e.PeerID, e.Address})
+
+	case transmission.EventListenerDisconnected:
+		o.enc.Encode(jsonPeer{o.header("listener_left", e.Time), e.PeerID, e.Address})
+
+	case transmission.EventQueued:
+		o.enc.Encode(jsonQueued{o.header("queued", e.Time), e.Position})
+
+	case transmission.EventMetadataReceived:
+		manifest := e.Metadata.Manifest()
+		o.enc.Encode(jsonMetadata{
+			jsonHeader: o.header("metadata", e.Time),
+			PeerID:     e.PeerID,
+			Name:       manifest.Name,
+			TotalBytes: manifest.TotalSize,
+			Files:      len(manifest.Files),
+			Hash:       manifest.Hash,
+			ContentID:  e.Metadata.ContentID(),
+		})
+
+	case transmission.EventDownloadStarted:
+		o.bytes, o.total = e.Done, e.Total
+		o.reportedBytes = e.Done
+
+	case transmission.EventPieceSent:
+		if !o.listener {
+			o.bytes += e.Bytes
+			o.progress(e.Time, false)
+		}
+
+	case transmission.EventPieceVerified:
+		o.bytes = e.Done
+		o.progress(e.Time, false)
+
+	case transmission.EventPieceFailed:
+		o.enc.Encode(jsonPieceFailed{o.header("piece_failed", e.Time), e.PeerID, e.Piece, e.Err.Error()})
+
+	case transmission.EventFileCompleted:
+		o.enc.Encode(jsonFile{o.header("file_completed", e.Time), e.Path, e.Bytes, hex.EncodeToString(e.Checksum), e.Err == nil})
+
+	case transmission.EventDownloadFinished:
+		o.progress(e.Time, true)
+
+	case transmission.EventIdle:
+		o.enc.Encode(o.header("idle", e.Time))
+
+	case transmission.EventShutdown:
+		o.enc.Encode(o.header("shutdown", e.Time))
+	}
+}
+
+// Report the bytes moved and the throughput since the last report, at most once every PROGRESS_INTERVAL
+// unless forced. Must be called with o.mu held.
+func (o *jsonObserver) progress(at time.Time, force bool) {
+	elapsed := at.Sub(o.reported)
+	if !force && elapsed < PROGRESS_INTERVAL {
+		return
+	}
+
+	var rate int64
+	if elapsed > 0 {
+		rate = int64(float64(o.bytes-o.reportedBytes) / elapsed.Seconds())
+	}
+
+	o.enc.Encode(jsonProgress{o.header("progress", at), o.bytes, o.total, rate})
+	o.reported, o.reportedBytes = at, o.bytes
+}
+
+// Write the last record of a run. meta is nil when the transfer failed before the metadata was known.
+func (o *jsonObserver) summary(meta *transmission.Metadata, err error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	duration := now.Sub(o.start)
+
+	s := jsonSummary{
+		jsonHeader:      o.header("summary", now),
+		OK:              err == nil,
+		DurationSeconds: duration.Seconds(),
+		Bytes:           o.bytes,
+	}
+
+	if !o.listener {
+		s.Listeners = &o.finished
+	}
+
+	if duration > 0 {
+		s.BytesPerSecond = int64(float64(o.bytes) / duration.Seconds())
+	}
+
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if meta != nil {
+		s.ContentID = meta.ContentID()
+		s.Content = meta.Manifest()
+	}
+
+	return o.enc.Encode(s)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/knightfall22/nin/transmission"
+)
+
+// Interactive picker for `nin listen --pick`. Lists the shared files and reads a selection such as 1,3-5 from stdin.
+func pickFiles(files []transmission.FileInfo) ([]string, error) {
+	fmt.Fprintln(os.Stderr, "Files offered by the sender:")
+	for i, f := range files {
+		fmt.Fprintf(os.Stderr, "%4d) %s (%d bytes)\n", i+1, f.Path, f.Size)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "Files to download (e.g. 1,3-5, empty for all): ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+
+		indices, err := parseSelection(line, len(files))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		paths := make([]string, 0, len(indices))
+		for _, i := range indices {
+			paths = append(paths, files[i].Path)
+		}
+
+		return paths, nil
+	}
+}
+
+// Parse a comma separated list of numbers and ranges counted from 1 into indices counted from 0
+func parseSelection(line string, count int) ([]int, error) {
+	line = strings.TrimSpace(line)
+
+	var indices []int
+	if line == "" || line == "all" {
+		for i := range count {
+			indices = append(indices, i)
+		}
+		return indices, nil
+	}
+
+	for _, field := range strings.Split(line, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(field, "-")
+
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid selection %q", field)
+		}
+
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(to))
+			if err != nil {
+				return nil, fmt.Errorf("invalid selection %q", field)
+			}
+		}
+
+		if first < 1 || last > count || first > last {
+			return nil, fmt.Errorf("selection %q is out of range 1-%d", field, count)
+		}
+
+		for i := first; i <= last; i++ {
+			indices = append(indices, i-1)
+		}
+	}
+
+	return indices, nil
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/knightfall22/nin/transmission"
+	"github.com/schollz/progressbar/v3"
+)
+
+// Renders the events of `nin send` and `nin listen` on the terminal
+type terminalObserver struct {
+	//Set on a listener, which only listens for connections when relaying
+	listener bool
+	//Where messages go, the progress bar and warnings always go to stderr
+	out io.Writer
+	//Leave out the progress bar
+	quiet bool
+
+	address string
+	bar     *progressbar.ProgressBar
+}
+
+func (o *terminalObserver) Observe(e transmission.Event) {
+	switch e.Kind {
+	case transmission.EventReady:
+		o.address = e.Address
+		if o.listener {
+			fmt.Fprintf(o.out, "Relaying to other listeners on %s\n", e.Address)
+			return
+		}
+
+		fmt.Fprintln(o.out, "Ready to begin sending file")
+		fmt.Fprintf(o.out, "Listening on %s\n", e.Address)
+
+	case transmission.EventListenerConnected:
+		fmt.Fprintf(o.out, "Received connection from %s\n", e.Address)
+
+	case transmission.EventQueued:
+		if o.listener {
+			fmt.Fprintf(os.Stderr, "sender full, position %d in queue\n", e.Position)
+		}
+
+	case transmission.EventListenerFinished:
+		fmt.Fprintf(o.out, "%s has finished downloading\n", e.Address)
+
+	case transmission.EventDownloadStarted:
+		if o.quiet {
+			return
+		}
+
+		description := "Downloading file..."
+		if e.Total < 0 {
+			description = "Receiving..."
+		}
+
+		o.bar = progressbar.NewOptions64(e.Total,
+			progressbar.OptionSetDescription(description),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetWidth(40),
+			progressbar.OptionThrottle(5*time.Millisecond),
+			progressbar.OptionShowCount(),
+			progressbar.OptionOnCompletion(func() {
+				fmt.Fprint(os.Stderr, "\nDownload completed!\n")
+			}),
+			progressbar.OptionSpinnerType(14),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetRenderBlankState(true),
+			progressbar.OptionSetPredictTime(true),
+		)
+		o.bar.Add64(e.Done)
+
+	case transmission.EventPieceVerified:
+		if o.bar != nil {
+			o.bar.Add64(e.Bytes)
+		}
+
+	case transmission.EventDownloadFinished:
+		if o.bar != nil {
+			o.bar.Finish()
+		}
+
+		if o.address != "" {
+			fmt.Fprintf(o.out, "Download complete, relaying to other listeners on %s\n", o.address)
+		}
+
+	case transmission.EventIdle:
+		fmt.Fprintln(o.out, "server idled for too long, shutting down....")
+
+	case transmission.EventShutdown:
+		fmt.Fprintln(os.Stderr, "Closing server....")
+	}
+}
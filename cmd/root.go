@@ -40,4 +40,6 @@ func init() {
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	rootCmd.PersistentFlags().String("output", "text", "output format of send and listen: text or newline delimited json on stdout(default=text)")
 }
@@ -4,7 +4,13 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 
 	"github.com/knightfall22/nin/transmission"
 	"github.com/spf13/cobra"
@@ -12,7 +18,7 @@ import (
 
 // sendCmd represents the send command
 var sendCmd = &cobra.Command{
-	Use:          "send <path>",
+	Use:          "send <path|->",
 	Args:         cobra.MinimumNArgs(1),
 	SilenceUsage: true,
 	Aliases:      []string{"s"},
@@ -25,6 +31,13 @@ var sendCmd = &cobra.Command{
 
 		transmission.Debug = debug
 
+		asJSON, err := jsonOutput(cmd)
+		if err != nil {
+			return err
+		}
+
+		human := humanOutput(asJSON)
+
 		zip, err := cmd.Flags().GetString("zip")
 		if err != nil {
 			return err
@@ -45,12 +58,73 @@ var sendCmd = &cobra.Command{
 			return err
 		}
 
+		queue, err := cmd.Flags().GetInt("queue")
+		if err != nil {
+			return err
+		}
+
 		delay, err := cmd.Flags().GetDuration("delay")
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("delay", delay)
+		fmt.Fprintln(human, "delay", delay)
+
+		code, err := cmd.Flags().GetString("code")
+		if err != nil {
+			return err
+		}
+
+		insecure, err := cmd.Flags().GetBool("insecure")
+		if err != nil {
+			return err
+		}
+
+		if insecure {
+			code = ""
+		} else if code == "" {
+			code, err = transmission.GenerateCode()
+			if err != nil {
+				return err
+			}
+		}
+
+		hash, err := cmd.Flags().GetString("hash")
+		if err != nil {
+			return err
+		}
+
+		merkle, err := cmd.Flags().GetBool("merkle")
+		if err != nil {
+			return err
+		}
+
+		pieceSize, err := cmd.Flags().GetString("piece-size")
+		if err != nil {
+			return err
+		}
+
+		pieceLength, err := parsePieceSize(pieceSize)
+		if err != nil {
+			return err
+		}
+
+		symlinks, err := cmd.Flags().GetString("symlinks")
+		if err != nil {
+			return err
+		}
+
+		if code != "" {
+			fmt.Fprintf(human, "Code phrase: %s\n", code)
+			fmt.Fprintf(human, "On the other machine run: nin listen --code %s\n", code)
+		}
+
+		var observer transmission.Observer = &terminalObserver{out: human}
+		var records *jsonObserver
+		if asJSON {
+			records = newJSONObserver(os.Stdout, false, code)
+			observer = observers{&terminalObserver{out: human, quiet: true}, records}
+		}
 
 		p := new(transmission.Peer)
 		opts := transmission.Options{
@@ -59,14 +133,78 @@ var sendCmd = &cobra.Command{
 			ZipDeleteComplete:      zipDelete,
 			MulticastAddress:       multicast,
 			ListenerLimit:          listners,
+			QueueLimit:             queue,
 			AutomaticShutdownDelay: delay,
+			Code:                   code,
+			Hash:                   hash,
+			Merkle:                 merkle,
+			PieceLength:            pieceLength,
+			Symlinks:               symlinks,
+			Observer:               observer,
+		}
+
+		//nin send - reads what to send from stdin
+		if args[0] == "-" {
+			name, err := cmd.Flags().GetString("name")
+			if err != nil {
+				return err
+			}
+
+			opts.FilePath = ""
+			opts.Stream = os.Stdin
+			opts.StreamName = name
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+
+		//Interrupting is the usual way to stop a sender before it idles
+		err = p.SendContext(ctx, opts)
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+
+		if records != nil {
+			if serr := records.summary(p.Metadata, err); err == nil {
+				err = serr
+			}
 		}
 
-		err = p.Send(opts)
 		return err
 	},
 }
 
+// Parse a piece size such as 256KiB, 4M or 65536. Units are powers of 1024.
+func parsePieceSize(size string) (int, error) {
+	value := strings.ToLower(strings.TrimSpace(size))
+	if value == "auto" {
+		return transmission.AUTO_PIECE_LENGTH, nil
+	}
+
+	multiplier := 1
+	for _, unit := range []struct {
+		suffixes   []string
+		multiplier int
+	}{
+		{[]string{"kib", "kb", "k"}, 1024},
+		{[]string{"mib", "mb", "m"}, 1024 * 1024},
+	} {
+		for _, suffix := range unit.suffixes {
+			if trimmed, ok := strings.CutSuffix(value, suffix); ok {
+				value, multiplier = trimmed, unit.multiplier
+				break
+			}
+		}
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid piece size %q", size)
+	}
+
+	return n * multiplier, nil
+}
+
 func init() {
 	rootCmd.AddCommand(sendCmd)
 
@@ -78,8 +216,16 @@ func init() {
 	sendCmd.PersistentFlags().Bool("zipdelete", true, "delete zip folder after sending(default=true)")
 	sendCmd.PersistentFlags().String("multicast", "", "multicast address")
 	sendCmd.PersistentFlags().Int("listners", 0, "number of listners(default=4)")
+	sendCmd.PersistentFlags().Int("queue", 0, "number of listners that can wait for a free slot(default=16)")
 	sendCmd.PersistentFlags().Duration("delay", transmission.DefaultAutomaticShutdownDelay, "automatic shutdown delay(default=60s)")
 	sendCmd.PersistentFlags().Int("debug", 0, "debug level(default=0)")
+	sendCmd.PersistentFlags().String("code", "", "code phrase listeners must provide(default=generated)")
+	sendCmd.PersistentFlags().String("name", "stdin", "name listeners save the stream under when sending from stdin(default=stdin)")
+	sendCmd.PersistentFlags().String("hash", "sha256", "piece hash algorithm: sha256, blake3 or sha1(default=sha256)")
+	sendCmd.PersistentFlags().String("piece-size", "auto", "piece length, e.g. 256KiB or 4MiB, auto picks one from the total size(default=auto)")
+	sendCmd.PersistentFlags().Bool("merkle", false, "send a merkle root instead of every piece hash, for very large transfers(default=false)")
+	sendCmd.PersistentFlags().String("symlinks", "skip", "symbolic links in a folder: skip, follow or preserve(default=skip)")
+	sendCmd.PersistentFlags().Bool("insecure", false, "send without a code phrase or encryption(default=false)")
 	// sendCmd.PersistentFlags().Int("retries", 0, "max piece retries(default=0)")
 
 	// Cobra supports local flags which will only run when this command
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/knightfall22/nin/transmission"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:          "verify <manifest> <dir>",
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	Short:        "Check a download against its manifest",
+	Long: `Check every file downloaded into <dir> against the checksums in <manifest>.
+The manifest is written by nin listen --manifest, the output of nin ls --json works as well.
+<dir> is the directory the content was downloaded into, as given to nin listen --path.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifest, err := transmission.ReadManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := transmission.VerifyManifest(manifest, args[1]); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: %d files OK\n", manifest.Name, len(manifest.Files))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
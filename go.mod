@@ -2,15 +2,21 @@ module github.com/knightfall22/nin
 
 go 1.24.5
 
+require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/schollz/peerdiscovery v1.7.6
+	github.com/schollz/progressbar/v3 v3.18.0
+	github.com/spf13/cobra v1.9.1
+	lukechampine.com/blake3 v1.4.1
+)
+
 require (
 	github.com/gabriel-vasile/mimetype v1.4.10 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/peerdiscovery v1.7.6 // indirect
-	github.com/schollz/progressbar/v3 v3.18.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,48 @@
+package transmission
+
+// Bitfield tracks which pieces a peer holds. Bit i is set when piece i is present.
+// The high bit of the first byte represents piece 0.
+type Bitfield []byte
+
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(b) {
+		return false
+	}
+
+	return b[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+func (b Bitfield) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(b) {
+		return
+	}
+
+	b[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+func (b Bitfield) Clear(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(b) {
+		return
+	}
+
+	b[byteIndex] &^= 1 << (7 - uint(index%8))
+}
+
+// Count returns the number of set bits among the first numPieces pieces.
+func (b Bitfield) Count(numPieces int) int {
+	count := 0
+	for i := range numPieces {
+		if b.Has(i) {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,75 @@
+package transmission
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Number of secret words in a generated code phrase
+const CODE_WORDS = 3
+
+var ErrCodeRequired = fmt.Errorf("sender requires a code phrase")
+var ErrCodeNotUsed = fmt.Errorf("sender does not use a code phrase, refusing unencrypted transfer")
+
+// GenerateCode returns a code phrase such as "4821-otter-plaza-cedar".
+// The leading number is public and used to tell senders apart during discovery,
+// the words are the secret that keys the encrypted session.
+func GenerateCode() (string, error) {
+	tag, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{fmt.Sprintf("%04d", tag.Int64())}
+	for range CODE_WORDS {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWords))))
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, codeWords[idx.Int64()])
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// Public part of the code phrase that is announced during discovery
+func codeTag(code string) string {
+	tag, _, _ := strings.Cut(code, "-")
+	return tag
+}
+
+var codeWords = []string{
+	"acid", "acorn", "actor", "adult", "agent", "album", "alarm", "alert", "alien", "alley", "alpha",
+	"amber", "angel", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow", "atlas", "attic",
+	"audio", "autumn", "award", "bacon", "badge", "bagel", "baker", "banjo", "barge", "basil",
+	"basin", "beach", "beard", "bench", "berry", "bison", "blade", "blaze", "bloom", "board", "bonus",
+	"boost", "brain", "brass", "bread", "brick", "bride", "broom", "brush", "bucket", "buddy",
+	"bugle", "cabin", "cable", "camel", "candy", "canoe", "canyon", "cargo", "carol", "carrot",
+	"castle", "cedar", "chalk", "charm", "cheek", "chess", "chief", "chili", "choir", "cider",
+	"cinema", "circle", "citrus", "clamp", "cliff", "clock", "cloud", "clover", "coast", "cobra",
+	"cocoa", "comet", "coral", "cotton", "couch", "cover", "crane", "crater", "cream", "creek",
+	"crown", "cubic", "cycle", "daisy", "dance", "delta", "denim", "depot", "desert", "diary",
+	"dingo", "disco", "dock", "dolphin", "donkey", "dough", "dragon", "drama", "dream", "drum",
+	"eagle", "easel", "echo", "elbow", "ember", "empire", "engine", "epoch", "fable", "falcon",
+	"fancy", "farmer", "feast", "fence", "ferry", "fiber", "field", "finch", "flame", "flask",
+	"fleet", "flint", "flute", "focus", "forest", "fossil", "fox", "frost", "fruit", "galaxy",
+	"garden", "garlic", "gecko", "geyser", "giant", "ginger", "glacier", "globe", "goose", "grape",
+	"gravel", "guitar", "hammer", "harbor", "harvest", "hazel", "heart", "hedge", "helmet", "heron",
+	"honey", "hotel", "husky", "igloo", "island", "ivory", "jacket", "jaguar", "jelly", "jewel",
+	"jockey", "juice", "jungle", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lake",
+	"lantern", "laser", "lemon", "lily", "linen", "lizard", "llama", "lobby", "lotus", "lunar",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "metal", "meteor", "mint", "mirror",
+	"moose", "mosaic", "motor", "muffin", "nectar", "needle", "noodle", "oasis", "ocean", "olive",
+	"onion", "opera", "orbit", "orchid", "otter", "oyster", "paddle", "panda", "paper", "parrot",
+	"pasta", "peach", "pearl", "pebble", "pepper", "piano", "pilot", "pixel", "planet", "plaza",
+	"plum", "polar", "pony", "poppy", "prism", "pumpkin", "puzzle", "quartz", "quill", "rabbit",
+	"radar", "radio", "raven", "reef", "ribbon", "river", "robot", "rocket", "saddle", "salad",
+	"salmon", "sandal", "satin",
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
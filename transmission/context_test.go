@@ -0,0 +1,302 @@
+package transmission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendContextReadyAndCancel(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := make(chan net.Addr, 1)
+	sent := make(chan error, 1)
+
+	p := new(Peer)
+	go func() {
+		sent <- p.SendContext(ctx, Options{
+			FilePath: root,
+			Ready:    func(addr net.Addr) { ready <- addr },
+		})
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-ready:
+	case err := <-sent:
+		t.Fatalf("expected the sender to become ready got %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not report its address")
+	}
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.ListenContext(ctx, Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, fmt.Sprint(addr.(*net.TCPAddr).Port)),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	cancel()
+	select {
+	case err := <-sent:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the sender to be cancelled got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender kept running after its context was cancelled")
+	}
+
+	if _, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+		t.Fatal("expected the sender to stop accepting listeners")
+	}
+}
+
+// A sender that accepts connections and never answers
+func silentSender(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestListenContextCancel(t *testing.T) {
+	address := silentSender(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	l := new(Peer)
+	err := l.ListenContext(ctx, Options{SenderAddress: address, DownloadFilePath: t.TempDir()})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the listener to be cancelled got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("listener took %v to stop", elapsed)
+	}
+
+	//A context that is already done never connects
+	if err := l.ListenContext(ctx, Options{SenderAddress: address}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the listener to be cancelled got %v", err)
+	}
+}
+
+func TestListenUnexpectedMessage(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	//Answer the handshake with a metadata request instead of an acknowledgement
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DeserializeMessageFromReader(conn); err != nil {
+			return
+		}
+		conn.Write(requestMetadata())
+		DeserializeMessageFromReader(conn)
+	}()
+
+	p := new(Peer)
+	err = p.Listen(Options{SenderAddress: l.Addr().String(), DownloadFilePath: t.TempDir()})
+	if !errors.Is(err, ErrUnexpectedMessage) {
+		t.Fatalf("expected an unexpected message error got %v", err)
+	}
+}
+
+func TestVirtualFileWriteAtOutOfRange(t *testing.T) {
+	vf := &VirtualFile{
+		rootPath:     "file.bin",
+		downloadPath: t.TempDir(),
+		files:        []FileInfo{{Path: "file.bin", Size: 16}},
+		totalSize:    16,
+		single:       true,
+	}
+
+	if _, err := vf.WriteAt(make([]byte, 16), 0); err == nil {
+		t.Fatal("expected a virtual file without handles to refuse writes")
+	}
+
+	vf.handles = make([]fileHandle, 1)
+	defer vf.Close()
+
+	for _, offset := range []int64{-1, 17} {
+		if _, err := vf.WriteAt([]byte{1}, offset); err == nil {
+			t.Fatalf("expected a write at %d to be refused", offset)
+		}
+	}
+
+	if n, err := vf.WriteAt(make([]byte, 8), 8); err != nil || n != 8 {
+		t.Fatalf("expected 8 bytes written got %d (%v)", n, err)
+	}
+}
+
+func TestSendContextSurvivesMalformedFrame(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := make(chan net.Addr, 1)
+	dropped := make(chan error, 4)
+	sent := make(chan error, 1)
+
+	p := new(Peer)
+	go func() {
+		sent <- p.SendContext(ctx, Options{
+			FilePath: root,
+			Ready:    func(addr net.Addr) { ready <- addr },
+			Observer: ObserverFunc(func(e Event) {
+				if e.Kind == EventListenerDisconnected && e.Err != nil {
+					dropped <- e.Err
+				}
+			}),
+		})
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-ready:
+	case err := <-sent:
+		t.Fatalf("expected the sender to become ready got %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not report its address")
+	}
+
+	conn := dialHandshake(t, addr.String(), "receiver_malformed")
+	defer conn.Close()
+
+	if msg, err := DeserializeMessageFromReader(conn); err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected the listener to be acknowledged got %+v %v", msg, err)
+	}
+
+	if _, err := conn.Write(frame(1, MessageRequestPiece, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	//Only the connection that sent the frame is dropped, with the reason
+	select {
+	case err := <-dropped:
+		if err == nil {
+			t.Fatal("expected the reason the listener was dropped")
+		}
+	case err := <-sent:
+		t.Fatalf("expected the sender to keep running got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the malformed listener was not dropped")
+	}
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	if err := l.ListenContext(ctx, Options{SenderAddress: addr.String(), DownloadFilePath: downloadPath}); err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	cancel()
+	select {
+	case err := <-sent:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the sender to be cancelled got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender kept running after its context was cancelled")
+	}
+}
+
+func TestListenContextMalformedMetadata(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	//Acknowledge the handshake properly, then answer the metadata request with a single byte
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DeserializeMessageFromReader(conn); err != nil {
+			return
+		}
+		conn.Write(senderListenerAck(&Handshake{Version: PROTOCOL_VERSION, PeerID: "sender_malformed", Capabilities: CapHashSHA256 | CapPipelining}))
+
+		if _, err := DeserializeMessageFromReader(conn); err != nil {
+			return
+		}
+		conn.Write(frame(2, MessageMetadata, []byte{1}))
+		DeserializeMessageFromReader(conn)
+	}()
+
+	p := new(Peer)
+	err = p.ListenContext(context.Background(), Options{SenderAddress: l.Addr().String(), DownloadFilePath: t.TempDir()})
+	if err == nil {
+		t.Fatal("expected malformed metadata to be refused")
+	}
+}
+
+func TestListenRefusesOldSender(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DeserializeMessageFromReader(conn); err != nil {
+			return
+		}
+		conn.Write(senderListenerAck(&Handshake{Version: MIN_PROTOCOL_VERSION - 1, PeerID: "sender_old", Capabilities: CapHashSHA1}))
+		DeserializeMessageFromReader(conn)
+	}()
+
+	p := new(Peer)
+	err = p.ListenContext(context.Background(), Options{SenderAddress: l.Addr().String(), DownloadFilePath: t.TempDir()})
+	if err == nil || !strings.Contains(err.Error(), "older than the minimum") {
+		t.Fatalf("expected an old sender to be refused got %v", err)
+	}
+}
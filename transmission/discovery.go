@@ -0,0 +1,183 @@
+package transmission
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/peerdiscovery"
+)
+
+const ANNOUNCEMENT_PREFIX = "hello"
+
+// What a sender or relay broadcasts on the local network.
+// Encoded as hello<port>[;key=value...], e.g. hello9009;code=4821;role=relay
+type announcement struct {
+	Port string
+	//Public part of the sender's code phrase, empty when the sender does not use one
+	CodeTag string
+	//Set by listeners relaying the pieces they have downloaded
+	Relay bool
+	//Hex encoded info hash of the content on offer, empty for older senders
+	Content string
+}
+
+func (a announcement) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ANNOUNCEMENT_PREFIX)
+	buf.WriteString(a.Port)
+
+	if a.CodeTag != "" {
+		fmt.Fprintf(&buf, ";code=%s", a.CodeTag)
+	}
+
+	if a.Relay {
+		buf.WriteString(";role=relay")
+	}
+
+	if a.Content != "" {
+		fmt.Fprintf(&buf, ";content=%s", a.Content)
+	}
+
+	return buf.Bytes()
+}
+
+func parseAnnouncement(payload []byte) (announcement, bool) {
+	var a announcement
+
+	if !bytes.HasPrefix(payload, []byte(ANNOUNCEMENT_PREFIX)) {
+		return a, false
+	}
+
+	fields := strings.Split(string(bytes.TrimPrefix(payload, []byte(ANNOUNCEMENT_PREFIX))), ";")
+	a.Port = fields[0]
+	if a.Port == "" {
+		return a, false
+	}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "code":
+			a.CodeTag = value
+		case "role":
+			a.Relay = value == "relay"
+		case "content":
+			a.Content = value
+		}
+	}
+
+	return a, true
+}
+
+// What this peer announces for the content it is offering
+func (p *Peer) announcement() announcement {
+	return announcement{
+		Port:    p.portStr,
+		CodeTag: codeTag(p.code),
+		Relay:   p.State == relay,
+		Content: p.Metadata.ContentID(),
+	}
+}
+
+// A sender or relay found on the local network
+type discoveredPeer struct {
+	address string
+	announcement
+}
+
+// Search the local network for senders and relays. When the listener has a code phrase only peers announcing
+// the same code tag are considered, otherwise only peers without one. Senders are listed before relays.
+func (p *Peer) discoverPeers(ctx context.Context) ([]discoveredPeer, error) {
+	p.dlog("attempting to discover peers")
+
+	stopChan := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() { close(stopChan) })
+	defer stop()
+
+	var discoveries []peerdiscovery.Discovered
+	var wg sync.WaitGroup
+	var dmu sync.Mutex
+	var err error
+
+	discover := func(version peerdiscovery.IPVersion) {
+		defer wg.Done()
+
+		found, err1 := peerdiscovery.Discover(peerdiscovery.Settings{
+			Limit:            -1,
+			Payload:          []byte("ok"),
+			TimeLimit:        2 * time.Second,
+			Delay:            20 * time.Millisecond,
+			MulticastAddress: p.MulticastAddress,
+			IPVersion:        version,
+			StopChan:         stopChan,
+		})
+
+		dmu.Lock()
+		if err1 != nil && err == nil {
+			err = err1
+		}
+		discoveries = append(discoveries, found...)
+		dmu.Unlock()
+	}
+
+	wg.Add(2)
+	go discover(peerdiscovery.IPv4)
+	go discover(peerdiscovery.IPv6)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(discoveries) == 0 {
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("no peers found")
+	}
+
+	p.dlog("all discovered peers %+v\n", discoveries)
+
+	var senders, relays []discoveredPeer
+	seen := make(map[string]bool)
+	for i, discovered := range discoveries {
+		a, ok := parseAnnouncement(discovered.Payload)
+		if !ok {
+			p.dlog("skipping discovery %d", i)
+			continue
+		}
+
+		if a.CodeTag != codeTag(p.code) {
+			p.dlog("skipping discovery %d, code does not match", i)
+			continue
+		}
+
+		address := net.JoinHostPort(discovered.Address, a.Port)
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		if err := PingServer(address); err != nil {
+			continue
+		}
+
+		if a.Relay {
+			relays = append(relays, discoveredPeer{address: address, announcement: a})
+		} else {
+			senders = append(senders, discoveredPeer{address: address, announcement: a})
+		}
+	}
+
+	if len(senders)+len(relays) == 0 {
+		return nil, fmt.Errorf("no peers found")
+	}
+
+	return append(senders, relays...), nil
+}
@@ -0,0 +1,376 @@
+package transmission
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrContentMismatch = errors.New("peer is offering different content")
+
+// A sender or relay the listener downloads pieces from
+type remotePeer struct {
+	address string
+	conn    net.Conn
+
+	//What the peer agreed to during the handshake
+	handshake *Handshake
+
+	//Pieces the peer holds. nil means it holds every piece.
+	have Bitfield
+}
+
+// Reported when a download connection ends
+type peerError struct {
+	peer *remotePeer
+	err  error
+}
+
+// Connections a listener opened, so cancelling it can close them all at once.
+// The zero value is ready to use.
+type connSet struct {
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+// Track conn. Returns false and closes conn when the set was already closed.
+func (s *connSet) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return false
+	}
+
+	s.conns = append(s.conns, conn)
+	return true
+}
+
+func (s *connSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Connect to a peer and perform the handshake
+func (p *Peer) openPeerConn(ctx context.Context, address string) (*remotePeer, error) {
+	conn, err := p.connectToPeer(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	//Closed as soon as ctx is cancelled, which also aborts the handshake
+	if !p.dialed.add(conn) {
+		return nil, ctx.Err()
+	}
+
+	secured, ack, err := p.listenerSenderHandshake(conn)
+	if err != nil {
+		p.dlog("an error occurred sending sender handshake: %v\n", err)
+		conn.Close()
+		return nil, err
+	}
+
+	return &remotePeer{address: address, conn: secured, handshake: ack}, nil
+}
+
+// Ask the peer which pieces it holds. Peers that do not answer bitfield requests are senders holding everything.
+func (p *Peer) requestBitfield(peer *remotePeer) error {
+	if !peer.handshake.Capabilities.Has(CapBitfield) {
+		return nil
+	}
+
+	if err := peer.conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+
+	defer peer.conn.SetDeadline(time.Time{})
+
+	msg := Message{ID: MessageRequestBitfield}
+	if _, err := peer.conn.Write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	reply, err := DeserializeMessageFromReader(peer.conn)
+	if err != nil {
+		return err
+	}
+
+	if reply.ID != MessageBitfield {
+		return fmt.Errorf("expected a bitfield, got message %d", reply.ID)
+	}
+
+	infoHash, have, err := UnmarshallBitfield(reply)
+	if err != nil {
+		return err
+	}
+
+	if infoHash != p.Metadata.InfoHash() {
+		return ErrContentMismatch
+	}
+
+	if have.Count(p.Metadata.NumPieces()) < p.Metadata.NumPieces() {
+		peer.have = have
+	}
+
+	return nil
+}
+
+// Download pieces over a single connection keeping up to window requests outstanding.
+// The peer answers requests in order, so responses are matched to requests first in first out.
+// Have messages may arrive at any time and widen what is requested from the peer.
+// On failure every piece still in flight is handed back to the scheduler for the other connections.
+func (p *Peer) download(peer *remotePeer, window int, sched *pieceScheduler, result chan<- PieceBlock, done <-chan struct{}) error {
+	conn := peer.conn
+	slots := make(chan struct{}, window)
+	inflight := make(chan int, window)
+	quit := make(chan struct{})
+	writeErr := make(chan error, 1)
+
+	//The read deadline is only armed while requests are outstanding,
+	//a relay may go quiet for a long time between have messages
+	var dmu sync.Mutex
+	outstanding := 0
+	arm := func(delta int) {
+		dmu.Lock()
+		defer dmu.Unlock()
+
+		outstanding += delta
+		if outstanding > 0 {
+			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	//Requester: keep the window full
+	go func() {
+		defer close(inflight)
+
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			case <-done:
+				return
+			}
+
+			var index int
+			for {
+				idx, ok, wait := sched.next(peer)
+				if ok {
+					index = idx
+					break
+				}
+
+				select {
+				case <-wait:
+				case <-quit:
+					return
+				case <-done:
+					return
+				}
+			}
+
+			inflight <- index
+			arm(1)
+
+			p.dlog("requesting piece %d from %s", index, peer.address)
+			if _, err := conn.Write(requestPiece(index)); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	fail := func(err error, current int) error {
+		close(quit)
+		//Unblocks the requester if it is stuck writing
+		conn.Close()
+
+		if current >= 0 {
+			sched.put(peer, current)
+		}
+
+		for index := range inflight {
+			sched.put(peer, index)
+		}
+
+		select {
+		case <-done:
+			//The download finished, the connection was closed on purpose
+			return nil
+		default:
+		}
+
+		p.dlog("an error has occured while listening %v\n", err)
+		return err
+	}
+
+	for {
+		msg, err := DeserializeMessageFromReader(conn)
+		if err != nil {
+			select {
+			case err = <-writeErr:
+			default:
+			}
+			return fail(err, -1)
+		}
+
+		if msg.ID == MessageHave {
+			index, err := parseHave(msg.Payload, p.Metadata.NumPieces())
+			if err != nil {
+				return fail(err, -1)
+			}
+
+			p.dlog("%s now has piece %d", peer.address, index)
+			sched.gained(peer, index)
+			continue
+		}
+
+		//Anything else answers the oldest outstanding request
+		var index int
+		select {
+		case idx, ok := <-inflight:
+			if !ok {
+				return fail(fmt.Errorf("unexpected message %d", msg.ID), -1)
+			}
+			index = idx
+		default:
+			return fail(fmt.Errorf("unexpected message %d", msg.ID), -1)
+		}
+		arm(-1)
+
+		if msg.ID == MessageError {
+			perr, err := UnmarshallError(msg)
+			if err != nil {
+				return fail(err, index)
+			}
+
+			if perr.Code != ErrorPieceUnavailable {
+				return fail(perr, index)
+			}
+
+			//The peer does not have the piece after all, let another peer serve it
+			if !sched.unavailable(peer, index) {
+				return fail(perr, index)
+			}
+
+			<-slots
+			continue
+		}
+
+		if msg.ID != MessagePiece {
+			return fail(fmt.Errorf("expected a piece, got message %d", msg.ID), index)
+		}
+
+		resPiece, err := UnmarshallPiece(msg)
+		if err != nil {
+			return fail(err, index)
+		}
+
+		if int(resPiece.Index) != index {
+			return fail(fmt.Errorf("expected piece %d, got piece %d", index, resPiece.Index), index)
+		}
+		p.dlog("received piece %d from %s", index, peer.address)
+		p.emit(Event{Kind: EventPieceReceived, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: index, Bytes: int64(len(resPiece.Buf))})
+
+		<-slots
+
+		if !p.verifyPiece(resPiece) {
+			p.mu.Lock()
+			//The budget is shared by every connection, so it must not go below zero
+			retry := p.MaxPieceRetries > 0
+			if retry {
+				p.MaxPieceRetries--
+			}
+			p.mu.Unlock()
+
+			resPiece.Release()
+			if retry {
+				p.dlog("piece at index %d does not match retrying....", resPiece.Index)
+				p.emit(Event{Kind: EventPieceFailed, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: index, Err: fmt.Errorf("piece at index %d does not match, retrying", index)})
+				sched.put(peer, index)
+				continue
+			}
+
+			p.dlog("piece at index %d does not match", resPiece.Index)
+			err := fmt.Errorf("piece at index %d does not match", index)
+			p.emit(Event{Kind: EventPieceFailed, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: index, Err: err})
+			return fail(err, index)
+		}
+
+		//Another connection delivered it first during the endgame
+		if !sched.finish(index) {
+			resPiece.Release()
+			continue
+		}
+
+		select {
+		case result <- *resPiece:
+		case <-done:
+			return fail(nil, -1)
+		}
+	}
+}
+
+// <info hash><bitfield>
+func MarshallBitfield(infoHash [20]byte, have Bitfield) *Message {
+	var payload bytes.Buffer
+
+	payload.Write(infoHash[:])
+	payload.Write(have)
+
+	return &Message{ID: MessageBitfield, Payload: payload.Bytes()}
+}
+
+func UnmarshallBitfield(message *Message) ([20]byte, Bitfield, error) {
+	var infoHash [20]byte
+
+	if len(message.Payload) < len(infoHash) {
+		return infoHash, nil, fmt.Errorf("bitfield message too short")
+	}
+
+	copy(infoHash[:], message.Payload)
+	have := Bitfield(bytes.Clone(message.Payload[len(infoHash):]))
+
+	return infoHash, have, nil
+}
+
+// <index>
+func haveMessage(index int) []byte {
+	msg := Message{ID: MessageHave}
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	msg.Payload = payload
+
+	return msg.Serialize()
+}
+
+func parseHave(payload []byte, numPieces int) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("malformed have message")
+	}
+
+	index := int(binary.BigEndian.Uint32(payload))
+	if index >= numPieces {
+		return 0, fmt.Errorf("have message for piece %d out of range", index)
+	}
+
+	return index, nil
+}
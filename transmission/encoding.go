@@ -0,0 +1,362 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// The payload of MessageMetadata, sent to peers that agreed to protocol version 3 or later.
+// Every integer is big endian. A string is <length uint32><utf-8 bytes>, at most MAX_STRING_LENGTH long.
+// A byte field is <length uint8><bytes>.
+//
+//	<magic "NINM"><encoding version uint16><flags uint8>
+//	<name string><type string>
+//	<hash algorithm uint8><piece length uint32><content length uint64>
+//	<checksum bytes>
+//	<piece count uint32><piece hash length uint8><piece hashes, count * length bytes>
+//	<entry count uint32><entries>
+//
+// Flags: 1 single file, 2 merkle mode, 4 stream.
+// Hash algorithms: 0 sha1, 1 sha256, 2 blake3. In merkle mode the checksum is the root of the piece hash tree
+// and there are no piece hashes. When there are piece hashes their length is the algorithm's digest size.
+// Merkle mode content has at most MAX_MERKLE_PIECES pieces.
+//
+// Each entry, in the order the content is laid out:
+//
+//	<kind uint8><entry flags uint8><path string><size uint64><mode uint32>
+//	<modification time seconds int64><modification time nanoseconds uint32>
+//	<link target string><checksum bytes>
+//
+// Kinds: 0 file, 1 directory, 2 symlink. Entry flag 1 means the modification time is set.
+// Paths are relative to the content's name and separated by forward slashes. An entry starts where
+// the previous one ends, so offsets are not sent. Mode holds the permission bits.
+const METADATA_ENCODING_VERSION = 1
+
+// Protocol version from which the metadata is sent in the binary encoding
+const METADATA_BINARY_PROTOCOL_VERSION = 3
+
+const (
+	//Most entries and piece hashes a listener decodes. Larger metadata is refused before anything is allocated.
+	MAX_METADATA_ENTRIES = 1 << 20
+	MAX_METADATA_PIECES  = 1 << 24
+	//Most pieces in merkle mode. The hash tree is sized from the piece count alone, not from bytes that were sent.
+	MAX_MERKLE_PIECES = 1 << 18
+)
+
+const (
+	METADATA_FLAG_SINGLE = 1 << iota
+	METADATA_FLAG_MERKLE
+	METADATA_FLAG_STREAM
+)
+
+const ENTRY_FLAG_MODTIME = 1 << 0
+
+var metadataMagic = []byte("NINM")
+
+var (
+	ErrMalformedMetadata          = errors.New("malformed metadata")
+	ErrUnsupportedMetadataVersion = errors.New("unsupported metadata encoding version")
+)
+
+func encodeMetadata(m *Metadata) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.Write(metadataMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(METADATA_ENCODING_VERSION))
+
+	var flags uint8
+	if m.Single {
+		flags |= METADATA_FLAG_SINGLE
+	}
+	if m.Merkle {
+		flags |= METADATA_FLAG_MERKLE
+	}
+	if m.Stream {
+		flags |= METADATA_FLAG_STREAM
+	}
+	buf.WriteByte(flags)
+
+	writeString(&buf, m.Name)
+	writeString(&buf, m.Type)
+
+	buf.WriteByte(uint8(m.HashAlgorithm))
+	binary.Write(&buf, binary.BigEndian, uint32(m.PieceLength))
+	binary.Write(&buf, binary.BigEndian, uint64(m.FileLength))
+
+	if err := writeBytes(&buf, m.Checksum); err != nil {
+		return nil, err
+	}
+
+	if len(m.Pieces) > MAX_METADATA_PIECES || len(m.Folders) > MAX_METADATA_ENTRIES {
+		return nil, fmt.Errorf("%w: %d pieces and %d entries", ErrMalformedMetadata, len(m.Pieces), len(m.Folders))
+	}
+
+	if m.Merkle && m.PieceLength > 0 && m.NumPieces() > MAX_MERKLE_PIECES {
+		return nil, fmt.Errorf("%w: %d pieces in merkle mode, use larger pieces", ErrMalformedMetadata, m.NumPieces())
+	}
+
+	//Listeners refuse hashes that are not as long as the algorithm's digest
+	var pieceLength int
+	if len(m.Pieces) > 0 {
+		pieceLength = m.HashAlgorithm.Size()
+	}
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.Pieces)))
+	buf.WriteByte(uint8(pieceLength))
+	for _, piece := range m.Pieces {
+		if len(piece) != pieceLength || pieceLength > 255 {
+			return nil, ErrMalformedPieceHash
+		}
+
+		buf.Write(piece)
+	}
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.Folders)))
+	for _, f := range m.Folders {
+		buf.WriteByte(uint8(f.Kind))
+
+		var entryFlags uint8
+		if !f.ModTime.IsZero() {
+			entryFlags |= ENTRY_FLAG_MODTIME
+		}
+		buf.WriteByte(entryFlags)
+
+		writeString(&buf, filepath.ToSlash(f.Path))
+		binary.Write(&buf, binary.BigEndian, uint64(f.Size))
+		binary.Write(&buf, binary.BigEndian, uint32(f.Mode.Perm()))
+
+		var seconds int64
+		var nanoseconds uint32
+		if !f.ModTime.IsZero() {
+			seconds, nanoseconds = f.ModTime.Unix(), uint32(f.ModTime.Nanosecond())
+		}
+		binary.Write(&buf, binary.BigEndian, seconds)
+		binary.Write(&buf, binary.BigEndian, nanoseconds)
+
+		writeString(&buf, filepath.ToSlash(f.LinkTarget))
+		if err := writeBytes(&buf, f.Checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeMetadata(payload []byte) (*Metadata, error) {
+	buf := bytes.NewReader(payload)
+
+	magic := make([]byte, len(metadataMagic))
+	if _, err := io.ReadFull(buf, magic); err != nil || !bytes.Equal(magic, metadataMagic) {
+		return nil, fmt.Errorf("%w: missing header", ErrMalformedMetadata)
+	}
+
+	var header struct {
+		Version uint16
+		Flags   uint8
+	}
+	if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	if header.Version != METADATA_ENCODING_VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedMetadataVersion, header.Version)
+	}
+
+	m := Metadata{
+		Single: header.Flags&METADATA_FLAG_SINGLE != 0,
+		Merkle: header.Flags&METADATA_FLAG_MERKLE != 0,
+		Stream: header.Flags&METADATA_FLAG_STREAM != 0,
+	}
+
+	var err error
+	if m.Name, err = readString(buf); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	if m.Type, err = readString(buf); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	var layout struct {
+		Hash        uint8
+		PieceLength uint32
+		FileLength  uint64
+	}
+	if err := binary.Read(buf, binary.BigEndian, &layout); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	if layout.PieceLength > MAX_PIECE_LENGTH || layout.FileLength > MAX_CONTENT_LENGTH {
+		return nil, fmt.Errorf("%w: piece length %d, content length %d", ErrMalformedMetadata, layout.PieceLength, layout.FileLength)
+	}
+
+	m.HashAlgorithm = HashAlgorithm(layout.Hash)
+	m.PieceLength = int32(layout.PieceLength)
+	m.FileLength = int64(layout.FileLength)
+
+	if m.Merkle && m.PieceLength > 0 && m.NumPieces() > MAX_MERKLE_PIECES {
+		return nil, fmt.Errorf("%w: %d pieces in merkle mode", ErrMalformedMetadata, m.NumPieces())
+	}
+
+	if m.Checksum, err = readBytes(buf); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	var pieces struct {
+		Count  uint32
+		Length uint8
+	}
+	if err := binary.Read(buf, binary.BigEndian, &pieces); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	//Every hash is as long as the algorithm's digest, otherwise a count of empty hashes would still allocate
+	if pieces.Count > 0 && int(pieces.Length) != m.HashAlgorithm.Size() {
+		return nil, fmt.Errorf("%w: %d byte piece hashes for %s", ErrMalformedMetadata, pieces.Length, m.HashAlgorithm)
+	}
+
+	//The hashes must already be in the payload, so a forged count cannot make the listener allocate
+	if pieces.Count > MAX_METADATA_PIECES || int64(pieces.Count)*int64(pieces.Length) > int64(buf.Len()) {
+		return nil, fmt.Errorf("%w: %d piece hashes", ErrMalformedMetadata, pieces.Count)
+	}
+
+	if pieces.Count > 0 {
+		hashes := make([]byte, int(pieces.Count)*int(pieces.Length))
+		if _, err := io.ReadFull(buf, hashes); err != nil {
+			return nil, malformedMetadata(err)
+		}
+
+		m.Pieces = make([][]byte, pieces.Count)
+		for i := range m.Pieces {
+			m.Pieces[i] = hashes[i*int(pieces.Length) : (i+1)*int(pieces.Length)]
+		}
+	}
+
+	var entries uint32
+	if err := binary.Read(buf, binary.BigEndian, &entries); err != nil {
+		return nil, malformedMetadata(err)
+	}
+
+	//Every entry takes at least this many bytes
+	const minEntryLength = 2 + 4 + 8 + 4 + 8 + 4 + 4 + 1
+	if entries > MAX_METADATA_ENTRIES || int64(entries)*minEntryLength > int64(buf.Len()) {
+		return nil, fmt.Errorf("%w: %d entries", ErrMalformedMetadata, entries)
+	}
+
+	if entries > 0 {
+		m.Folders = make([]FileInfo, entries)
+	}
+
+	var offset int64
+	for i := range m.Folders {
+		f, err := decodeEntry(buf)
+		if err != nil {
+			return nil, malformedMetadata(err)
+		}
+
+		f.CummulativeOffset = offset
+		offset += f.Size
+		m.Folders[i] = f
+	}
+
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("%w: %d unexpected trailing bytes", ErrMalformedMetadata, buf.Len())
+	}
+
+	return &m, nil
+}
+
+func decodeEntry(buf *bytes.Reader) (FileInfo, error) {
+	var f FileInfo
+
+	var header struct {
+		Kind  uint8
+		Flags uint8
+	}
+	if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+		return f, err
+	}
+	f.Kind = FileKind(header.Kind)
+
+	path, err := readString(buf)
+	if err != nil {
+		return f, err
+	}
+	f.Path = filepath.FromSlash(path)
+
+	var attributes struct {
+		Size        uint64
+		Mode        uint32
+		Seconds     int64
+		Nanoseconds uint32
+	}
+	if err := binary.Read(buf, binary.BigEndian, &attributes); err != nil {
+		return f, err
+	}
+
+	if attributes.Size > MAX_CONTENT_LENGTH || attributes.Nanoseconds >= uint32(time.Second) {
+		return f, fmt.Errorf("invalid attributes for %q", path)
+	}
+
+	f.Size = int64(attributes.Size)
+	f.Mode = fs.FileMode(attributes.Mode).Perm()
+	if header.Flags&ENTRY_FLAG_MODTIME != 0 {
+		f.ModTime = time.Unix(attributes.Seconds, int64(attributes.Nanoseconds))
+	}
+
+	target, err := readString(buf)
+	if err != nil {
+		return f, err
+	}
+	f.LinkTarget = filepath.FromSlash(target)
+
+	if f.Checksum, err = readBytes(buf); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+func malformedMetadata(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return fmt.Errorf("%w: %v", ErrMalformedMetadata, err)
+}
+
+// <length uint8><bytes>, used for digests
+func writeBytes(buf *bytes.Buffer, b []byte) error {
+	if len(b) > 255 {
+		return fmt.Errorf("%w: %d byte field", ErrMalformedMetadata, len(b))
+	}
+
+	buf.WriteByte(uint8(len(b)))
+	buf.Write(b)
+
+	return nil
+}
+
+func readBytes(buf io.Reader) ([]byte, error) {
+	var length uint8
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
@@ -0,0 +1,255 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Fail the test unless both hold the same metadata. Modification times are compared as instants.
+func compareMetadata(t *testing.T, want, got *Metadata) {
+	t.Helper()
+
+	if len(want.Folders) != len(got.Folders) {
+		t.Fatalf("expected %d entries got %d", len(want.Folders), len(got.Folders))
+	}
+
+	for i := range want.Folders {
+		if !want.Folders[i].ModTime.Equal(got.Folders[i].ModTime) {
+			t.Fatalf("expected %s modified at %v got %v", want.Folders[i].Path, want.Folders[i].ModTime, got.Folders[i].ModTime)
+		}
+	}
+
+	stripped := func(m *Metadata) Metadata {
+		c := *m
+		c.Folders = append([]FileInfo(nil), m.Folders...)
+		for i := range c.Folders {
+			c.Folders[i].ModTime = time.Time{}
+		}
+
+		return c
+	}
+
+	if a, b := stripped(want), stripped(got); !reflect.DeepEqual(a, b) {
+		t.Fatalf("expected %+v got %+v", a, b)
+	}
+}
+
+func TestMetadataEncodingRoundTrip(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 0)
+	if err := os.Symlink("file0.bin", filepath.Join(root, "dir0", "link.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []MetadataOptions{
+		{Hash: HashSHA256, Symlinks: SymlinkPreserve},
+		{Hash: HashBLAKE3, Merkle: true, PieceLength: MIN_PIECE_LENGTH},
+		{Hash: HashSHA1},
+	}
+
+	for _, opts := range tests {
+		for _, path := range []string{root, filepath.Join(root, "dir1", "file1.bin")} {
+			meta, vf, err := GenerateMetadataWithOptions(path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vf.Close()
+
+			message, err := MarshallMetadata(meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := UnmarshallMetadata(message)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+
+			compareMetadata(t, meta, decoded)
+			if decoded.ContentID() != meta.ContentID() {
+				t.Fatalf("expected content id %s got %s", meta.ContentID(), decoded.ContentID())
+			}
+		}
+	}
+
+	stream := streamMetadata("stdin", HashBLAKE3, PIECELENGTH)
+	message, err := MarshallMetadata(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := UnmarshallMetadata(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareMetadata(t, stream, decoded)
+}
+
+// Metadata encoded by version 1. Changing the encoding breaks every peer that implements it,
+// so this must only change along with METADATA_ENCODING_VERSION.
+const goldenMetadata = "4e494e4d00010000000008666f6c6465722d6100000000" +
+	"0100004000000000000000005003616263" +
+	"0000000220" + "0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a" +
+	"0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d" +
+	"00000002" +
+	"010100000001610000000000000000000001ed0000000065a2b8c0000001f40000000000" +
+	"000000000007612f622e7478740000000000000050000001a40000000000000000000000000000000001ff"
+
+func goldenMetadataValue() *Metadata {
+	return &Metadata{
+		Name:          "folder-a",
+		PieceLength:   16384,
+		HashAlgorithm: HashSHA256,
+		FileLength:    80,
+		Checksum:      []byte("abc"),
+		Pieces:        [][]byte{bytes.Repeat([]byte{0x0a}, 32), bytes.Repeat([]byte{0x0d}, 32)},
+		Folders: []FileInfo{
+			{Path: "a", Kind: FileKindDir, Mode: 0755, ModTime: time.Unix(1705162944, 500)},
+			{Path: filepath.Join("a", "b.txt"), Size: 80, Mode: 0644, Checksum: []byte{0xff}},
+		},
+	}
+}
+
+func TestMetadataEncodingGolden(t *testing.T) {
+	message, err := MarshallMetadata(goldenMetadataValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(message.Payload); got != goldenMetadata {
+		t.Fatalf("encoding changed\nwant %s\ngot  %s", goldenMetadata, got)
+	}
+
+	payload, _ := hex.DecodeString(goldenMetadata)
+	decoded, err := UnmarshallMetadata(&Message{ID: MessageMetadata, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareMetadata(t, goldenMetadataValue(), decoded)
+}
+
+func TestDecodeMetadataRefusesMalformed(t *testing.T) {
+	payload, _ := hex.DecodeString(goldenMetadata)
+
+	for i := range payload {
+		if _, err := decodeMetadata(payload[:i]); !errors.Is(err, ErrMalformedMetadata) {
+			t.Fatalf("expected a payload cut to %d bytes to be malformed got %v", i, err)
+		}
+	}
+
+	if _, err := decodeMetadata(append(bytes.Clone(payload), 0)); !errors.Is(err, ErrMalformedMetadata) {
+		t.Fatalf("expected trailing bytes to be refused got %v", err)
+	}
+
+	newer := bytes.Clone(payload)
+	newer[5] = METADATA_ENCODING_VERSION + 1
+	if _, err := decodeMetadata(newer); !errors.Is(err, ErrUnsupportedMetadataVersion) {
+		t.Fatalf("expected a newer version to be refused got %v", err)
+	}
+
+	//A piece count far beyond what the payload holds must be refused before it is allocated
+	forged := bytes.Clone(payload)
+	copy(forged[40:44], []byte{0x00, 0xff, 0xff, 0xff})
+	if _, err := decodeMetadata(forged); !errors.Is(err, ErrMalformedMetadata) {
+		t.Fatalf("expected a forged piece count to be refused got %v", err)
+	}
+
+	//Millions of empty piece hashes take no bytes at all
+	var empty bytes.Buffer
+	empty.Write(metadataMagic)
+	binary.Write(&empty, binary.BigEndian, uint16(METADATA_ENCODING_VERSION))
+	empty.WriteByte(0)
+	writeString(&empty, "x")
+	writeString(&empty, "")
+	binary.Write(&empty, binary.BigEndian, struct {
+		Hash        uint8
+		PieceLength uint32
+		FileLength  uint64
+	}{uint8(HashSHA256), MIN_PIECE_LENGTH, 1})
+	empty.WriteByte(0)
+	binary.Write(&empty, binary.BigEndian, struct {
+		Count  uint32
+		Length uint8
+	}{MAX_METADATA_PIECES, 0})
+	binary.Write(&empty, binary.BigEndian, uint32(0))
+
+	if _, err := decodeMetadata(empty.Bytes()); !errors.Is(err, ErrMalformedMetadata) {
+		t.Fatalf("expected %d empty piece hashes to be refused got %v", MAX_METADATA_PIECES, err)
+	}
+
+	//A few bytes of merkle metadata announcing millions of pieces would size a huge hash tree
+	var merkle bytes.Buffer
+	merkle.Write(metadataMagic)
+	binary.Write(&merkle, binary.BigEndian, uint16(METADATA_ENCODING_VERSION))
+	merkle.WriteByte(METADATA_FLAG_SINGLE | METADATA_FLAG_MERKLE)
+	writeString(&merkle, "x")
+	writeString(&merkle, "")
+	binary.Write(&merkle, binary.BigEndian, struct {
+		Hash        uint8
+		PieceLength uint32
+		FileLength  uint64
+	}{uint8(HashSHA256), MIN_PIECE_LENGTH, (MAX_MERKLE_PIECES + 1) * MIN_PIECE_LENGTH})
+	writeBytes(&merkle, make([]byte, 32))
+	binary.Write(&merkle, binary.BigEndian, struct {
+		Count  uint32
+		Length uint8
+	}{0, 0})
+	binary.Write(&merkle, binary.BigEndian, uint32(0))
+
+	if _, err := decodeMetadata(merkle.Bytes()); !errors.Is(err, ErrMalformedMetadata) {
+		t.Fatalf("expected %d merkle pieces to be refused got %v", MAX_MERKLE_PIECES+1, err)
+	}
+
+	tooMany := &Metadata{Name: "x", Single: true, Merkle: true, HashAlgorithm: HashSHA256, PieceLength: MIN_PIECE_LENGTH,
+		FileLength: (MAX_MERKLE_PIECES + 1) * MIN_PIECE_LENGTH, Checksum: make([]byte, 32)}
+	if _, err := MarshallMetadata(tooMany); !errors.Is(err, ErrMalformedMetadata) {
+		t.Fatalf("expected a sender to refuse %d merkle pieces got %v", MAX_MERKLE_PIECES+1, err)
+	}
+
+	//One piece fewer decodes
+	tooMany.FileLength = MAX_MERKLE_PIECES * MIN_PIECE_LENGTH
+	message, err := MarshallMetadata(tooMany)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decodeMetadata(message.Payload); err != nil {
+		t.Fatalf("expected %d merkle pieces to be accepted got %v", MAX_MERKLE_PIECES, err)
+	}
+}
+
+// A listener from before the binary encoding can not read the metadata, it is refused at the handshake
+func TestSenderRefusesOlderListeners(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hello := Handshake{Version: METADATA_BINARY_PROTOCOL_VERSION - 1, PeerID: "receiver_old", Capabilities: CapHashSHA1 | CapHashSHA256}
+	if _, err := conn.Write(listenerSenderHandshake(&hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessageFromReader(conn)
+	if err != nil || msg.ID != MessageError {
+		t.Fatalf("expected an error got %+v (%v)", msg, err)
+	}
+
+	if perr, err := UnmarshallError(msg); err != nil || perr.Code != ErrorUnsupportedVersion {
+		t.Fatalf("expected an unsupported version error got %+v (%v)", perr, err)
+	}
+}
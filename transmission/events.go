@@ -0,0 +1,133 @@
+package transmission
+
+import (
+	"fmt"
+	"time"
+)
+
+// What happened during a transfer
+type EventKind int8
+
+const (
+	//The sender, or a relaying listener, accepts connections on Address
+	EventReady EventKind = iota
+	//A listener finished the handshake and was given a slot
+	EventListenerConnected
+	//A listener is waiting for a free slot at Position in the sender's queue
+	EventQueued
+	//The metadata was sent to a listener, Bytes long
+	EventMetadataSent
+	//The listener received and checked the Metadata. Total is the length of the content.
+	EventMetadataReceived
+	//The listener starts downloading. Total is the number of bytes wanted, -1 for a stream, and Done what an earlier run already saved.
+	EventDownloadStarted
+	//A piece was sent to a listener
+	EventPieceSent
+	//A piece arrived from a peer and is about to be verified
+	EventPieceReceived
+	//A piece was verified and saved. Done counts the bytes saved so far.
+	EventPieceVerified
+	//A piece did not match its hash. Err says whether it will be requested again.
+	EventPieceFailed
+	//A listener reported it has every piece it wanted
+	EventListenerFinished
+	//A listener's connections closed. Err says why, nil when the listener hung up.
+	EventListenerDisconnected
+	//The listener saved every piece it wanted
+	EventDownloadFinished
+	//The peer went without listeners for its automatic shutdown delay
+	EventIdle
+	//The peer stopped serving and closed its files
+	EventShutdown
+	//A downloaded file is complete. Err is ErrChecksumMismatch when it does not match its checksum.
+	EventFileCompleted
+)
+
+var eventKinds = []struct {
+	kind EventKind
+	name string
+}{
+	{EventReady, "ready"},
+	{EventListenerConnected, "listener_connected"},
+	{EventQueued, "queued"},
+	{EventMetadataSent, "metadata_sent"},
+	{EventMetadataReceived, "metadata_received"},
+	{EventDownloadStarted, "download_started"},
+	{EventPieceSent, "piece_sent"},
+	{EventPieceReceived, "piece_received"},
+	{EventPieceVerified, "piece_verified"},
+	{EventPieceFailed, "piece_failed"},
+	{EventListenerFinished, "listener_finished"},
+	{EventListenerDisconnected, "listener_disconnected"},
+	{EventDownloadFinished, "download_finished"},
+	{EventIdle, "idle"},
+	{EventShutdown, "shutdown"},
+	{EventFileCompleted, "file_completed"},
+}
+
+func (k EventKind) String() string {
+	for _, e := range eventKinds {
+		if e.kind == k {
+			return e.name
+		}
+	}
+
+	return fmt.Sprintf("event(%d)", int(k))
+}
+
+// Something that happened during a transfer. Fields that do not apply to the kind are left zero.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	//Peer ID and network address of the other side. For EventReady, the address this peer listens on.
+	PeerID  string
+	Address string
+
+	//Index of the piece for piece events
+	Piece int
+	//Bytes in the piece or message the event is about
+	Bytes int64
+
+	//Progress of a download in bytes
+	Done  int64
+	Total int64
+
+	//Place in the sender's queue, starting at 1
+	Position int
+
+	//File a file event is about, relative to the download with forward slashes, and its expected checksum
+	Path     string
+	Checksum []byte
+
+	//What the sender offers, for EventMetadataReceived. Must not be modified.
+	Metadata *Metadata
+
+	Err error
+}
+
+// Receives the events of a transfer. Events are delivered one at a time from the goroutine that caused them,
+// so Observe must return quickly and must not call back into the Peer.
+type Observer interface {
+	Observe(e Event)
+}
+
+// Adapter to use an ordinary function as an Observer
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+func (p *Peer) emit(e Event) {
+	if p.observer == nil {
+		return
+	}
+
+	e.Time = time.Now()
+
+	p.emu.Lock()
+	defer p.emu.Unlock()
+
+	p.observer.Observe(e)
+}
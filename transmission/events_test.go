@@ -0,0 +1,128 @@
+package transmission
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// Keeps every event it observes
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Observe(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) count(kind EventKind) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, e := range r.events {
+		if e.Kind == kind {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (r *eventRecorder) last(kind EventKind) (Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].Kind == kind {
+			return r.events[i], true
+		}
+	}
+
+	return Event{}, false
+}
+
+func TestTransferEvents(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+
+	sent := new(eventRecorder)
+	p := initializeSender(t, Options{FilePath: root, Observer: sent})
+
+	received := new(eventRecorder)
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: t.TempDir(),
+		Observer:         received,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	numPieces := p.Metadata.NumPieces()
+
+	if n := received.count(EventPieceVerified); n != numPieces {
+		t.Fatalf("expected %d verified pieces got %d", numPieces, n)
+	}
+
+	if n := received.count(EventPieceReceived); n != numPieces {
+		t.Fatalf("expected %d received pieces got %d", numPieces, n)
+	}
+
+	started, ok := received.last(EventDownloadStarted)
+	if !ok || started.Total != p.Metadata.FileLength || started.PeerID != p.id {
+		t.Fatalf("expected the download of %d bytes from %s to start got %+v", p.Metadata.FileLength, p.id, started)
+	}
+
+	if n := received.count(EventFileCompleted); n != 2 {
+		t.Fatalf("expected both files to complete got %d", n)
+	}
+
+	if file, _ := received.last(EventFileCompleted); file.Err != nil || file.Path != "dir1/file1.bin" || len(file.Checksum) == 0 {
+		t.Fatalf("expected dir1/file1.bin to match its checksum got %+v", file)
+	}
+
+	finished, ok := received.last(EventDownloadFinished)
+	if !ok || finished.Done != finished.Total || finished.Total != p.Metadata.FileLength {
+		t.Fatalf("expected the download to finish with every byte got %+v", finished)
+	}
+
+	//The listener sent its finished acknowledgement before returning, the sender may still be reading it
+	p.Shutdown()
+
+	if ready, ok := sent.last(EventReady); !ok || ready.Address == "" {
+		t.Fatalf("expected the sender to report its address got %+v", ready)
+	}
+
+	connected, ok := sent.last(EventListenerConnected)
+	if !ok || connected.PeerID != l.id {
+		t.Fatalf("expected %s to connect got %+v", l.id, connected)
+	}
+
+	if sent.count(EventMetadataSent) != 1 || sent.count(EventPieceSent) != numPieces {
+		t.Fatalf("expected the metadata and %d pieces to be sent got %d and %d", numPieces, sent.count(EventMetadataSent), sent.count(EventPieceSent))
+	}
+
+	if sent.count(EventShutdown) != 1 {
+		t.Fatal("expected the sender to report its shutdown")
+	}
+}
+
+func TestEventKindString(t *testing.T) {
+	seen := make(map[string]bool)
+	for kind := EventReady; kind <= EventFileCompleted; kind++ {
+		name := kind.String()
+		if seen[name] {
+			t.Fatalf("%s names more than one event", name)
+		}
+		seen[name] = true
+	}
+
+	if got := EventKind(100).String(); got != "event(100)" {
+		t.Fatalf("expected an unknown kind to be numbered got %s", got)
+	}
+}
@@ -0,0 +1,238 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Version of the wire format spoken by this build.
+// Version 0 is a peer from before the handshake carried a payload.
+// Version 2 adds the trailing flags byte to the handshake.
+// Version 3 sends the metadata in the binary encoding instead of gob.
+const PROTOCOL_VERSION = 3
+
+// Oldest version a peer may speak before the handshake is refused.
+// Older peers exchange metadata in layouts this build can no longer read or write.
+const MIN_PROTOCOL_VERSION = 3
+
+// Features a peer supports. The sender grants the intersection of what both sides support.
+type Capability uint32
+
+const (
+	//Reserved, not implemented by this build
+	CapCompression Capability = 1 << iota
+	CapEncryption
+	CapPipelining
+	CapHashSHA1
+	//Peer answers MessageRequestBitfield
+	CapBitfield
+	CapHashSHA256
+	CapHashBLAKE3
+	//Peer verifies pieces against a Merkle root using the proof sent with each piece
+	CapMerkle
+)
+
+func (c Capability) Has(flag Capability) bool {
+	return c&flag == flag
+}
+
+var capabilityNames = []struct {
+	flag Capability
+	name string
+}{
+	{CapCompression, "compression"},
+	{CapEncryption, "encryption"},
+	{CapPipelining, "pipelining"},
+	{CapHashSHA1, "sha1"},
+	{CapBitfield, "bitfield"},
+	{CapHashSHA256, "sha256"},
+	{CapHashBLAKE3, "blake3"},
+	{CapMerkle, "merkle"},
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, cap := range capabilityNames {
+		if c.Has(cap.flag) {
+			names = append(names, cap.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Exchanged in MessageListenerSenderHandshake and MessageListenerAcknowledgement.
+// In the acknowledgement Version and Capabilities are what the sender agreed to.
+type Handshake struct {
+	Version      uint16
+	PeerID       string
+	Capabilities Capability
+
+	//Set by a peer that only wants to look at the metadata. It is not given a listener slot
+	//and may not request pieces.
+	Inspect bool
+}
+
+const HANDSHAKE_FLAG_INSPECT = 1 << 0
+
+// <version><peer id length><peer id><capabilities><flags>
+func (h *Handshake) Marshall() []byte {
+	var payload bytes.Buffer
+
+	binary.Write(&payload, binary.BigEndian, h.Version)
+	writeString(&payload, h.PeerID)
+	binary.Write(&payload, binary.BigEndian, uint32(h.Capabilities))
+
+	var flags uint8
+	if h.Inspect {
+		flags |= HANDSHAKE_FLAG_INSPECT
+	}
+	payload.WriteByte(flags)
+
+	return payload.Bytes()
+}
+
+func UnmarshallHandshake(payload []byte) (*Handshake, error) {
+	var h Handshake
+
+	buf := bytes.NewReader(payload)
+	if err := binary.Read(buf, binary.BigEndian, &h.Version); err != nil {
+		return nil, err
+	}
+
+	id, err := readString(buf)
+	if err != nil {
+		return nil, err
+	}
+	h.PeerID = id
+
+	var caps uint32
+	if err := binary.Read(buf, binary.BigEndian, &caps); err != nil {
+		return nil, err
+	}
+	h.Capabilities = Capability(caps)
+
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	h.Inspect = flags&HANDSHAKE_FLAG_INSPECT != 0
+
+	return &h, nil
+}
+
+// Reasons a peer refuses to continue, sent in MessageError
+type ErrorCode uint16
+
+const (
+	ErrorMalformedMessage ErrorCode = iota + 1
+	ErrorUnsupportedVersion
+	ErrorMissingCapability
+	ErrorCodeRequired
+	//A relay was asked for a piece it does not hold yet
+	ErrorPieceUnavailable
+	//A peer that connected to inspect the metadata asked for pieces
+	ErrorNotAdmitted
+	//The streaming sender could not read its input
+	ErrorStreamFailed
+)
+
+// ProtocolError is returned to the caller when the other side answers with MessageError
+type ProtocolError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("peer refused: %s (code %d)", e.Reason, e.Code)
+}
+
+// Allows errors.Is to match the sentinel errors that some codes correspond to
+func (e *ProtocolError) Unwrap() error {
+	switch e.Code {
+	case ErrorCodeRequired:
+		return ErrCodeRequired
+	}
+
+	return nil
+}
+
+// <code><reason length><reason>
+func MarshallError(code ErrorCode, reason string) *Message {
+	var payload bytes.Buffer
+
+	binary.Write(&payload, binary.BigEndian, uint16(code))
+	writeString(&payload, reason)
+
+	return &Message{ID: MessageError, Payload: payload.Bytes()}
+}
+
+func UnmarshallError(message *Message) (*ProtocolError, error) {
+	buf := bytes.NewReader(message.Payload)
+
+	var code uint16
+	if err := binary.Read(buf, binary.BigEndian, &code); err != nil {
+		return nil, err
+	}
+
+	reason, err := readString(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProtocolError{Code: ErrorCode(code), Reason: reason}, nil
+}
+
+// Capabilities this peer can offer for the current transfer
+func (p *Peer) capabilities() Capability {
+	caps := CapHashSHA1 | CapHashSHA256 | CapHashBLAKE3 | CapMerkle | CapPipelining | CapBitfield
+	if p.code != "" {
+		caps |= CapEncryption
+	}
+
+	return caps
+}
+
+// Algorithm the offered pieces are hashed with
+func (p *Peer) hashAlgorithm() HashAlgorithm {
+	if p.Metadata == nil {
+		return HashSHA1
+	}
+
+	return p.Metadata.HashAlgorithm
+}
+
+// Decide what to agree to with a listener, or why to refuse it
+func (p *Peer) negotiate(h *Handshake) (*Handshake, *ProtocolError) {
+	if h.Version < MIN_PROTOCOL_VERSION {
+		return nil, &ProtocolError{
+			Code:   ErrorUnsupportedVersion,
+			Reason: fmt.Sprintf("protocol version %d is older than the minimum %d", h.Version, MIN_PROTOCOL_VERSION),
+		}
+	}
+
+	if p.code != "" && !h.Capabilities.Has(CapEncryption) {
+		return nil, &ProtocolError{Code: ErrorCodeRequired, Reason: ErrCodeRequired.Error()}
+	}
+
+	algorithm := p.hashAlgorithm()
+	if !h.Capabilities.Has(algorithm.capability()) {
+		return nil, &ProtocolError{
+			Code:   ErrorMissingCapability,
+			Reason: fmt.Sprintf("listener does not support the %s piece hash", algorithm),
+		}
+	}
+
+	if p.Metadata != nil && p.Metadata.Merkle && !h.Capabilities.Has(CapMerkle) {
+		return nil, &ProtocolError{Code: ErrorMissingCapability, Reason: "listener does not support merkle piece proofs"}
+	}
+
+	return &Handshake{
+		Version:      min(h.Version, PROTOCOL_VERSION),
+		PeerID:       p.id,
+		Capabilities: h.Capabilities & p.capabilities(),
+	}, nil
+}
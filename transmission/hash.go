@@ -0,0 +1,128 @@
+package transmission
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Algorithm used for the piece hashes in the metadata
+type HashAlgorithm uint8
+
+const (
+	//The algorithm of the original protocol
+	HashSHA1 HashAlgorithm = iota
+	HashSHA256
+	HashBLAKE3
+)
+
+// Used by senders unless another algorithm is chosen. SHA-1 is weaker and only kept as an option.
+const DEFAULT_HASH_ALGORITHM = HashSHA256
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("unknown hash algorithm")
+	ErrMalformedPieceHash   = errors.New("piece hash has the wrong length for its algorithm")
+)
+
+var hashAlgorithmNames = []struct {
+	algorithm HashAlgorithm
+	name      string
+}{
+	{HashSHA1, "sha1"},
+	{HashSHA256, "sha256"},
+	{HashBLAKE3, "blake3"},
+}
+
+func (h HashAlgorithm) String() string {
+	for _, a := range hashAlgorithmNames {
+		if a.algorithm == h {
+			return a.name
+		}
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(h))
+}
+
+// Parse an algorithm name such as sha256. An empty name is the default algorithm.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	if name == "" {
+		return DEFAULT_HASH_ALGORITHM, nil
+	}
+
+	for _, a := range hashAlgorithmNames {
+		if a.name == strings.ToLower(name) {
+			return a.algorithm, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownHashAlgorithm, name)
+}
+
+func (h HashAlgorithm) New() hash.Hash {
+	switch h {
+	case HashSHA256:
+		return sha256.New()
+	case HashBLAKE3:
+		return blake3.New(32, nil)
+	default:
+		return sha1.New()
+	}
+}
+
+func (h HashAlgorithm) Sum(data []byte) []byte {
+	switch h {
+	case HashSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case HashBLAKE3:
+		sum := blake3.Sum256(data)
+		return sum[:]
+	default:
+		sum := sha1.Sum(data)
+		return sum[:]
+	}
+}
+
+// Length of a digest in bytes
+func (h HashAlgorithm) Size() int {
+	return h.New().Size()
+}
+
+// Capability a peer advertises when it can verify pieces hashed with the algorithm
+func (h HashAlgorithm) capability() Capability {
+	switch h {
+	case HashSHA1:
+		return CapHashSHA1
+	case HashSHA256:
+		return CapHashSHA256
+	case HashBLAKE3:
+		return CapHashBLAKE3
+	}
+
+	return 0
+}
+
+// Make sure the metadata uses an algorithm this peer can verify and every piece hash fits it
+func (m *Metadata) checkHashes() error {
+	if m.HashAlgorithm.capability() == 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownHashAlgorithm, m.HashAlgorithm)
+	}
+
+	size := m.HashAlgorithm.Size()
+	if m.Merkle && (len(m.Checksum) != size || len(m.Pieces) > 0) {
+		return ErrMalformedPieceHash
+	}
+
+	for _, piece := range m.Pieces {
+		if len(piece) != size {
+			return ErrMalformedPieceHash
+		}
+	}
+
+	return nil
+}
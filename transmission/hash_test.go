@@ -0,0 +1,70 @@
+package transmission
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHashAlgorithm(t *testing.T) {
+	tests := map[string]HashAlgorithm{"sha1": HashSHA1, "SHA256": HashSHA256, "blake3": HashBLAKE3}
+	for name, want := range tests {
+		algorithm, err := ParseHashAlgorithm(name)
+		if err != nil || algorithm != want {
+			t.Fatalf("expected %s got %s (%v)", want, algorithm, err)
+		}
+	}
+
+	if algorithm, err := ParseHashAlgorithm(""); err != nil || algorithm != DEFAULT_HASH_ALGORITHM {
+		t.Fatalf("expected the default algorithm got %s (%v)", algorithm, err)
+	}
+
+	if _, err := ParseHashAlgorithm("md5"); !errors.Is(err, ErrUnknownHashAlgorithm) {
+		t.Fatalf("expected %v got %v", ErrUnknownHashAlgorithm, err)
+	}
+}
+
+func TestCheckHashes(t *testing.T) {
+	meta := &Metadata{HashAlgorithm: HashBLAKE3, Pieces: [][]byte{make([]byte, 32)}}
+	if err := meta.checkHashes(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	meta.HashAlgorithm = HashSHA1
+	if err := meta.checkHashes(); err != ErrMalformedPieceHash {
+		t.Fatalf("expected %v got %v", ErrMalformedPieceHash, err)
+	}
+
+	meta.HashAlgorithm = 200
+	if err := meta.checkHashes(); !errors.Is(err, ErrUnknownHashAlgorithm) {
+		t.Fatalf("expected %v got %v", ErrUnknownHashAlgorithm, err)
+	}
+}
+
+func TestListenWithHashAlgorithms(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+
+	for _, name := range []string{"sha1", "sha256", "blake3"} {
+		t.Run(name, func(t *testing.T) {
+			p := initializeSender(t, Options{FilePath: root, Hash: name})
+			defer p.Shutdown()
+
+			if p.Metadata.HashAlgorithm.String() != name {
+				t.Fatalf("expected pieces hashed with %s got %s", name, p.Metadata.HashAlgorithm)
+			}
+
+			downloadPath := t.TempDir()
+			l := new(Peer)
+			err := l.Listen(Options{
+				SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+				DownloadFilePath: downloadPath,
+			})
+			if err != nil {
+				t.Fatalf("an error as occurred while listening %v\n", err)
+			}
+
+			compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+		})
+	}
+}
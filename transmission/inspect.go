@@ -0,0 +1,60 @@
+package transmission
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Peers that may inspect the metadata at once. They hold no listener slot and never queue.
+const MAX_INSPECT_SESSIONS = 4
+
+// How long an inspecting peer has to read the metadata before the sender hangs up
+const INSPECT_TIMEOUT = 10 * time.Second
+
+// Ends an inspecting peer's session once it was sent the metadata
+var errInspected = errors.New("metadata sent to an inspecting peer")
+
+// Connect to a sender, read what it is offering and disconnect.
+// The sender does not count the connection as a listener, so inspecting works even when it is full.
+func (p *Peer) Inspect(opts Options) (*Metadata, error) {
+	p.State = receiver
+	p.inspecting = true
+
+	p.code = normalizeCode(opts.Code)
+	p.MulticastAddress = opts.MulticastAddress
+
+	if opts.SenderAddress == "" {
+		found, err := p.discoverPeers(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		p.SenderAddress = found[0].address
+	} else {
+		p.SenderAddress = opts.SenderAddress
+	}
+
+	id, err := generatePeerID(receiver)
+	if err != nil {
+		return nil, err
+	}
+	p.id = id
+
+	peer, err := p.openPeerConn(context.Background(), p.SenderAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer peer.conn.Close()
+
+	p.SenderID = peer.handshake.PeerID
+	p.SenderVersion = peer.handshake.Version
+	p.SenderCapabilities = peer.handshake.Capabilities
+
+	if err := p.listenerRequestMetadata(peer.conn); err != nil {
+		p.dlog("an error occurred requesting metadata: %v\n", err)
+		return nil, err
+	}
+
+	return p.Metadata, nil
+}
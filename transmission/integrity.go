@@ -0,0 +1,357 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Files that did not match their checksum, either right after downloading or when verifying a directory
+type IntegrityError struct {
+	Corrupt []string
+	Missing []string
+}
+
+func (e *IntegrityError) Error() string {
+	var problems []string
+	if len(e.Corrupt) > 0 {
+		problems = append(problems, fmt.Sprintf("corrupt: %s", strings.Join(e.Corrupt, ", ")))
+	}
+
+	if len(e.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing: %s", strings.Join(e.Missing, ", ")))
+	}
+
+	return fmt.Sprintf("%v, %s", ErrChecksumMismatch, strings.Join(problems, "; "))
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// Computes the whole content and per file checksums from content written in order.
+// Each file's checksum is stored in files as soon as its last byte is written.
+type checksummer struct {
+	files []FileInfo
+	whole hash.Hash
+	file  hash.Hash
+
+	//File being hashed and the global offset reached so far
+	index  int
+	offset int64
+}
+
+func newChecksummer(files []FileInfo, newHash func() hash.Hash) *checksummer {
+	c := &checksummer{
+		files: files,
+		whole: newHash(),
+		file:  newHash(),
+	}
+	c.finishFiles()
+
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.whole.Write(p)
+
+	written := len(p)
+	for len(p) > 0 && c.index < len(c.files) {
+		f := c.files[c.index]
+
+		n := min(int64(len(p)), f.CummulativeOffset+f.Size-c.offset)
+		c.file.Write(p[:n])
+		c.offset += n
+		p = p[n:]
+
+		c.finishFiles()
+	}
+
+	return written, nil
+}
+
+// Store the checksum of every file whose last byte has been written
+func (c *checksummer) finishFiles() {
+	for c.index < len(c.files) && c.offset == c.files[c.index].CummulativeOffset+c.files[c.index].Size {
+		if c.files[c.index].Kind == FileKindFile {
+			c.files[c.index].Checksum = c.file.Sum(nil)
+		}
+		c.file.Reset()
+		c.index++
+	}
+}
+
+func (c *checksummer) Sum() []byte {
+	return c.whole.Sum(nil)
+}
+
+// Hash size bytes of the payload starting at offset
+func checksumRange(r io.ReaderAt, hasher hash.Hash, offset, size int64) ([]byte, error) {
+	buf := make([]byte, min(size, int64(PIECELENGTH)))
+
+	for size > 0 {
+		n, err := r.ReadAt(buf[:min(size, int64(len(buf)))], offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		//The file on disk is shorter than it should be
+		if n == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		hasher.Write(buf[:n])
+		offset += int64(n)
+		size -= int64(n)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// Verifies each downloaded file against its checksum as soon as all of its pieces are on disk
+type fileChecker struct {
+	vf *VirtualFile
+	//Where the downloaded payload is read back from
+	payload io.ReaderAt
+	meta    *Metadata
+	checked []bool
+	corrupt []string
+
+	//Called for every file once it is complete, with ErrChecksumMismatch when it is corrupt
+	onFile func(f FileInfo, err error)
+}
+
+func newFileChecker(vf *VirtualFile, payload io.ReaderAt, meta *Metadata) *fileChecker {
+	return &fileChecker{
+		vf:      vf,
+		payload: payload,
+		meta:    meta,
+		checked: make([]bool, len(meta.Folders)),
+	}
+}
+
+// Check the files the piece at index belongs to, if it was the last one they were waiting for
+func (c *fileChecker) pieceDone(index int, have Bitfield) error {
+	begin, end := c.meta.pieceBounds(index)
+
+	fileIndex, _ := c.vf.findFileAndOffset(begin)
+	for ; fileIndex < len(c.meta.Folders) && c.meta.Folders[fileIndex].CummulativeOffset < end; fileIndex++ {
+		if c.complete(fileIndex, have) {
+			if err := c.check(fileIndex); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check every file that was complete before the download started and report the corrupt ones
+func (c *fileChecker) finish(have Bitfield) error {
+	for i := range c.meta.Folders {
+		if c.complete(i, have) {
+			if err := c.check(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(c.corrupt) > 0 {
+		return &IntegrityError{Corrupt: c.corrupt}
+	}
+
+	return nil
+}
+
+// Reports whether the file at index is waiting to be checked and every piece it spans is on disk
+func (c *fileChecker) complete(fileIndex int, have Bitfield) bool {
+	f := c.meta.Folders[fileIndex]
+	if c.checked[fileIndex] || f.Kind != FileKindFile || !c.vf.isSelected(fileIndex) {
+		return false
+	}
+
+	pieceLength := int64(c.meta.PieceLength)
+	first := int(f.CummulativeOffset / pieceLength)
+	last := int((f.CummulativeOffset + max(f.Size, 1) - 1) / pieceLength)
+
+	for i := first; i <= last && i < c.meta.NumPieces(); i++ {
+		if !have.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Files from a sender that did not compute checksums are only reported as complete
+func (c *fileChecker) check(fileIndex int) error {
+	c.checked[fileIndex] = true
+	f := c.meta.Folders[fileIndex]
+
+	var mismatch error
+	if len(f.Checksum) > 0 {
+		sum, err := checksumRange(c.payload, c.meta.newChecksum(), f.CummulativeOffset, f.Size)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if err != nil || !bytes.Equal(sum, f.Checksum) {
+			c.corrupt = append(c.corrupt, c.meta.displayPath(f))
+			mismatch = ErrChecksumMismatch
+		}
+	}
+
+	if c.onFile != nil {
+		c.onFile(f, mismatch)
+	}
+
+	return nil
+}
+
+// Path of a file as shown to the user, relative to the download and with forward slashes
+func (m *Metadata) displayPath(f FileInfo) string {
+	if m.Single {
+		return filepath.Base(m.Name)
+	}
+
+	return filepath.ToSlash(f.Path)
+}
+
+// Description of the content and its checksums that can be kept to verify a download later
+type Manifest struct {
+	Name      string `json:"name"`
+	Single    bool   `json:"single"`
+	Hash      string `json:"hash"`
+	Checksum  string `json:"checksum"`
+	TotalSize int64  `json:"total_size"`
+	//Checksums are Merkle roots over blocks of PieceLength
+	Merkle      bool           `json:"merkle,omitempty"`
+	PieceLength int32          `json:"piece_length"`
+	Files       []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+func (m *Metadata) Manifest() *Manifest {
+	manifest := &Manifest{
+		Name:        filepath.Base(m.Name),
+		Single:      m.Single,
+		Hash:        m.HashAlgorithm.String(),
+		Checksum:    hex.EncodeToString(m.Checksum),
+		TotalSize:   m.FileLength,
+		Merkle:      m.Merkle,
+		PieceLength: m.PieceLength,
+		Files:       []ManifestFile{},
+	}
+
+	for _, f := range m.Folders {
+		if f.Kind != FileKindFile {
+			continue
+		}
+
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Path:     m.displayPath(f),
+			Size:     f.Size,
+			Checksum: hex.EncodeToString(f.Checksum),
+		})
+	}
+
+	return manifest
+}
+
+func WriteManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// Re-check content downloaded into dir against the manifest, the way a listener saves it:
+// a single file at dir/<name>, a folder's files under dir/<name>/.
+func VerifyManifest(manifest *Manifest, dir string) error {
+	algorithm, err := ParseHashAlgorithm(manifest.Hash)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Merkle && manifest.PieceLength <= 0 {
+		return fmt.Errorf("%w: merkle manifest without a piece length", ErrChecksumMismatch)
+	}
+
+	newHash := func() hash.Hash {
+		return newContentHash(algorithm, manifest.Merkle, int(manifest.PieceLength))
+	}
+
+	root := filepath.Join(dir, manifest.Name)
+
+	var integrity IntegrityError
+	whole := newHash()
+
+	for _, f := range manifest.Files {
+		path := root
+		if !manifest.Single {
+			path = filepath.Join(root, filepath.FromSlash(f.Path))
+		}
+
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			integrity.Missing = append(integrity.Missing, f.Path)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		hasher := newHash()
+		n, err := io.Copy(io.MultiWriter(hasher, whole), file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		if n != f.Size || hex.EncodeToString(hasher.Sum(nil)) != f.Checksum {
+			integrity.Corrupt = append(integrity.Corrupt, f.Path)
+		}
+	}
+
+	if len(integrity.Corrupt) > 0 || len(integrity.Missing) > 0 {
+		return &integrity
+	}
+
+	//Every file matched, so a different content checksum means the manifest itself was altered
+	if manifest.Checksum != "" && hex.EncodeToString(whole.Sum(nil)) != manifest.Checksum {
+		return fmt.Errorf("%w: content checksum of %s", ErrChecksumMismatch, manifest.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGeneratedChecksums(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 5)
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	whole := sha256.New()
+	for _, f := range meta.Folders {
+		if f.Kind != FileKindFile {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(root, f.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		whole.Write(data)
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], f.Checksum) {
+			t.Fatalf("expected checksum %x for %s got %x", sum, f.Path, f.Checksum)
+		}
+	}
+
+	if !bytes.Equal(whole.Sum(nil), meta.Checksum) {
+		t.Fatalf("expected content checksum %x got %x", whole.Sum(nil), meta.Checksum)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	if err := WriteManifest(manifestPath, l.Metadata.Manifest()); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyManifest(manifest, downloadPath); err != nil {
+		t.Fatalf("expected download to verify got %v", err)
+	}
+
+	//Flip a byte in one file and remove the other
+	got := filepath.Join(downloadPath, filepath.Base(root))
+	corrupt := filepath.Join(got, "dir0", "file0.bin")
+	data, err := os.ReadFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[1000] ^= 0xff
+	if err := os.WriteFile(corrupt, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(got, "dir1", "file1.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	var integrity *IntegrityError
+	if err := VerifyManifest(manifest, downloadPath); !errors.As(err, &integrity) {
+		t.Fatalf("expected an integrity error got %v", err)
+	}
+
+	if len(integrity.Corrupt) != 1 || integrity.Corrupt[0] != "dir0/file0.bin" ||
+		len(integrity.Missing) != 1 || integrity.Missing[0] != "dir1/file1.bin" {
+		t.Fatalf("expected dir0/file0.bin corrupt and dir1/file1.bin missing got %+v", integrity)
+	}
+}
+
+func TestListenReportsCorruptFile(t *testing.T) {
+	finished := make(chan struct{}, 1)
+	disconnected := make(chan struct{}, 1)
+
+	root := writeTestTree(t, 700*1024, 300*1024, 900*1024)
+	p := initializeSender(t, Options{
+		FilePath: root,
+		Observer: ObserverFunc(func(e Event) {
+			switch e.Kind {
+			case EventListenerFinished:
+				finished <- struct{}{}
+			case EventListenerDisconnected:
+				disconnected <- struct{}{}
+			}
+		}),
+	})
+	defer p.Shutdown()
+
+	//Pieces still match, only the file checksum the sender announces is wrong
+	p.Metadata.Folders[1].Checksum[0] ^= 0xff
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+
+	var integrity *IntegrityError
+	if !errors.As(err, &integrity) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected an integrity error got %v", err)
+	}
+
+	want := filepath.ToSlash(p.Metadata.Folders[1].Path)
+	if len(integrity.Corrupt) != 1 || integrity.Corrupt[0] != want {
+		t.Fatalf("expected only %s to be corrupt got %v", want, integrity.Corrupt)
+	}
+
+	//The download can be resumed and the sender was never told it finished
+	if _, err := os.Stat(resumeStatePath(downloadPath, p.Metadata)); err != nil {
+		t.Fatalf("expected the download state to be kept got %v", err)
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener did not disconnect")
+	}
+
+	select {
+	case <-finished:
+		t.Fatal("expected no finished acknowledgement from a corrupt download")
+	default:
+	}
+}
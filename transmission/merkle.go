@@ -0,0 +1,250 @@
+package transmission
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"sync"
+)
+
+var ErrMalformedProof = errors.New("malformed merkle proof")
+
+// Prefix of interior nodes, so a node can never be mistaken for a piece hash
+const merkleNodePrefix = 0x01
+
+// Binary hash tree over the piece hashes, used in Merkle mode instead of sending every piece hash in the metadata.
+// The leaves are padded with zero hashes to a power of two. A sender knows every node, a listener starts with
+// only the root and fills in the nodes of each proof it verifies, so it can prove those pieces to other listeners.
+type merkleTree struct {
+	mu        sync.Mutex
+	algorithm HashAlgorithm
+	numPieces int
+
+	//levels[0] holds the leaves and the last level the root. Unknown nodes are nil.
+	levels [][][]byte
+}
+
+// A tree that only knows its root
+func newMerkleTree(algorithm HashAlgorithm, numPieces int, root []byte) *merkleTree {
+	t := &merkleTree{algorithm: algorithm, numPieces: numPieces}
+
+	width := 1
+	for width < numPieces {
+		width *= 2
+	}
+
+	for ; width >= 1; width /= 2 {
+		t.levels = append(t.levels, make([][]byte, width))
+	}
+
+	t.levels[len(t.levels)-1][0] = root
+	return t
+}
+
+// A complete tree over the given piece hashes
+func buildMerkleTree(algorithm HashAlgorithm, leaves [][]byte) *merkleTree {
+	t := newMerkleTree(algorithm, len(leaves), nil)
+
+	padding := make([]byte, algorithm.Size())
+	for i := range t.levels[0] {
+		if i < len(leaves) {
+			t.levels[0][i] = leaves[i]
+		} else {
+			t.levels[0][i] = padding
+		}
+	}
+
+	for level := 1; level < len(t.levels); level++ {
+		for i := range t.levels[level] {
+			t.levels[level][i] = t.node(t.levels[level-1][2*i], t.levels[level-1][2*i+1])
+		}
+	}
+
+	return t
+}
+
+func (t *merkleTree) node(left, right []byte) []byte {
+	h := t.algorithm.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+func (t *merkleTree) root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Number of hashes in the proof of every piece
+func (t *merkleTree) depth() int {
+	return len(t.levels) - 1
+}
+
+// Siblings of every node from the piece's leaf up to the root.
+// Returns false if this tree has not learned all of them yet.
+func (t *merkleTree) proof(index int) ([][]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	proof := make([][]byte, 0, t.depth())
+	for level := 0; level < t.depth(); level++ {
+		sibling := t.levels[level][index^1]
+		if sibling == nil {
+			return nil, false
+		}
+
+		proof = append(proof, sibling)
+		index /= 2
+	}
+
+	return proof, true
+}
+
+// Check the piece hash against the root using the proof. A verified proof is remembered,
+// so the piece can be proven to other listeners.
+func (t *merkleTree) verify(index int, leaf []byte, proof [][]byte) bool {
+	if index < 0 || index >= t.numPieces || len(proof) != t.depth() {
+		return false
+	}
+
+	path := make([][]byte, 0, len(proof)+1)
+	path = append(path, leaf)
+
+	node, position := leaf, index
+	for _, sibling := range proof {
+		if position%2 == 0 {
+			node = t.node(node, sibling)
+		} else {
+			node = t.node(sibling, node)
+		}
+
+		path = append(path, node)
+		position /= 2
+	}
+
+	if !bytes.Equal(node, t.root()) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	//The proof points into the piece message, whose buffer is reused once the piece is written
+	position = index
+	for level, sibling := range proof {
+		t.levels[level][position] = path[level]
+		t.levels[level][position^1] = bytes.Clone(sibling)
+		position /= 2
+	}
+
+	return true
+}
+
+// Piece hash learned from an earlier verified proof, nil if unknown
+func (t *merkleTree) leaf(index int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.levels[0][index]
+}
+
+// Restore a piece hash verified in an earlier run, along with every parent that can be computed from it
+func (t *merkleTree) restore(index int, leaf []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.levels[0][index] = leaf
+	for level := 0; level < t.depth(); level++ {
+		sibling := t.levels[level][index^1]
+		if sibling == nil {
+			return
+		}
+
+		if index%2 == 0 {
+			t.levels[level+1][index/2] = t.node(t.levels[level][index], sibling)
+		} else {
+			t.levels[level+1][index/2] = t.node(sibling, t.levels[level][index])
+		}
+		index /= 2
+	}
+}
+
+// Split the proof hashes sent after a piece's data
+func splitProof(raw []byte, size int) ([][]byte, error) {
+	if size == 0 || len(raw)%size != 0 {
+		return nil, ErrMalformedProof
+	}
+
+	proof := make([][]byte, 0, len(raw)/size)
+	for len(raw) > 0 {
+		proof = append(proof, raw[:size])
+		raw = raw[size:]
+	}
+
+	return proof, nil
+}
+
+// Computes the Merkle root of content written in order, split into blocks of a piece's length.
+// Used for the whole content and per file checksums in Merkle mode.
+type merkleHasher struct {
+	algorithm HashAlgorithm
+	blockSize int
+	block     []byte
+	leaves    [][]byte
+}
+
+func newMerkleHasher(algorithm HashAlgorithm, blockSize int) *merkleHasher {
+	return &merkleHasher{algorithm: algorithm, blockSize: blockSize}
+}
+
+func (m *merkleHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), m.blockSize-len(m.block))
+		m.block = append(m.block, p[:n]...)
+		p = p[n:]
+
+		if len(m.block) == m.blockSize {
+			m.leaves = append(m.leaves, m.algorithm.Sum(m.block))
+			m.block = m.block[:0]
+		}
+	}
+
+	return written, nil
+}
+
+func (m *merkleHasher) Sum(b []byte) []byte {
+	leaves := m.leaves
+	if len(m.block) > 0 {
+		leaves = append(leaves[:len(leaves):len(leaves)], m.algorithm.Sum(m.block))
+	}
+
+	return append(b, buildMerkleTree(m.algorithm, leaves).root()...)
+}
+
+func (m *merkleHasher) Reset() {
+	m.block = m.block[:0]
+	m.leaves = nil
+}
+
+func (m *merkleHasher) Size() int {
+	return m.algorithm.Size()
+}
+
+func (m *merkleHasher) BlockSize() int {
+	return m.blockSize
+}
+
+// Hash used for the whole content and per file checksums
+func newContentHash(algorithm HashAlgorithm, merkle bool, pieceLength int) hash.Hash {
+	if merkle {
+		return newMerkleHasher(algorithm, pieceLength)
+	}
+
+	return algorithm.New()
+}
+
+func (m *Metadata) newChecksum() hash.Hash {
+	return newContentHash(m.HashAlgorithm, m.Merkle, int(m.PieceLength))
+}
@@ -0,0 +1,147 @@
+package transmission
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func merkleLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = HashSHA256.Sum([]byte(fmt.Sprintf("piece %d", i)))
+	}
+
+	return leaves
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		leaves := merkleLeaves(n)
+		full := buildMerkleTree(HashSHA256, leaves)
+
+		//A listener only knows the root
+		partial := newMerkleTree(HashSHA256, n, full.root())
+
+		for i, leaf := range leaves {
+			proof, ok := full.proof(i)
+			if !ok {
+				t.Fatalf("%d pieces: expected a proof for piece %d", n, i)
+			}
+
+			if partial.verify(i, leaves[(i+1)%n], proof) && n > 1 {
+				t.Fatalf("%d pieces: expected the wrong piece hash to be refused at %d", n, i)
+			}
+
+			if !partial.verify(i, leaf, proof) {
+				t.Fatalf("%d pieces: expected piece %d to verify", n, i)
+			}
+
+			//Once verified the listener can prove the piece itself
+			relayed, ok := partial.proof(i)
+			if !ok || len(relayed) != len(proof) {
+				t.Fatalf("%d pieces: expected the listener to prove piece %d", n, i)
+			}
+
+			for level := range proof {
+				if !bytes.Equal(relayed[level], proof[level]) {
+					t.Fatalf("%d pieces: relayed proof of piece %d differs at level %d", n, i, level)
+				}
+			}
+		}
+
+		if partial.verify(n, leaves[0], nil) {
+			t.Fatalf("%d pieces: expected an out of range piece to be refused", n)
+		}
+	}
+}
+
+func TestMerkleRestore(t *testing.T) {
+	leaves := merkleLeaves(4)
+	full := buildMerkleTree(HashSHA256, leaves)
+	partial := newMerkleTree(HashSHA256, 4, full.root())
+
+	partial.restore(0, leaves[0])
+	if _, ok := partial.proof(0); ok {
+		t.Fatalf("expected no proof without the sibling hashes")
+	}
+
+	for i := 1; i < 4; i++ {
+		partial.restore(i, leaves[i])
+	}
+
+	if _, ok := partial.proof(0); !ok {
+		t.Fatalf("expected a proof once every piece hash is restored")
+	}
+}
+
+func TestMerkleHasher(t *testing.T) {
+	data := randomBytes(t, 10*1024+7)
+
+	var leaves [][]byte
+	for chunk := data; len(chunk) > 0; {
+		n := min(len(chunk), 1024)
+		leaves = append(leaves, HashBLAKE3.Sum(chunk[:n]))
+		chunk = chunk[n:]
+	}
+
+	hasher := newMerkleHasher(HashBLAKE3, 1024)
+	hasher.Write(data[:100])
+	hasher.Write(data[100:])
+
+	if want := buildMerkleTree(HashBLAKE3, leaves).root(); !bytes.Equal(hasher.Sum(nil), want) {
+		t.Fatalf("expected root %x got %x", want, hasher.Sum(nil))
+	}
+}
+
+func TestPieceProofRoundTrip(t *testing.T) {
+	proof := merkleLeaves(3)
+
+	msg, err := marshallPieceBlock(7, 7*1024, []byte("piece data"), proof...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	piece, err := UnmarshallPiece(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if piece.Index != 7 || string(piece.Buf) != "piece data" {
+		t.Fatalf("expected piece 7 got %d %q", piece.Index, piece.Buf)
+	}
+
+	got, err := splitProof(piece.Proof, HashSHA256.Size())
+	if err != nil || len(got) != len(proof) || !bytes.Equal(got[2], proof[2]) {
+		t.Fatalf("expected the proof to round trip got %d hashes (%v)", len(got), err)
+	}
+}
+
+func TestListenMerkle(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+	p := initializeSender(t, Options{FilePath: root, Merkle: true})
+	defer p.Shutdown()
+
+	if len(p.Metadata.Pieces) != 0 || p.Metadata.NumPieces() != 5 {
+		t.Fatalf("expected 5 pieces and no piece hashes got %d hashes", len(p.Metadata.Pieces))
+	}
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+		Connections:      2,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	if err := VerifyManifest(l.Metadata.Manifest(), downloadPath); err != nil {
+		t.Fatalf("expected merkle manifest to verify got %v", err)
+	}
+}
@@ -3,8 +3,11 @@ package transmission
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"slices"
+	"sync"
 )
 
 // Defines the messaging format for peer to peer communication
@@ -20,6 +23,23 @@ const (
 	MessageRequestPiece
 	MessagePiece
 	MessageListenerFinishedAcknowledgement
+	//Carries one side's half of the code phrase key exchange
+	MessagePake
+	//Sent instead of the expected reply when a peer refuses to continue
+	MessageError
+	//Sent instead of an acknowledgement when the sender has no free listener slot
+	MessageReject
+	MessageRequestBitfield
+	//Carries the info hash of the content and the pieces the peer holds
+	MessageBitfield
+	//Tells a listener that requested the bitfield about a piece the relay has since verified
+	MessageHave
+	//Asks a streaming sender for the hashes of the pieces it has read so far and those that follow
+	MessageRequestStream
+	//Carries the index and hash of a piece the streaming sender has just read
+	MessageStreamHash
+	//Sent once the streaming sender's input ends, with the final piece count and length
+	MessageStreamEnd
 )
 
 type PieceBlock struct {
@@ -27,6 +47,18 @@ type PieceBlock struct {
 	Offset        int64
 	NumTransfered int32
 	Buf           []byte
+	//Hashes proving the piece against the Merkle root, empty unless the sender uses Merkle mode
+	Proof []byte
+
+	//Message Buf and Proof point into
+	message *Message
+}
+
+// Hand the piece's buffer back once its data has been written. Buf and Proof may not be used afterwards.
+func (b *PieceBlock) Release() {
+	if b.message != nil {
+		b.message.Release()
+	}
 }
 
 type Message struct {
@@ -36,6 +68,9 @@ type Message struct {
 	//It is important to decode the payload in order lest you get bad data.
 	//All variable length type except for ints have a prefix
 	Payload []byte
+
+	//Payload came from the piece buffer pool
+	pooled bool
 }
 
 // Serializes message into <size><id><payload>.
@@ -56,32 +91,67 @@ func (m *Message) Serialize() []byte {
 	return bytSlice
 }
 
+// Largest payloads accepted from a peer, checked before anything is allocated for them
+const (
+	//Handshakes, errors, requests and everything else that is not listed below
+	MAX_CONTROL_MESSAGE_SIZE = MAX_STRING_LENGTH + 1024
+	//Index, offset and length, the data, then a proof of at most 64 hashes of up to 64 bytes
+	MAX_PIECE_MESSAGE_SIZE = 16 + MAX_PIECE_LENGTH + 64*64
+	//About two million 32 byte piece hashes. Larger content has to use Merkle mode or larger pieces.
+	MAX_METADATA_SIZE = 64 * 1024 * 1024
+	//Info hash and one bit per piece
+	MAX_BITFIELD_MESSAGE_SIZE = 20 + MAX_METADATA_PIECES/8
+)
+
+var (
+	ErrMessageTooLarge = errors.New("message exceeds the maximum size for its type")
+	//Returned by DeserializeMessage for a zero length frame. Readers skip them.
+	ErrKeepAlive = errors.New("keep-alive message")
+)
+
+func maxPayloadSize(id MessageCode) int {
+	switch id {
+	case MessagePiece:
+		return MAX_PIECE_MESSAGE_SIZE
+	case MessageMetadata:
+		return MAX_METADATA_SIZE
+	case MessageBitfield:
+		return MAX_BITFIELD_MESSAGE_SIZE
+	default:
+		return MAX_CONTROL_MESSAGE_SIZE
+	}
+}
+
+// Payloads up to this size are allocated up front, larger ones grow as the bytes arrive,
+// so a peer announcing a large message has to actually send it. Pieces always grow into a pooled buffer.
+const PREALLOCATED_PAYLOAD_SIZE = 1024 * 1024
+
 func DeserializeMessage(message []byte) (*Message, error) {
 	buf := bytes.NewReader(message)
 
-	//Fetch Size
-	size := make([]byte, 4)
-	_, err := io.ReadFull(buf, size)
-	if err != nil && err != io.EOF {
+	msg, err := readMessage(buf)
+	if err != nil {
 		return nil, err
 	}
 
-	msgLength := int32(binary.BigEndian.Uint32(size))
-
-	payload := make([]byte, msgLength)
-	_, err = io.ReadFull(buf, payload)
-	if err != nil && err != io.EOF {
-		return nil, err
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after the message", buf.Len())
 	}
 
-	return &Message{
-		ID:      MessageCode(payload[0]),
-		Payload: payload[1:],
-	}, nil
+	return msg, nil
 }
 
+// Read the next message, skipping keep-alives
 func DeserializeMessageFromReader(buf io.Reader) (*Message, error) {
+	for {
+		msg, err := readMessage(buf)
+		if err != ErrKeepAlive {
+			return msg, err
+		}
+	}
+}
 
+func readMessage(buf io.Reader) (*Message, error) {
 	//Fetch Size
 	size := make([]byte, 4)
 	_, err := io.ReadFull(buf, size)
@@ -89,71 +159,153 @@ func DeserializeMessageFromReader(buf io.Reader) (*Message, error) {
 		return nil, err
 	}
 
-	msgLength := int32(binary.BigEndian.Uint32(size))
+	msgLength := binary.BigEndian.Uint32(size)
 
 	//Keep alive message
 	if msgLength == 0 {
-		return nil, nil
+		return nil, ErrKeepAlive
 	}
 
-	payload := make([]byte, msgLength)
-	_, err = io.ReadFull(buf, payload)
-	if err != nil {
-		return nil, err
+	id := make([]byte, 1)
+	if _, err := io.ReadFull(buf, id); err != nil {
+		return nil, unexpectedEOF(err)
 	}
 
-	return &Message{
-		ID:      MessageCode(payload[0]),
-		Payload: payload[1:],
-	}, nil
+	msg := &Message{ID: MessageCode(id[0])}
+
+	length := int64(msgLength) - 1
+	if length > int64(maxPayloadSize(msg.ID)) {
+		return nil, fmt.Errorf("%w: %d byte payload for message %d", ErrMessageTooLarge, length, msg.ID)
+	}
+
+	switch {
+	case msg.ID == MessagePiece:
+		msg.Payload, err = readPiecePayload(buf, int(length))
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		msg.pooled = true
+		return msg, nil
+	case length <= PREALLOCATED_PAYLOAD_SIZE:
+		msg.Payload = make([]byte, length)
+	default:
+		var payload bytes.Buffer
+		if _, err := io.CopyN(&payload, buf, length); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		msg.Payload = payload.Bytes()
+		return msg, nil
+	}
+
+	if _, err := io.ReadFull(buf, msg.Payload); err != nil {
+		msg.Release()
+		return nil, unexpectedEOF(err)
+	}
+
+	return msg, nil
 }
 
-// Marshall Metadata into message format
-func MarshallMetadata(file *Metadata) (*Message, error) {
-	message := Message{ID: MessageMetadata}
+// A message that ends early is truncated, not a clean end of the connection
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
 
-	var buf bytes.Buffer
+	return err
+}
 
-	enc := gob.NewEncoder(&buf)
+// Piece payloads are the only large messages exchanged over and over, so their buffers are reused
+var pieceBuffers = sync.Pool{
+	New: func() any {
+		return new([]byte)
+	},
+}
 
-	if err := enc.Encode(file); err != nil {
-		return nil, err
+func getPieceBuffer(size int) []byte {
+	b := pieceBuffers.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
 	}
 
-	message.Payload = buf.Bytes()
+	return (*b)[:size]
+}
 
-	return &message, nil
+// Read a piece's payload into a pooled buffer. A buffer too small for it grows as the bytes arrive,
+// PREALLOCATED_PAYLOAD_SIZE at a time.
+func readPiecePayload(r io.Reader, length int) ([]byte, error) {
+	b := getPieceBuffer(0)
+	for len(b) < length {
+		chunk := min(length-len(b), PREALLOCATED_PAYLOAD_SIZE)
+		b = slices.Grow(b, chunk)
+
+		n, err := io.ReadFull(r, b[len(b):len(b)+chunk])
+		b = b[:len(b)+n]
+		if err != nil {
+			putPieceBuffer(b)
+			return nil, err
+		}
+	}
+
+	return b, nil
 }
 
-func UnmarshallMetadata(message *Message) (*Metadata, error) {
-	buf := bytes.NewReader(message.Payload)
-	dec := gob.NewDecoder(buf)
+func putPieceBuffer(b []byte) {
+	b = b[:0]
+	pieceBuffers.Put(&b)
+}
 
-	var metadata Metadata
+// Hand a piece's payload back to the pool. Nothing may use the payload afterwards.
+func (m *Message) Release() {
+	if !m.pooled {
+		return
+	}
+
+	putPieceBuffer(m.Payload)
+	m.Payload = nil
+	m.pooled = false
+}
 
-	if err := dec.Decode(&metadata); err != nil {
+// Marshall Metadata into message format, in the binary encoding described in encoding.go
+func MarshallMetadata(file *Metadata) (*Message, error) {
+	payload, err := encodeMetadata(file)
+	if err != nil {
 		return nil, err
 	}
 
-	return &metadata, nil
+	if len(payload) > MAX_METADATA_SIZE {
+		return nil, fmt.Errorf("%w: metadata is %d bytes, use merkle mode or larger pieces", ErrMessageTooLarge, len(payload))
+	}
+
+	return &Message{ID: MessageMetadata, Payload: payload}, nil
+}
+
+func UnmarshallMetadata(message *Message) (*Metadata, error) {
+	return decodeMetadata(message.Payload)
 }
 
 func MarshallPiece(file *VirtualFile, index int) (*Message, error) {
-	//Create a buf
-	buf := make([]byte, PIECELENGTH)
+	//The data is copied into the message, so the buffer can be reused right away
+	buf := getPieceBuffer(file.pieceLength)
+	defer putPieceBuffer(buf)
 
-	offset := index * PIECELENGTH
+	offset := index * file.pieceLength
 
 	n, err := file.ReadAt(buf, int64(offset))
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
+	return marshallPieceBlock(index, int64(offset), buf[:n])
+}
+
+// <index><offset><transfered data length><data><proof hashes>
+func marshallPieceBlock(index int, offset int64, data []byte, proof ...[]byte) (*Message, error) {
 	message := Message{ID: MessagePiece}
 
-	//<index><offset><transfered data length><data>
 	var payload bytes.Buffer
-	err = binary.Write(&payload, binary.BigEndian, uint32(index))
+	err := binary.Write(&payload, binary.BigEndian, uint32(index))
 	if err != nil {
 		return nil, err
 	}
@@ -163,12 +315,17 @@ func MarshallPiece(file *VirtualFile, index int) (*Message, error) {
 		return nil, err
 	}
 
-	err = binary.Write(&payload, binary.BigEndian, uint32(n))
+	err = binary.Write(&payload, binary.BigEndian, uint32(len(data)))
 	if err != nil {
 		return nil, err
 	}
 
-	message.Payload = append(payload.Bytes(), buf[:n]...)
+	payload.Write(data)
+	for _, hash := range proof {
+		payload.Write(hash)
+	}
+
+	message.Payload = payload.Bytes()
 	return &message, nil
 }
 
@@ -190,7 +347,13 @@ func UnmarshallPiece(message *Message) (*PieceBlock, error) {
 		return nil, err
 	}
 
-	piece.Buf = message.Payload[16:]
+	if piece.NumTransfered < 0 || int(piece.NumTransfered) > len(message.Payload)-16 {
+		return nil, errors.New("piece data exceeds the message")
+	}
+
+	piece.Buf = message.Payload[16 : 16+piece.NumTransfered]
+	piece.Proof = message.Payload[16+piece.NumTransfered:]
+	piece.message = message
 
 	return &piece, nil
 }
@@ -206,6 +369,9 @@ func RequestPiece(index int) []byte {
 	return msg.Serialize()
 }
 
+// Longest length prefixed string accepted from a peer
+const MAX_STRING_LENGTH = 64 * 1024
+
 func writeString(buf *bytes.Buffer, s string) error {
 	b := []byte(s)
 
@@ -220,3 +386,21 @@ func writeString(buf *bytes.Buffer, s string) error {
 
 	return nil
 }
+
+func readString(buf io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	if length > MAX_STRING_LENGTH {
+		return "", errors.New("string exceeds maximum length")
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
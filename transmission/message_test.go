@@ -2,9 +2,11 @@ package transmission
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"runtime"
 	"testing"
 )
 
@@ -12,19 +14,16 @@ func TestFormatMetadata(t *testing.T) {
 	file := Metadata{
 		Name:        "example.txt",
 		Type:        "text",
-		Checksum:    [20]byte{0x12, 0x34, 0x56},
+		Checksum:    []byte{0x12, 0x34, 0x56},
 		PieceLength: 262144,
-		Pieces: [][20]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
+		Pieces: [][]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
 			0xc5, 0xb5, 0xbc, 0x11, 0x67, 0xbd, 0xa8, 0x4b,
 			0x83, 0x3e, 0x5c, 0x5, 0x7a, 0x77, 0xd2}},
 		FileLength: 1024,
 	}
 
-	var buf bytes.Buffer
-
-	enc := gob.NewEncoder(&buf)
-
-	if err := enc.Encode(file); err != nil {
+	encoded, err := encodeMetadata(&file)
+	if err != nil {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
@@ -33,7 +32,7 @@ func TestFormatMetadata(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	if !bytes.Equal(message.Payload, buf.Bytes()) {
+	if !bytes.Equal(message.Payload, encoded) {
 		t.Fatalf("invalid message payload")
 	}
 
@@ -43,9 +42,9 @@ func TestFormatMetadataSerialization(t *testing.T) {
 	file := Metadata{
 		Name:        "example.txt",
 		Type:        "text",
-		Checksum:    [20]byte{0x12, 0x34, 0x56},
+		Checksum:    []byte{0x12, 0x34, 0x56},
 		PieceLength: 262144,
-		Pieces: [][20]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
+		Pieces: [][]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
 			0xc5, 0xb5, 0xbc, 0x11, 0x67, 0xbd, 0xa8, 0x4b,
 			0x83, 0x3e, 0x5c, 0x5, 0x7a, 0x77, 0xd2}},
 		FileLength: 1024,
@@ -56,15 +55,12 @@ func TestFormatMetadataSerialization(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	var buf bytes.Buffer
-
-	enc := gob.NewEncoder(&buf)
-
-	if err := enc.Encode(file); err != nil {
+	encoded, err := encodeMetadata(&file)
+	if err != nil {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	if !bytes.Equal(message.Payload, buf.Bytes()) {
+	if !bytes.Equal(message.Payload, encoded) {
 		t.Fatalf("invalid message payload")
 	}
 
@@ -75,7 +71,7 @@ func TestFormatMetadataSerialization(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	expectedSize := len(buf.Bytes()) + 1
+	expectedSize := len(encoded) + 1
 	if size != uint32(expectedSize) {
 		t.Fatalf("invalid message size")
 	}
@@ -85,9 +81,9 @@ func TestFormatMetadataDeSerialization(t *testing.T) {
 	file := Metadata{
 		Name:        "example.txt",
 		Type:        "text",
-		Checksum:    [20]byte{0x12, 0x34, 0x56},
+		Checksum:    []byte{0x12, 0x34, 0x56},
 		PieceLength: 262144,
-		Pieces: [][20]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
+		Pieces: [][]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
 			0xc5, 0xb5, 0xbc, 0x11, 0x67, 0xbd, 0xa8, 0x4b,
 			0x83, 0x3e, 0x5c, 0x5, 0x7a, 0x77, 0xd2}},
 		FileLength: 1024,
@@ -98,15 +94,12 @@ func TestFormatMetadataDeSerialization(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	var buf bytes.Buffer
-
-	enc := gob.NewEncoder(&buf)
-
-	if err := enc.Encode(file); err != nil {
+	encoded, err := encodeMetadata(&file)
+	if err != nil {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	if !bytes.Equal(message.Payload, buf.Bytes()) {
+	if !bytes.Equal(message.Payload, encoded) {
 		t.Fatalf("invalid message payload")
 	}
 
@@ -117,7 +110,7 @@ func TestFormatMetadataDeSerialization(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	expectedSize := len(buf.Bytes()) + 1
+	expectedSize := len(encoded) + 1
 	if size != uint32(expectedSize) {
 		t.Fatalf("invalid message size")
 	}
@@ -136,9 +129,9 @@ func TestFormatMetadataParsing(t *testing.T) {
 	file := Metadata{
 		Name:        "example.txt",
 		Type:        "text",
-		Checksum:    [20]byte{0x12, 0x34, 0x56},
+		Checksum:    []byte{0x12, 0x34, 0x56},
 		PieceLength: 262144,
-		Pieces: [][20]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
+		Pieces: [][]byte{{0x1f, 0x8a, 0xc1, 0xf, 0x23,
 			0xc5, 0xb5, 0xbc, 0x11, 0x67, 0xbd, 0xa8, 0x4b,
 			0x83, 0x3e, 0x5c, 0x5, 0x7a, 0x77, 0xd2}},
 		FileLength: 1024,
@@ -149,15 +142,12 @@ func TestFormatMetadataParsing(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	var buf bytes.Buffer
-
-	enc := gob.NewEncoder(&buf)
-
-	if err := enc.Encode(file); err != nil {
+	encoded, err := encodeMetadata(&file)
+	if err != nil {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	if !bytes.Equal(message.Payload, buf.Bytes()) {
+	if !bytes.Equal(message.Payload, encoded) {
 		t.Fatalf("invalid message payload")
 	}
 
@@ -168,7 +158,7 @@ func TestFormatMetadataParsing(t *testing.T) {
 		t.Fatalf("an error as occured while formatting file %v\n", err)
 	}
 
-	expectedSize := len(buf.Bytes()) + 1
+	expectedSize := len(encoded) + 1
 	if size != uint32(expectedSize) {
 		t.Fatalf("invalid message size")
 	}
@@ -195,8 +185,8 @@ func TestFormatMetadataParsing(t *testing.T) {
 		t.Fatalf("invalid file type got %s wanted %s", newFile.Type, file.Type)
 	}
 
-	if file.Checksum != newFile.Checksum {
-		t.Fatalf("invalid file checksum got %s wanted %s", newFile.Checksum, file.Checksum)
+	if !bytes.Equal(file.Checksum, newFile.Checksum) {
+		t.Fatalf("invalid file checksum got %x wanted %x", newFile.Checksum, file.Checksum)
 	}
 
 	if file.PieceLength != newFile.PieceLength {
@@ -307,9 +297,294 @@ func TestMarshallCorrect(t *testing.T) {
 
 	reqPieceHash := metadata.Pieces[2]
 
-	pieceBufHash := sha1.Sum(piece.Buf)
+	pieceBufHash := metadata.HashAlgorithm.Sum(piece.Buf)
 
-	if !bytes.Equal(reqPieceHash[:], pieceBufHash[:]) {
+	if !bytes.Equal(reqPieceHash, pieceBufHash) {
 		t.Fatalf("error piece is not valid")
 	}
 }
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	h := Handshake{
+		Version:      PROTOCOL_VERSION,
+		PeerID:       "receiver_0102030405",
+		Capabilities: CapEncryption | CapHashSHA1,
+		Inspect:      true,
+	}
+
+	msg, err := DeserializeMessage(listenerSenderHandshake(&h))
+	if err != nil {
+		t.Fatalf("an error as occured while deserialing the message %v\n", err)
+	}
+
+	if msg.ID != MessageListenerSenderHandshake {
+		t.Fatalf("invalid message id")
+	}
+
+	got, err := UnmarshallHandshake(msg.Payload)
+	if err != nil {
+		t.Fatalf("an error as occured while parsing the handshake %v\n", err)
+	}
+
+	if *got != h {
+		t.Fatalf("expected %+v got %+v", h, *got)
+	}
+
+	//Every field is required, the flags included
+	payload := h.Marshall()
+	for i := range payload {
+		if _, err := UnmarshallHandshake(payload[:i]); err == nil {
+			t.Fatalf("expected a handshake cut to %d bytes to fail", i)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	p := &Peer{id: "sender_0102030405", code: "1234-otter-plaza-cedar"}
+
+	ack, perr := p.negotiate(&Handshake{Version: PROTOCOL_VERSION, Capabilities: CapEncryption | CapHashSHA1 | CapCompression})
+	if perr != nil {
+		t.Fatalf("unexpected refusal %v", perr)
+	}
+
+	if ack.Capabilities != CapEncryption|CapHashSHA1 {
+		t.Fatalf("expected [encryption,sha1] got [%s]", ack.Capabilities)
+	}
+
+	_, perr = p.negotiate(&Handshake{Version: PROTOCOL_VERSION, Capabilities: CapHashSHA1})
+	if perr == nil || perr.Code != ErrorCodeRequired {
+		t.Fatalf("expected listener without a code to be refused got %v", perr)
+	}
+
+	p.code = ""
+	_, perr = p.negotiate(&Handshake{Version: PROTOCOL_VERSION, Capabilities: CapEncryption})
+	if perr == nil || perr.Code != ErrorMissingCapability {
+		t.Fatalf("expected listener without sha1 to be refused got %v", perr)
+	}
+
+	//Peers from before the handshake carried a payload, and those that still exchanged gob metadata
+	for _, version := range []uint16{0, MIN_PROTOCOL_VERSION - 1} {
+		_, perr = p.negotiate(&Handshake{Version: version, Capabilities: CapHashSHA1})
+		if perr == nil || perr.Code != ErrorUnsupportedVersion {
+			t.Fatalf("expected a version %d listener to be refused got %v", version, perr)
+		}
+	}
+
+	//Listeners must be able to verify the algorithm the pieces were hashed with
+	p.Metadata = &Metadata{HashAlgorithm: HashBLAKE3}
+	_, perr = p.negotiate(&Handshake{Version: PROTOCOL_VERSION, Capabilities: CapHashSHA1 | CapHashSHA256})
+	if perr == nil || perr.Code != ErrorMissingCapability {
+		t.Fatalf("expected listener without blake3 to be refused got %v", perr)
+	}
+
+	if _, perr = p.negotiate(&Handshake{Version: PROTOCOL_VERSION, Capabilities: CapHashBLAKE3}); perr != nil {
+		t.Fatalf("unexpected refusal %v", perr)
+	}
+}
+
+func TestErrorMessageRoundTrip(t *testing.T) {
+	msg := MarshallError(ErrorUnsupportedVersion, "too old")
+
+	perr, err := UnmarshallError(msg)
+	if err != nil {
+		t.Fatalf("an error as occured while parsing the message %v\n", err)
+	}
+
+	if perr.Code != ErrorUnsupportedVersion || perr.Reason != "too old" {
+		t.Fatalf("unexpected protocol error %+v", perr)
+	}
+}
+
+// Frame a message with an arbitrary length prefix
+func frame(length uint32, id MessageCode, payload []byte) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, length)
+	buf = append(buf, byte(id))
+
+	return append(buf, payload...)
+}
+
+func TestDeserializeMessageLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, io.EOF},
+		{"short length", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"keep-alive", []byte{0, 0, 0, 0}, ErrKeepAlive},
+		{"missing id", []byte{0, 0, 0, 1}, io.ErrUnexpectedEOF},
+		{"truncated payload", frame(10, MessagePing, []byte{1, 2}), io.ErrUnexpectedEOF},
+		{"huge piece", frame(MAX_PIECE_MESSAGE_SIZE+2, MessagePiece, nil), ErrMessageTooLarge},
+		{"huge control message", frame(MAX_CONTROL_MESSAGE_SIZE+2, MessageListenerSenderHandshake, nil), ErrMessageTooLarge},
+		{"largest length", frame(math.MaxUint32, MessageMetadata, nil), ErrMessageTooLarge},
+		//Announcing large metadata does not allocate it before the bytes arrive
+		{"truncated metadata", frame(MAX_METADATA_SIZE, MessageMetadata, []byte{1, 2, 3}), io.ErrUnexpectedEOF},
+		{"truncated piece", frame(MAX_PIECE_MESSAGE_SIZE, MessagePiece, []byte{1, 2, 3}), io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		if _, err := DeserializeMessage(test.input); !errors.Is(err, test.want) {
+			t.Fatalf("%s: expected %v got %v", test.name, test.want, err)
+		}
+	}
+}
+
+// A peer announcing the largest piece and sending nothing more gets a buffer for what it sent, not the whole piece
+func TestDeserializeAnnouncedPieceGrows(t *testing.T) {
+	input := frame(MAX_PIECE_MESSAGE_SIZE, MessagePiece, []byte{1, 2, 3})
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	if _, err := DeserializeMessage(input); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a truncated piece got %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= MAX_PIECE_MESSAGE_SIZE/2 {
+		t.Fatalf("expected far less than %d bytes to be allocated got %d", MAX_PIECE_MESSAGE_SIZE, allocated)
+	}
+
+	//Pieces that do arrive in full are read whole
+	sent, err := marshallPieceBlock(1, MAX_PIECE_LENGTH, bytes.Repeat([]byte{9}, 3*PREALLOCATED_PAYLOAD_SIZE+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessage(sent.Serialize())
+	if err != nil || !bytes.Equal(msg.Payload, sent.Payload) {
+		t.Fatalf("expected the piece to be read whole got %v", err)
+	}
+	msg.Release()
+}
+
+func TestParsePieceRequest(t *testing.T) {
+	msg, err := DeserializeMessage(RequestPiece(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index, err := parsePieceRequest(msg.Payload); err != nil || index != 7 {
+		t.Fatalf("expected piece 7 got %d (%v)", index, err)
+	}
+
+	//The frame is well formed, the request inside it is not
+	for _, payload := range [][]byte{nil, {1, 2, 3}, {1, 2, 3, 4, 5}} {
+		msg, err := DeserializeMessage(frame(uint32(len(payload)+1), MessageRequestPiece, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := parsePieceRequest(msg.Payload); err == nil {
+			t.Fatalf("expected a %d byte piece request to be refused", len(payload))
+		}
+	}
+}
+
+func TestDeserializeMessageFromReaderSkipsKeepAlives(t *testing.T) {
+	ping := Message{ID: MessagePing, Payload: []byte{1, 2, 3}}
+	stream := append([]byte{0, 0, 0, 0, 0, 0, 0, 0}, ping.Serialize()...)
+
+	msg, err := DeserializeMessageFromReader(bytes.NewReader(stream))
+	if err != nil || msg == nil || msg.ID != MessagePing || !bytes.Equal(msg.Payload, ping.Payload) {
+		t.Fatalf("expected the ping after the keep-alives got %+v (%v)", msg, err)
+	}
+
+	//Only keep-alives and then the connection closes
+	if _, err := DeserializeMessageFromReader(bytes.NewReader([]byte{0, 0, 0, 0})); err != io.EOF {
+		t.Fatalf("expected the end of the stream got %v", err)
+	}
+}
+
+func TestPieceBufferReuse(t *testing.T) {
+	sent, err := marshallPieceBlock(3, 3*16384, bytes.Repeat([]byte{7}, 16384))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessage(sent.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	piece, err := UnmarshallPiece(msg)
+	if err != nil || piece.Index != 3 || !bytes.Equal(piece.Buf, bytes.Repeat([]byte{7}, 16384)) {
+		t.Fatalf("expected piece 3 got %+v (%v)", piece, err)
+	}
+
+	piece.Release()
+	if msg.Payload != nil {
+		t.Fatalf("expected the payload to be handed back to the pool")
+	}
+
+	//Releasing twice or releasing an unpooled message does nothing
+	piece.Release()
+	sent.Release()
+	if len(sent.Payload) == 0 {
+		t.Fatalf("expected a message that was not pooled to keep its payload")
+	}
+}
+
+func FuzzDeserializeMessage(f *testing.F) {
+	f.Add(sendPong())
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add(RequestPiece(7))
+	f.Add(MarshallError(ErrorMalformedMessage, "bad").Serialize())
+	f.Add(frame(MAX_PIECE_MESSAGE_SIZE+2, MessagePiece, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DeserializeMessage(data)
+		if err != nil {
+			return
+		}
+
+		if len(msg.Payload) > maxPayloadSize(msg.ID) {
+			t.Fatalf("accepted a %d byte payload for message %d", len(msg.Payload), msg.ID)
+		}
+
+		//A message that was accepted serializes back to the same bytes
+		if !bytes.Equal(msg.Serialize(), data) {
+			t.Fatalf("round trip changed %x into %x", data, msg.Serialize())
+		}
+		msg.Release()
+	})
+}
+
+func FuzzDeserializeMessageFromReader(f *testing.F) {
+	piece, _ := marshallPieceBlock(0, 0, []byte("data"))
+	f.Add(append([]byte{0, 0, 0, 0}, piece.Serialize()...))
+	f.Add(append(sendPong(), sendPong()...))
+	f.Add(frame(MAX_METADATA_SIZE, MessageMetadata, []byte{1}))
+	//A piece request without its index
+	f.Add(frame(1, MessageRequestPiece, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			msg, err := DeserializeMessageFromReader(r)
+			if err != nil {
+				return
+			}
+
+			if msg == nil {
+				t.Fatalf("expected a message or an error")
+			}
+
+			if len(msg.Payload) > maxPayloadSize(msg.ID) {
+				t.Fatalf("accepted a %d byte payload for message %d", len(msg.Payload), msg.ID)
+			}
+
+			if msg.ID == MessageRequestPiece {
+				if _, err := parsePieceRequest(msg.Payload); err == nil && len(msg.Payload) != 4 {
+					t.Fatalf("accepted a %d byte piece request", len(msg.Payload))
+				}
+			}
+
+			if msg.ID == MessagePiece {
+				if piece, err := UnmarshallPiece(msg); err == nil {
+					piece.Release()
+				}
+			}
+		}
+	})
+}
@@ -1,45 +1,139 @@
 package transmission
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 )
 
 var PIECELENGTH = 512 * 1024 // 512 KB
 
+const (
+	MIN_PIECE_LENGTH = 16 * 1024
+	MAX_PIECE_LENGTH = 16 * 1024 * 1024
+	//Pick the piece length from the total size of the content
+	AUTO_PIECE_LENGTH = -1
+	//Automatic piece lengths grow until the content fits in about this many pieces
+	AUTO_TARGET_PIECES = 2048
+)
+
+var ErrInvalidPieceLength = fmt.Errorf("piece length must be a power of two between %d and %d bytes", MIN_PIECE_LENGTH, MAX_PIECE_LENGTH)
+
+var ErrPieceCountMismatch = errors.New("number of piece hashes does not match the content length")
+
+// Piece length for content of the given size: small pieces for small transfers so
+// a few tiny files are not padded out, larger ones for huge transfers so there are fewer requests and hashes.
+func AutoPieceLength(totalSize int64) int {
+	pieceLength := MIN_PIECE_LENGTH
+	for pieceLength < MAX_PIECE_LENGTH && totalSize > int64(pieceLength)*AUTO_TARGET_PIECES {
+		pieceLength *= 2
+	}
+
+	return pieceLength
+}
+
+func checkPieceLength(pieceLength int) error {
+	if pieceLength < MIN_PIECE_LENGTH || pieceLength > MAX_PIECE_LENGTH || pieceLength&(pieceLength-1) != 0 {
+		return ErrInvalidPieceLength
+	}
+
+	return nil
+}
+
+// What a FileInfo describes
+type FileKind uint8
+
+const (
+	//Zero so an entry read without a kind is a regular file
+	FileKindFile FileKind = iota
+	FileKindDir
+	FileKindSymlink
+)
+
 type FileInfo struct {
 	Path              string
 	Size              int64
 	CummulativeOffset int64
-	AbsolutePath      string
+	Kind              FileKind
+	//Permission bits and modification time the listener restores once the download completes.
+	//Zero when the sender did not send them.
+	Mode    fs.FileMode
+	ModTime time.Time
+	//What a FileKindSymlink entry points to, relative to the link
+	LinkTarget string
+	//Digest of the file's content, computed with the metadata's hash algorithm
+	Checksum []byte
 }
 
+// Sent to every listener, so it only holds the content's name and paths relative to it
 type Metadata struct {
-	Name        string
-	Type        string
-	Checksum    [20]byte
+	//Base name of what is sent, never the sender's full path
+	Name string
+	Type string
+	//Digest of the whole content, every file in order
+	Checksum    []byte
 	PieceLength int32
-	Pieces      [][20]byte
-	FileLength  int64
-	Single      bool
-	Folders     []FileInfo
+	//Algorithm the piece hashes were computed with
+	HashAlgorithm HashAlgorithm
+	//Empty in Merkle mode, pieces are then proven against Checksum, the root of the piece hash tree
+	Pieces     [][]byte
+	Merkle     bool
+	FileLength int64
+	Single     bool
+	Folders    []FileInfo
+	//Content is read from a stream of unknown length. Pieces and FileLength stay empty,
+	//piece hashes are sent as the sender reads them.
+	Stream bool
 }
 
-// Generate metadata from file
+// How metadata is generated
+type MetadataOptions struct {
+	Hash HashAlgorithm
+	//Zero is PIECELENGTH, AUTO_PIECE_LENGTH picks one from the total size
+	PieceLength int
+	//Only send the root of the piece hash tree, pieces are sent with their proof
+	Merkle bool
+	//What to do with symbolic links inside a shared folder
+	Symlinks SymlinkPolicy
+	//Name listeners save the content under. Empty means the base name of the path.
+	Name string
+}
+
+// Generate metadata from file, hashing pieces with the default algorithm
 func GenerateMetadata(path string) (*Metadata, *VirtualFile, error) {
-	fmt.Fprintf(os.Stdout, "Generating metadata from %s\n", path)
-	vf := VirtualFile{
-		rootPath: path,
+	return GenerateMetadataWithOptions(path, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM})
+}
+
+func GenerateMetadataWithOptions(path string, opts MetadataOptions) (*Metadata, *VirtualFile, error) {
+	return generateMetadata(newVirtualFile(path, opts))
+}
+
+func newVirtualFile(path string, opts MetadataOptions) *VirtualFile {
+	return &VirtualFile{
+		rootPath:    path,
+		hash:        opts.Hash,
+		merkle:      opts.Merkle,
+		pieceLength: opts.PieceLength,
+		symlinks:    opts.Symlinks,
+		name:        opts.Name,
 	}
+}
+
+func generateMetadata(vf *VirtualFile) (*Metadata, *VirtualFile, error) {
+	fmt.Fprintf(os.Stderr, "Generating metadata from %s\n", vf.rootPath)
 
 	if err := vf.Build(); err != nil {
+		vf.Close()
 		return nil, nil, err
 	}
 
@@ -47,19 +141,135 @@ func GenerateMetadata(path string) (*Metadata, *VirtualFile, error) {
 	metadata.FileLength = vf.totalSize
 	metadata.Single = vf.single
 
-	fmt.Fprintf(os.Stdout, "Generated metadata from %s\n", path)
-	return metadata, &vf, nil
+	fmt.Fprintf(os.Stderr, "Generated metadata from %s\n", vf.rootPath)
+	return metadata, vf, nil
+
+}
+
+// InfoHash identifies the content described by the metadata.
+// It is derived from the piece hashes and the file layout, so it does not depend on where the sender stores the files.
+// SHA-256 is used regardless of the piece hash algorithm and truncated to 20 bytes.
+func (m *Metadata) InfoHash() [20]byte {
+	hasher := sha256.New()
+
+	binary.Write(hasher, binary.BigEndian, m.PieceLength)
+	binary.Write(hasher, binary.BigEndian, m.FileLength)
+	binary.Write(hasher, binary.BigEndian, m.HashAlgorithm)
+
+	for _, piece := range m.Pieces {
+		hasher.Write(piece)
+	}
+
+	if m.Merkle {
+		hasher.Write(m.Checksum)
+	}
+
+	for _, f := range m.Folders {
+		io.WriteString(hasher, f.Path)
+		binary.Write(hasher, binary.BigEndian, f.Size)
+
+		if f.Kind == FileKindSymlink {
+			io.WriteString(hasher, f.LinkTarget)
+		}
+	}
+
+	var hash [20]byte
+	copy(hash[:], hasher.Sum(nil))
+
+	return hash
+}
 
+// ContentID is the hex encoded info hash. Peers announcing the same content ID offer identical pieces.
+func (m *Metadata) ContentID() string {
+	infoHash := m.InfoHash()
+	return hex.EncodeToString(infoHash[:])
+}
+
+// Check metadata received from a sender before anything is sized from it.
+// Piece lengths outside the bounds a sender may choose are refused, as they decide how much a listener buffers,
+// and so are paths that would be written outside the download directory.
+func (m *Metadata) validate() error {
+	if err := checkPieceLength(int(m.PieceLength)); err != nil {
+		return err
+	}
+
+	if m.FileLength < 0 || m.FileLength > MAX_CONTENT_LENGTH {
+		return fmt.Errorf("invalid content length %d", m.FileLength)
+	}
+
+	limit := MAX_METADATA_PIECES
+	if m.Merkle {
+		limit = MAX_MERKLE_PIECES
+	}
+
+	if m.NumPieces() > limit {
+		return fmt.Errorf("%d pieces, at most %d are accepted", m.NumPieces(), limit)
+	}
+
+	//Missing hashes would leave the end of the content unrequested, extra ones can never be matched
+	if want := (m.FileLength + int64(m.PieceLength) - 1) / int64(m.PieceLength); !m.Merkle && !m.Stream && int64(len(m.Pieces)) != want {
+		return fmt.Errorf("%w: %d piece hashes for %d pieces", ErrPieceCountMismatch, len(m.Pieces), want)
+	}
+
+	if err := m.checkFiles(); err != nil {
+		return err
+	}
+
+	return m.checkHashes()
+}
+
+// Number of pieces the content is split into
+func (m *Metadata) NumPieces() int {
+	if !m.Merkle {
+		return len(m.Pieces)
+	}
+
+	return int((m.FileLength + int64(m.PieceLength) - 1) / int64(m.PieceLength))
+}
+
+// Returns the global byte range [begin, end) covered by the piece at index
+func (m *Metadata) pieceBounds(index int) (begin, end int64) {
+	begin = int64(index) * int64(m.PieceLength)
+	end = begin + int64(m.PieceLength)
+
+	if end > m.FileLength {
+		end = m.FileLength
+	}
+
+	return begin, end
 }
 
 type VirtualFile struct {
-	rootPath  string
-	files     []FileInfo
-	handles   []*os.File
-	pieces    [][20]byte
-	totalSize int64
-	single    bool
-	mu        sync.Mutex
+	rootPath string
+	//Name listeners save the content under
+	name  string
+	files []FileInfo
+	//Where each entry of files is read from on the sender. Kept out of files, which is sent to listeners.
+	sources []string
+	//Set when the content is read from a file system other than the local one, sources are then paths within it
+	fsys     fs.FS
+	handles  []fileHandle
+	pieces   [][]byte
+	checksum []byte
+	//Algorithm pieces and checksums are hashed with
+	hash   HashAlgorithm
+	merkle bool
+	//Length of every piece but the last
+	pieceLength int
+	symlinks    SymlinkPolicy
+	totalSize   int64
+	single      bool
+	mu          sync.Mutex
+
+	//Reserve disk space for each file when it is opened for writing instead of leaving it sparse
+	preallocate bool
+	//Offset within each file opened for writing from which it read as zeros when opened.
+	//Nil on a sender, whose files are never written.
+	zeroFrom []int64
+
+	//Files the listener chose to download, nil when every file is wanted.
+	//Bytes that fall into other files are dropped instead of written.
+	selected []bool
 
 	//used for building path to write to
 	downloadPath string
@@ -106,7 +316,23 @@ func (vf *VirtualFile) ReadAt(p []byte, offset int64) (int, error) {
 	vf.mu.Lock()
 	defer vf.mu.Unlock()
 	for len(p) > 0 && fileIndex < len(vf.files) {
-		n, err := vf.handles[fileIndex].ReadAt(p, localOffset)
+		//Directories and empty files hold no bytes of the content
+		if vf.files[fileIndex].Size == 0 {
+			fileIndex++
+			localOffset = 0
+			continue
+		}
+
+		if !vf.isSelected(fileIndex) {
+			return bytesRead, fmt.Errorf("%s was not selected for download", vf.files[fileIndex].Path)
+		}
+
+		handle, err := vf.openHandle(fileIndex)
+		if err != nil {
+			return bytesRead, err
+		}
+
+		n, err := handle.ReadAt(p, localOffset)
 
 		bytesRead += n
 
@@ -131,7 +357,15 @@ func (vf *VirtualFile) ReadAt(p []byte, offset int64) (int, error) {
 
 }
 
-func (vf *VirtualFile) WriteAt(offset int64, p []byte) (int, error) {
+func (vf *VirtualFile) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 || offset > vf.totalSize {
+		return 0, fmt.Errorf("write at offset %d outside of the %d byte content", offset, vf.totalSize)
+	}
+
+	if len(vf.handles) != len(vf.files) {
+		return 0, fmt.Errorf("%s is not open for writing", vf.rootPath)
+	}
+
 	// Find starting file
 	fileIndex, localOffset := vf.findFileAndOffset(offset)
 
@@ -140,28 +374,6 @@ func (vf *VirtualFile) WriteAt(offset int64, p []byte) (int, error) {
 	vf.mu.Lock()
 	defer vf.mu.Unlock()
 	for len(p) > 0 && fileIndex < len(vf.files) {
-		if vf.handles[fileIndex] == nil {
-			var path string
-			fileBase := filepath.Base(vf.rootPath)
-
-			if vf.single {
-				path = filepath.Join(vf.downloadPath, fileBase)
-			} else {
-				path = filepath.Join(vf.downloadPath, fileBase, vf.files[fileIndex].Path)
-			}
-
-			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-				panic(err)
-			}
-
-			file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
-			if err != nil {
-				return bytesWritten, err
-			}
-
-			vf.handles[fileIndex] = file
-		}
-
 		//Determine which position to write to
 		maxWriteSize := vf.files[fileIndex].Size - localOffset
 		if maxWriteSize <= 0 {
@@ -174,20 +386,33 @@ func (vf *VirtualFile) WriteAt(offset int64, p []byte) (int, error) {
 		writeSize := int64(len(p))
 		writeSize = min(writeSize, maxWriteSize)
 
-		// _, err := vf.handles[fileIndex].Seek(localOffset, io.SeekStart)
-		// if err != nil {
-		// 	return bytesWritten, err
-		// }
+		//A piece overlapping a file that was not selected still counts as consumed
+		if !vf.isSelected(fileIndex) {
+			p = p[writeSize:]
+			bytesWritten += int(writeSize)
+			fileIndex++
+			localOffset = 0
+			continue
+		}
 
-		//Found `io.Copy` to work alot better than `WriteAt`. Since our writes work like appends anyways we can just use `io.Copy`.
-		n, err := io.Copy(vf.handles[fileIndex], bytes.NewReader(p[:writeSize]))
+		handle, err := vf.openHandle(fileIndex)
 		if err != nil {
 			return bytesWritten, err
 		}
 
+		//Write at the piece's position within the file rather than appending, so pieces that were
+		//already downloaded before a restart can be skipped.
+		n := int(writeSize)
+		if vf.zeroFrom == nil || localOffset < vf.zeroFrom[fileIndex] || !allZero(p[:writeSize]) {
+			n, err = handle.WriteAt(p[:writeSize], localOffset)
+			if err != nil {
+				return bytesWritten, err
+			}
+		}
+
 		p = p[writeSize:]
 
-		bytesWritten += int(n)
+		bytesWritten += n
 		fileIndex++
 		localOffset = 0
 	}
@@ -196,27 +421,152 @@ func (vf *VirtualFile) WriteAt(offset int64, p []byte) (int, error) {
 
 }
 
-func (vf *VirtualFile) Build() error {
-	info, err := os.Stat(vf.rootPath)
+// Open every selected file that holds content, so space for the whole download is reserved before it starts
+func (vf *VirtualFile) Preallocate() error {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+
+	vf.preallocate = true
+
+	for i, f := range vf.files {
+		if f.Kind != FileKindFile || f.Size == 0 || !vf.isSelected(i) {
+			continue
+		}
+
+		if _, err := vf.openHandle(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func allZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (vf *VirtualFile) isSelected(fileIndex int) bool {
+	return vf.selected == nil || vf.selected[fileIndex]
+}
+
+// Reports whether every byte in [begin, end) belongs to a selected file, i.e. the range is stored on disk
+func (vf *VirtualFile) covers(begin, end int64) bool {
+	if vf.selected == nil {
+		return true
+	}
+
+	for i, f := range vf.files {
+		if f.CummulativeOffset < end && f.CummulativeOffset+f.Size > begin && !vf.selected[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the handle for the file at index, opening it on the listener side when needed.
+// Must be called with vf.mu held.
+func (vf *VirtualFile) openHandle(fileIndex int) (fileHandle, error) {
+	if vf.handles[fileIndex] != nil {
+		return vf.handles[fileIndex], nil
+	}
+
+	//Content read from an fs.FS was opened when the metadata was generated
+	if vf.fsys != nil {
+		return nil, fmt.Errorf("%s: %w", vf.files[fileIndex].Path, ErrReadOnly)
+	}
+
+	path := vf.filePath(fileIndex)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !info.IsDir() {
-		vf.single = true
+	//Drop any stale data left behind by an older, larger file with the same name
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	size := vf.files[fileIndex].Size
+	if info.Size() > size {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	//Grow the file to its final size up front. Pieces can then land in any order, and what was added
+	//reads as zeros, so zero bytes written there can be skipped and the file stays sparse.
+	if info.Size() < size {
+		if vf.preallocate {
+			err = preallocate(file, size)
+		} else {
+			err = file.Truncate(size)
+		}
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if vf.zeroFrom == nil {
+		vf.zeroFrom = make([]int64, len(vf.files))
+	}
+	vf.zeroFrom[fileIndex] = min(info.Size(), size)
+
+	vf.handles[fileIndex] = file
+
+	return file, nil
+}
+
+// Path the file at index is written to on the listener side
+func (vf *VirtualFile) filePath(fileIndex int) string {
+	fileBase := filepath.Base(vf.rootPath)
+
+	if vf.single {
+		return filepath.Join(vf.downloadPath, fileBase)
+	}
+
+	return filepath.Join(vf.downloadPath, fileBase, vf.files[fileIndex].Path)
+}
+
+func (vf *VirtualFile) Build() error {
+	var err error
+	if vf.fsys != nil {
+		err = vf.scanFS()
+	} else {
+		err = vf.scan()
 	}
 
-	err = filepath.Walk(vf.rootPath, vf.walkFunc)
 	if err != nil {
 		return err
 	}
 
-	sort.Slice(vf.files, func(i, j int) bool {
-		return vf.files[i].Path < vf.files[j].Path
-	})
+	sort.Sort(entriesByPath{vf})
 
 	vf.calculateCummulativeOffsets()
 
+	switch vf.pieceLength {
+	case 0:
+		vf.pieceLength = PIECELENGTH
+	case AUTO_PIECE_LENGTH:
+		vf.pieceLength = AutoPieceLength(vf.totalSize)
+	}
+
 	if err := vf.buildFileHandles(); err != nil {
 		return err
 	}
@@ -231,19 +581,118 @@ func (vf *VirtualFile) Build() error {
 	return nil
 }
 
+// Find the entries to send on the local file system
+func (vf *VirtualFile) scan() error {
+	info, err := os.Stat(vf.rootPath)
+	if err != nil {
+		return err
+	}
+
+	//The root itself is always followed, it was named explicitly
+	if info.IsDir() {
+		err = vf.walk(vf.rootPath, []fs.FileInfo{info})
+	} else {
+		vf.single = true
+		err = vf.addEntry(vf.rootPath, info, FileKindFile, "")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if vf.name == "" {
+		absolute, err := filepath.Abs(vf.rootPath)
+		if err != nil {
+			return err
+		}
+		vf.name = filepath.Base(absolute)
+	}
+
+	return nil
+}
+
 func (vf *VirtualFile) ToMetadata() *Metadata {
 	var metadata Metadata
 
-	metadata.Name = vf.rootPath
-	metadata.PieceLength = int32(PIECELENGTH)
+	metadata.Name = vf.name
+	metadata.PieceLength = int32(vf.pieceLength)
 	metadata.Folders = vf.files
+	metadata.HashAlgorithm = vf.hash
 	metadata.Pieces = vf.pieces
+	metadata.Checksum = vf.checksum
+	metadata.Merkle = vf.merkle
+
+	//The checksum is the root of the tree over the piece hashes
+	if vf.merkle {
+		metadata.Pieces = nil
+	}
 
 	return &metadata
 }
 
+// Recreate the directories, empty files and links and restore the sender's permissions and modification times.
+// Called once the payload is complete, as writing into a file or directory changes its modification time.
+func (vf *VirtualFile) restoreAttributes() error {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+
+	for i, f := range vf.files {
+		if !vf.isSelected(i) {
+			continue
+		}
+
+		switch {
+		case f.Kind == FileKindDir:
+			if err := os.MkdirAll(vf.filePath(i), 0755); err != nil {
+				return err
+			}
+		case f.Kind == FileKindFile && f.Size == 0:
+			if _, err := vf.openHandle(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	//Created before modification times are restored, as adding a link changes its directory's
+	if err := vf.restoreSymlinks(); err != nil {
+		return err
+	}
+
+	//Paths are sorted, so going backwards handles what a directory contains before the directory itself
+	for i := len(vf.files) - 1; i >= 0; i-- {
+		f := vf.files[i]
+		if !vf.isSelected(i) || f.Kind == FileKindSymlink {
+			continue
+		}
+
+		path := vf.filePath(i)
+		if f.Mode != 0 {
+			if err := os.Chmod(path, f.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+
+		if !f.ModTime.IsZero() {
+			if err := os.Chtimes(path, f.ModTime, f.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close every open handle. Safe to call more than once.
 func (vf *VirtualFile) Close() error {
-	for _, file := range vf.handles {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+
+	for i, file := range vf.handles {
+		if file == nil {
+			continue
+		}
+
+		vf.handles[i] = nil
 		if err := file.Close(); err != nil {
 			return err
 		}
@@ -252,8 +701,13 @@ func (vf *VirtualFile) Close() error {
 }
 
 func (vf *VirtualFile) buildFileHandles() error {
-	for _, f := range vf.files {
-		open, err := os.Open(f.AbsolutePath)
+	for i, f := range vf.files {
+		if f.Kind != FileKindFile {
+			vf.handles = append(vf.handles, nil)
+			continue
+		}
+
+		open, err := vf.openSource(i)
 		if err != nil {
 			return err
 		}
@@ -264,25 +718,32 @@ func (vf *VirtualFile) buildFileHandles() error {
 	return nil
 }
 
-func (vf *VirtualFile) generatePieces() ([][20]byte, error) {
+func (vf *VirtualFile) generatePieces() ([][]byte, error) {
 	//Hash 512kb blocks of file
-	numPieces := (vf.totalSize + int64(PIECELENGTH) - 1) / int64(PIECELENGTH)
+	numPieces := (vf.totalSize + int64(vf.pieceLength) - 1) / int64(vf.pieceLength)
+
+	pieces := make([][]byte, numPieces)
 
-	pieces := make([][20]byte, numPieces)
+	buf := make([]byte, vf.pieceLength)
 
-	buf := make([]byte, PIECELENGTH)
+	//Checksums are computed in the same pass, the content is read in order
+	checksums := newChecksummer(vf.files, func() hash.Hash {
+		return newContentHash(vf.hash, vf.merkle, vf.pieceLength)
+	})
 
 	for i := range numPieces {
-		offset := i * int64(PIECELENGTH)
+		offset := i * int64(vf.pieceLength)
 		n, err := vf.ReadAt(buf, int64(offset))
 		if err != nil && err != io.EOF {
 			return nil, err
 		}
 
-		hash := sha1.Sum(buf[:n])
-		pieces[i] = hash
+		pieces[i] = vf.hash.Sum(buf[:n])
+		checksums.Write(buf[:n])
 	}
 
+	vf.checksum = checksums.Sum()
+
 	return pieces, nil
 }
 
@@ -295,17 +756,26 @@ func (vf *VirtualFile) calculateCummulativeOffsets() {
 	}
 }
 
-func (vf *VirtualFile) walkFunc(path string, info fs.FileInfo, err error) error {
-	if err != nil {
-		return err
-	}
+// Sorts the entries by path, moving each entry's source along with it
+type entriesByPath struct {
+	vf *VirtualFile
+}
 
-	if info.IsDir() {
-		if path == vf.rootPath {
-			return nil
-		}
-	}
+func (e entriesByPath) Len() int {
+	return len(e.vf.files)
+}
+
+func (e entriesByPath) Less(i, j int) bool {
+	return e.vf.files[i].Path < e.vf.files[j].Path
+}
 
+func (e entriesByPath) Swap(i, j int) {
+	e.vf.files[i], e.vf.files[j] = e.vf.files[j], e.vf.files[i]
+	e.vf.sources[i], e.vf.sources[j] = e.vf.sources[j], e.vf.sources[i]
+}
+
+// Record the entry at path, relative to the root
+func (vf *VirtualFile) addEntry(path string, info fs.FileInfo, kind FileKind, target string) error {
 	relative, err := filepath.Rel(vf.rootPath, path)
 	if err != nil {
 		return err
@@ -316,21 +786,29 @@ func (vf *VirtualFile) walkFunc(path string, info fs.FileInfo, err error) error
 		return err
 	}
 
-	if info.Size() == 0 {
-		return nil
+	vf.appendEntry(relative, absolute, info, kind, target)
+
+	return nil
+}
+
+// Record an entry that is read from source
+func (vf *VirtualFile) appendEntry(relative, source string, info fs.FileInfo, kind FileKind, target string) {
+	//Directories and empty files are sent too, so the listener can recreate them
+	fileInfo := FileInfo{
+		Path:       relative,
+		Mode:       info.Mode().Perm(),
+		ModTime:    info.ModTime(),
+		Kind:       kind,
+		LinkTarget: target,
 	}
 
-	if !info.IsDir() {
-		fileInfo := FileInfo{
-			Path:         relative,
-			AbsolutePath: absolute,
-			Size:         info.Size(),
-		}
-		vf.files = append(vf.files, fileInfo)
-		vf.totalSize += fileInfo.Size
+	if kind == FileKindFile {
+		fileInfo.Size = info.Size()
 	}
 
-	return nil
+	vf.files = append(vf.files, fileInfo)
+	vf.sources = append(vf.sources, source)
+	vf.totalSize += fileInfo.Size
 }
 
 // func generateFileMetadata(path string) (*Metadata, error) {
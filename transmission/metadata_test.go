@@ -2,9 +2,14 @@ package transmission
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 )
 
@@ -26,7 +31,7 @@ func TestGenerateMetadata(t *testing.T) {
 
 	if fi.Name != res.Name ||
 		fi.Type != res.Type ||
-		fi.Checksum != res.Checksum || fi.PieceLength != res.PieceLength ||
+		!bytes.Equal(fi.Checksum, res.Checksum) || fi.PieceLength != res.PieceLength ||
 		fi.FileLength != res.FileLength {
 		t.Fatalf("invalid metadata")
 	}
@@ -101,7 +106,7 @@ func TestWritingFromVirtualFile(t *testing.T) {
 		files:        meta.Folders,
 		pieces:       meta.Pieces,
 		totalSize:    meta.FileLength,
-		handles:      make([]*os.File, len(meta.Folders)),
+		handles:      make([]fileHandle, len(meta.Folders)),
 		single:       meta.Single,
 	}
 
@@ -132,7 +137,7 @@ func TestWritingFromVirtualFile(t *testing.T) {
 			t.Fatalf("failed while reading %v\n", err)
 		}
 
-		_, err := lf.WriteAt(int64(offset), buf)
+		_, err := lf.WriteAt(buf, int64(offset))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -178,3 +183,328 @@ func TestWritingFromVirtualFile(t *testing.T) {
 	lf.Close()
 	os.RemoveAll("./testdata/result/small")
 }
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MIN_PIECE_LENGTH},
+		{10 * 1024, MIN_PIECE_LENGTH},
+		{1 << 30, 512 * 1024},
+		{100 << 30, MAX_PIECE_LENGTH},
+	}
+
+	for _, test := range tests {
+		if got := AutoPieceLength(test.size); got != test.want {
+			t.Fatalf("expected piece length %d for %d bytes got %d", test.want, test.size, got)
+		}
+	}
+
+	for _, pieceLength := range []int{0, 1000, MIN_PIECE_LENGTH / 2, MAX_PIECE_LENGTH * 2} {
+		if err := checkPieceLength(pieceLength); err != ErrInvalidPieceLength {
+			t.Fatalf("expected %d to be refused got %v", pieceLength, err)
+		}
+	}
+}
+
+func TestGenerateMetadataPieceLength(t *testing.T) {
+	root := writeTestTree(t, 100*1024, 30*1024)
+
+	meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: HashSHA256, PieceLength: AUTO_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	if meta.PieceLength != MIN_PIECE_LENGTH || meta.NumPieces() != 9 {
+		t.Fatalf("expected 9 pieces of %d got %d of %d", MIN_PIECE_LENGTH, meta.NumPieces(), meta.PieceLength)
+	}
+}
+
+// A listener refuses piece lengths a sender could not have chosen before sizing anything from them
+func TestValidatePieceLength(t *testing.T) {
+	root := writeTestTree(t, 100*1024, 30*1024)
+
+	meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: HashSHA256, Merkle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	if err := meta.validate(); err != nil {
+		t.Fatalf("expected the generated metadata to be valid got %v", err)
+	}
+
+	for _, pieceLength := range []int32{1, MIN_PIECE_LENGTH - 1, MIN_PIECE_LENGTH + 1, MAX_PIECE_LENGTH * 2} {
+		altered := *meta
+		altered.PieceLength = pieceLength
+
+		if err := altered.validate(); err != ErrInvalidPieceLength {
+			t.Fatalf("expected piece length %d to be refused got %v", pieceLength, err)
+		}
+	}
+}
+
+// Every piece of the content needs exactly one hash
+func TestValidatePieceCount(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+
+	meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: HashSHA256, PieceLength: MIN_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	if err := meta.validate(); err != nil {
+		t.Fatalf("expected the generated metadata to be valid got %v", err)
+	}
+
+	short := *meta
+	short.Pieces = meta.Pieces[:1]
+	if err := short.validate(); !errors.Is(err, ErrPieceCountMismatch) {
+		t.Fatalf("expected 1 of %d piece hashes to be refused got %v", len(meta.Pieces), err)
+	}
+
+	long := *meta
+	long.Pieces = append(slices.Clone(meta.Pieces), meta.Pieces[0])
+	if err := long.validate(); !errors.Is(err, ErrPieceCountMismatch) {
+		t.Fatalf("expected an extra piece hash to be refused got %v", err)
+	}
+}
+
+func TestGenerateMetadataEmptyEntries(t *testing.T) {
+	root := writeTestTree(t, 1024)
+	if err := os.WriteFile(filepath.Join(root, "empty.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "emptydir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	kinds := make(map[string]FileKind)
+	for _, f := range meta.Folders {
+		kinds[filepath.ToSlash(f.Path)] = f.Kind
+	}
+
+	if len(kinds) != 4 || kinds["dir0"] != FileKindDir || kinds["emptydir"] != FileKindDir ||
+		kinds["empty.txt"] != FileKindFile || kinds["dir0/file0.bin"] != FileKindFile {
+		t.Fatalf("expected both directories and both files got %v", kinds)
+	}
+
+	if meta.FileLength != 1024 || meta.NumPieces() != 1 {
+		t.Fatalf("expected 1024 bytes in 1 piece got %d in %d", meta.FileLength, meta.NumPieces())
+	}
+}
+
+func TestMarshallMetadataHasNoLocalPaths(t *testing.T) {
+	root := writeTestTree(t, 1024, 2048)
+	if !filepath.IsAbs(root) {
+		t.Fatalf("expected an absolute test tree got %s", root)
+	}
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	message, err := MarshallMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Name != filepath.Base(root) {
+		t.Fatalf("expected the name %s got %s", filepath.Base(root), meta.Name)
+	}
+
+	//The parent directory is what the sender would leak, e.g. its home directory
+	if bytes.Contains(message.Payload, []byte(filepath.Dir(root))) {
+		t.Fatalf("metadata sent to listeners contains the local path %s", filepath.Dir(root))
+	}
+}
+
+// Virtual file a listener writes the content described by meta into, under dir
+func listenerFile(meta *Metadata, dir string) *VirtualFile {
+	return &VirtualFile{
+		rootPath:     meta.Name,
+		downloadPath: dir,
+		files:        meta.Folders,
+		pieces:       meta.Pieces,
+		pieceLength:  int(meta.PieceLength),
+		totalSize:    meta.FileLength,
+		handles:      make([]fileHandle, len(meta.Folders)),
+		single:       meta.Single,
+	}
+}
+
+func TestWriteAtRandomOrder(t *testing.T) {
+	root := writeTestTree(t, 100*1024, 0, 37*1024, 250*1024+3, 16*1024)
+
+	meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, PieceLength: MIN_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	for _, preallocate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preallocate=%v", preallocate), func(t *testing.T) {
+			dir := t.TempDir()
+			lf := listenerFile(meta, dir)
+			defer lf.Close()
+
+			if preallocate {
+				if err := lf.Preallocate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			//Every piece in random order from several goroutines, some of them twice as if retried
+			order := rand.Perm(meta.NumPieces())
+			order = append(order, order[:len(order)/3]...)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, len(order))
+			for worker := range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					buf := make([]byte, meta.PieceLength)
+					for i := worker; i < len(order); i += 4 {
+						begin, end := meta.pieceBounds(order[i])
+						if _, err := vf.ReadAt(buf[:end-begin], begin); err != nil && err != io.EOF {
+							errs <- err
+							return
+						}
+
+						if _, err := lf.WriteAt(buf[:end-begin], begin); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			if err := lf.restoreAttributes(); err != nil {
+				t.Fatal(err)
+			}
+
+			compareTrees(t, root, filepath.Join(dir, meta.Name))
+		})
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	root := writeTestTree(t, 100*1024, 37*1024, 250*1024)
+
+	meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, PieceLength: MIN_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vf.Close()
+
+	dir := t.TempDir()
+	lf := listenerFile(meta, dir)
+	defer lf.Close()
+
+	skipped := -1
+	lf.selected = make([]bool, len(meta.Folders))
+	for i, f := range meta.Folders {
+		lf.selected[i] = true
+		if f.Kind == FileKindFile && skipped < 0 {
+			lf.selected[i] = false
+			skipped = i
+		}
+	}
+
+	if err := lf.Preallocate(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Every selected file has its final size before a single piece arrives
+	for i, f := range meta.Folders {
+		if f.Kind != FileKindFile {
+			continue
+		}
+
+		info, err := os.Stat(lf.filePath(i))
+		if i == skipped {
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected %s, which was not selected, not to be created", f.Path)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() != f.Size {
+			t.Fatalf("expected %s to be preallocated to %d bytes got %d", f.Path, f.Size, info.Size())
+		}
+	}
+}
+
+func TestWriteAtSparse(t *testing.T) {
+	//Data, a long run of zeros, then data again
+	content := make([]byte, 8*MIN_PIECE_LENGTH)
+	copy(content, "head")
+	copy(content[len(content)-4:], "tail")
+
+	source := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(source, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, vf, err := GenerateMetadataWithOptions(source, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, PieceLength: MIN_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	//Leftovers from an earlier, shorter file must be overwritten even where the content is zeros
+	dir := t.TempDir()
+	stale := bytes.Repeat([]byte{0xff}, 3*MIN_PIECE_LENGTH)
+	if err := os.WriteFile(filepath.Join(dir, meta.Name), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lf := listenerFile(meta, dir)
+	defer lf.Close()
+
+	buf := make([]byte, MIN_PIECE_LENGTH)
+	for i := meta.NumPieces() - 1; i >= 0; i-- {
+		begin, end := meta.pieceBounds(i)
+		if _, err := vf.ReadAt(buf[:end-begin], begin); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+
+		if n, err := lf.WriteAt(buf[:end-begin], begin); err != nil || int64(n) != end-begin {
+			t.Fatalf("expected piece %d to be written got %d bytes (%v)", i, n, err)
+		}
+	}
+	lf.Close()
+
+	got, err := os.ReadFile(filepath.Join(dir, meta.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Fatal("the written file differs from the source")
+	}
+}
@@ -0,0 +1,146 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+// SPAKE2 over edwards25519. Both sides derive the same session key only when they know the same code phrase,
+// and an eavesdropper or impostor learns nothing that lets them guess the code offline.
+//
+// The sender plays role A and sends X = x*G + w*M, the listener plays role B and sends Y = y*G + w*N.
+// Each side removes the other's password blinding and computes the shared point K = x*y*G.
+
+type pakeRole int8
+
+const (
+	pakeRoleSender pakeRole = iota
+	pakeRoleListener
+)
+
+var ErrPakeInvalidMessage = fmt.Errorf("invalid key exchange message")
+
+// The blinding points M and N must have no known discrete log relative to G.
+// They are derived by hashing a fixed label to the curve, so nobody picked them.
+var (
+	pakeM = hashToPoint("nin spake2 M")
+	pakeN = hashToPoint("nin spake2 N")
+)
+
+type spake2 struct {
+	role pakeRole
+	w    *edwards25519.Scalar
+	x    *edwards25519.Scalar
+	msg  []byte
+}
+
+func newSpake2(code string, role pakeRole) (*spake2, error) {
+	w, err := passwordScalar(code)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	blind := pakeM
+	if role == pakeRoleListener {
+		blind = pakeN
+	}
+
+	//x*G + w*blind
+	public := new(edwards25519.Point).ScalarBaseMult(x)
+	public.Add(public, new(edwards25519.Point).ScalarMult(w, blind))
+
+	return &spake2{
+		role: role,
+		w:    w,
+		x:    x,
+		msg:  public.Bytes(),
+	}, nil
+}
+
+// Message to send to the other side
+func (s *spake2) Bytes() []byte {
+	return s.msg
+}
+
+// Derive the session key from the other side's message
+func (s *spake2) SessionKey(peerMsg []byte) ([]byte, error) {
+	peer, err := new(edwards25519.Point).SetBytes(peerMsg)
+	if err != nil {
+		return nil, ErrPakeInvalidMessage
+	}
+
+	blind := pakeN
+	if s.role == pakeRoleListener {
+		blind = pakeM
+	}
+
+	//Remove the other side's blinding then multiply by our secret and the cofactor
+	unblinded := new(edwards25519.Point).Subtract(peer, new(edwards25519.Point).ScalarMult(s.w, blind))
+	shared := new(edwards25519.Point).ScalarMult(s.x, unblinded)
+	shared.MultByCofactor(shared)
+
+	if shared.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, ErrPakeInvalidMessage
+	}
+
+	senderMsg, listenerMsg := s.msg, peerMsg
+	if s.role == pakeRoleListener {
+		senderMsg, listenerMsg = peerMsg, s.msg
+	}
+
+	//Bind the key to the whole transcript
+	hasher := sha256.New()
+	for _, part := range [][]byte{senderMsg, listenerMsg, shared.Bytes(), s.w.Bytes()} {
+		binary.Write(hasher, binary.BigEndian, uint32(len(part)))
+		hasher.Write(part)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+func passwordScalar(code string) (*edwards25519.Scalar, error) {
+	hash := sha512.Sum512([]byte("nin spake2 password:" + code))
+	return edwards25519.NewScalar().SetUniformBytes(hash[:])
+}
+
+func randomScalar() (*edwards25519.Scalar, error) {
+	byt := make([]byte, 64)
+	if _, err := rand.Read(byt); err != nil {
+		return nil, err
+	}
+
+	return edwards25519.NewScalar().SetUniformBytes(byt)
+}
+
+// Try-and-increment hash to the curve. The result is multiplied by the cofactor so it lies in the prime order subgroup.
+func hashToPoint(label string) *edwards25519.Point {
+	for counter := uint32(0); ; counter++ {
+		var buf bytes.Buffer
+		buf.WriteString(label)
+		binary.Write(&buf, binary.BigEndian, counter)
+
+		hash := sha256.Sum256(buf.Bytes())
+		point, err := new(edwards25519.Point).SetBytes(hash[:])
+		if err != nil {
+			continue
+		}
+
+		point.MultByCofactor(point)
+		if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+
+		return point
+	}
+}
@@ -0,0 +1,116 @@
+package transmission
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//Longest path in the metadata a listener accepts, in bytes
+	MAX_PATH_LENGTH = 4096
+	//Longest single file or directory name
+	MAX_NAME_LENGTH = 255
+	//Most directories a path may be nested in
+	MAX_PATH_DEPTH = 64
+	//Largest file or content a listener accepts, 1 PiB, so summing the sizes cannot overflow
+	MAX_CONTENT_LENGTH = 1 << 50
+)
+
+var ErrUnsafePath = errors.New("unsafe path in metadata")
+
+// Names Windows reserves for devices, with or without an extension. They are refused everywhere
+// so content received on one system can be passed on to another.
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Make sure a path sent by a sender stays inside the directory it is joined to.
+// Both slashes and backslashes are treated as separators, whichever system the sender runs on.
+func checkPath(path string) error {
+	if path == "" || len(path) > MAX_PATH_LENGTH {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, path)
+	}
+
+	if strings.ContainsRune(path, 0) || !filepath.IsLocal(filepath.FromSlash(path)) {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, path)
+	}
+
+	names := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	if len(names) == 0 || len(names) > MAX_PATH_DEPTH {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, path)
+	}
+
+	for _, name := range names {
+		if name == "." || name == ".." || len(name) > MAX_NAME_LENGTH || reservedName(name) {
+			return fmt.Errorf("%w: %q", ErrUnsafePath, path)
+		}
+	}
+
+	return nil
+}
+
+func reservedName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.TrimRight(base, " ")
+
+	for _, reserved := range reservedNames {
+		if strings.EqualFold(base, reserved) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check every path the listener will create from the metadata, and that the files
+// tile the content without gaps or overlaps
+func (m *Metadata) checkFiles() error {
+	if err := checkPath(filepath.Base(m.Name)); err != nil {
+		return err
+	}
+
+	//A single file is saved under the name alone
+	if m.Single && len(m.Folders) > 1 {
+		return fmt.Errorf("%w: single file with %d entries", ErrUnsafePath, len(m.Folders))
+	}
+
+	var offset int64
+	for _, f := range m.Folders {
+		if !m.Single {
+			if err := checkPath(f.Path); err != nil {
+				return err
+			}
+		}
+
+		if f.Kind > FileKindSymlink || f.Size < 0 || f.Size > MAX_CONTENT_LENGTH || (f.Kind != FileKindFile && f.Size != 0) {
+			return fmt.Errorf("invalid entry for %q", f.Path)
+		}
+
+		if f.CummulativeOffset != offset {
+			return fmt.Errorf("entry for %q starts at %d instead of %d", f.Path, f.CummulativeOffset, offset)
+		}
+
+		offset += f.Size
+		if offset > MAX_CONTENT_LENGTH {
+			return fmt.Errorf("entries hold more than %d bytes", MAX_CONTENT_LENGTH)
+		}
+	}
+
+	//A stream's length is unknown until it ends
+	if m.Stream {
+		return nil
+	}
+
+	if offset != m.FileLength {
+		return fmt.Errorf("entries hold %d bytes but the content is %d", offset, m.FileLength)
+	}
+
+	return nil
+}
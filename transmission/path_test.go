@@ -0,0 +1,131 @@
+package transmission
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		path string
+		safe bool
+	}{
+		{"file.bin", true},
+		{"dir0/file0.bin", true},
+		{"a/b/../c", false},
+		{"../../.bashrc", false},
+		{"..", false},
+		{".", false},
+		{"", false},
+		{"/etc/passwd", false},
+		{"dir\\..\\..\\file", false},
+		{"C:\\Windows", true},
+		{"NUL", false},
+		{"docs/com1.txt", false},
+		{"docs/console.txt", true},
+		{"a\x00b", false},
+		{strings.Repeat("a", MAX_NAME_LENGTH+1), false},
+		{strings.Repeat("a/", MAX_PATH_DEPTH) + "a", false},
+	}
+
+	for _, test := range tests {
+		if err := checkPath(test.path); (err == nil) != test.safe {
+			t.Fatalf("expected %q safe=%v got %v", test.path, test.safe, err)
+		}
+	}
+}
+
+func TestValidateRejectsUnsafeMetadata(t *testing.T) {
+	root := writeTestTree(t, 1024, 2048)
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vf.Close()
+
+	if err := meta.validate(); err != nil {
+		t.Fatalf("expected generated metadata to be valid got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		alter func(m *Metadata)
+	}{
+		{"traversal", func(m *Metadata) { m.Folders[1].Path = filepath.Join("..", "..", ".bashrc") }},
+		{"absolute", func(m *Metadata) { m.Folders[1].Path = "/tmp/file" }},
+		{"name", func(m *Metadata) { m.Name = ".." }},
+		{"overlap", func(m *Metadata) { m.Folders[len(m.Folders)-1].CummulativeOffset = 0 }},
+		{"negative size", func(m *Metadata) { m.Folders[1].Size = -1 }},
+	}
+
+	for _, test := range tests {
+		altered := *meta
+		altered.Folders = append([]FileInfo(nil), meta.Folders...)
+		test.alter(&altered)
+
+		if err := altered.validate(); err == nil {
+			t.Fatalf("%s: expected the metadata to be refused", test.name)
+		}
+	}
+}
+
+// Every path a listener would write to for validated metadata must be inside its download directory
+func FuzzUnmarshallMetadata(f *testing.F) {
+	root := writeTestTree(f, 1024, 2048)
+	for _, opts := range []MetadataOptions{{Hash: HashSHA256}, {Hash: HashBLAKE3, Merkle: true}} {
+		meta, vf, err := GenerateMetadataWithOptions(root, opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		vf.Close()
+
+		msg, err := MarshallMetadata(meta)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(msg.Payload)
+	}
+
+	downloadPath := filepath.Join(f.TempDir(), "download")
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		meta, err := UnmarshallMetadata(&Message{ID: MessageMetadata, Payload: payload})
+		if err != nil || meta.validate() != nil {
+			return
+		}
+
+		vf := &VirtualFile{rootPath: meta.Name, files: meta.Folders, single: meta.Single, downloadPath: downloadPath}
+		for i := range meta.Folders {
+			relative, err := filepath.Rel(downloadPath, vf.filePath(i))
+			if err != nil || !filepath.IsLocal(relative) {
+				t.Fatalf("%q escapes the download directory", vf.filePath(i))
+			}
+		}
+	})
+}
+
+func FuzzCheckPath(f *testing.F) {
+	for _, path := range []string{"dir0/file0.bin", "../x", "a/./b", "a\\..\\b", "/abs", "aux.txt"} {
+		f.Add(path)
+	}
+
+	downloadPath := filepath.Join(f.TempDir(), "download")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		err := checkPath(path)
+		if err != nil {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("expected an unsafe path error got %v", err)
+			}
+			return
+		}
+
+		relative, err := filepath.Rel(downloadPath, filepath.Join(downloadPath, path))
+		if err != nil || !filepath.IsLocal(relative) || relative == "." {
+			t.Fatalf("%q was accepted but resolves to %q", path, relative)
+		}
+	})
+}
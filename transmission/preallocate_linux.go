@@ -0,0 +1,24 @@
+//go:build linux
+
+package transmission
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Grow file to size with blocks reserved on disk, so running out of space fails now rather than halfway
+// through the download. File systems without fallocate get a sparse file instead.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return file.Truncate(size)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: file.Name(), Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transmission
+
+import "os"
+
+// Grow file to size. Only Linux reserves the blocks, elsewhere the file is left sparse.
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,245 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Default number of listeners that may wait for a free slot
+const DEFAULT_QUEUE_LIMIT = 16
+
+// Suggested wait before a refused listener tries again
+const QUEUE_RETRY_AFTER = 30 * time.Second
+
+// How often a queued listener is told its position. It doubles as a keep-alive.
+const QUEUE_UPDATE_INTERVAL = 5 * time.Second
+
+var ErrSenderFull = errors.New("sender full")
+
+// Sent by the sender in place of an acknowledgement when every listener slot is taken.
+// A non zero position means the listener is queued and will be acknowledged when a slot frees up,
+// otherwise the queue is full too and the listener should try again after RetryAfter.
+type Reject struct {
+	Reason     string
+	RetryAfter time.Duration
+	Position   int
+}
+
+// RejectError is returned to the caller when the sender refuses a listener without queueing it
+type RejectError struct {
+	Reject
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Reason, e.RetryAfter)
+}
+
+func (e *RejectError) Unwrap() error {
+	return ErrSenderFull
+}
+
+// <reason length><reason><retry after seconds><position>
+func MarshallReject(r *Reject) *Message {
+	var payload bytes.Buffer
+
+	writeString(&payload, r.Reason)
+	binary.Write(&payload, binary.BigEndian, uint32(r.RetryAfter/time.Second))
+	binary.Write(&payload, binary.BigEndian, uint32(r.Position))
+
+	return &Message{ID: MessageReject, Payload: payload.Bytes()}
+}
+
+func UnmarshallReject(message *Message) (*Reject, error) {
+	buf := bytes.NewReader(message.Payload)
+
+	reason, err := readString(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var retryAfter, position uint32
+	if err := binary.Read(buf, binary.BigEndian, &retryAfter); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &position); err != nil {
+		return nil, err
+	}
+
+	return &Reject{
+		Reason:     reason,
+		RetryAfter: time.Duration(retryAfter) * time.Second,
+		Position:   int(position),
+	}, nil
+}
+
+// Key a session's slot is tracked under. A listener that sent no peer ID counts each connection as its own listener.
+func (s *listenerSession) slotKey() string {
+	if s.peerID == "" {
+		return s.raw.RemoteAddr().String()
+	}
+
+	return s.peerID
+}
+
+// Must be called with p.mu held
+func (p *Peer) join(s *listenerSession) {
+	if p.peers == nil {
+		p.peers = make(map[string]int)
+	}
+
+	p.peers[s.slotKey()]++
+	p.Listeners = append(p.Listeners, s.raw)
+	s.joined = true
+}
+
+// Take a listener slot for the session if one is free and nobody is queued ahead of it.
+// Extra connections from a listener that already holds a slot share it.
+func (p *Peer) admit(s *listenerSession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers[s.slotKey()] == 0 && (len(p.peers) >= p.ListenerLimit || len(p.waiting) > 0) {
+		return false
+	}
+
+	p.join(s)
+	return true
+}
+
+// Count the session as inspecting unless MAX_INSPECT_SESSIONS already are
+func (p *Peer) admitInspect(s *listenerSession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inspectors >= MAX_INSPECT_SESSIONS {
+		return false
+	}
+
+	p.inspectors++
+	s.inspectCounted = true
+	return true
+}
+
+// Hand free slots to queued listeners in the order they arrived
+func (p *Peer) admitNext() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.peers) < p.ListenerLimit && len(p.waiting) > 0 {
+		next := p.waiting[0]
+		p.waiting = p.waiting[1:]
+
+		p.join(next)
+		close(next.admitted)
+	}
+}
+
+// Give up the session's share of its listener slot, or its place among the inspecting peers
+func (p *Peer) release(s *listenerSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.subscribers, s)
+
+	if s.inspectCounted {
+		p.inspectors--
+		s.inspectCounted = false
+	}
+
+	if !s.joined {
+		return
+	}
+
+	for i, c := range p.Listeners {
+		if c == s.raw {
+			p.Listeners = append(p.Listeners[:i], p.Listeners[i+1:]...)
+			break
+		}
+	}
+
+	key := s.slotKey()
+	p.peers[key]--
+	if p.peers[key] <= 0 {
+		delete(p.peers, key)
+	}
+
+	s.joined = false
+}
+
+// Position of the session in the queue starting at 1, or 0 if it is not queued
+func (p *Peer) queuePosition(s *listenerSession) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for i, w := range p.waiting {
+		if w == s {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+func (p *Peer) leaveQueue(s *listenerSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, w := range p.waiting {
+		if w == s {
+			p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Queue the session and block until it is admitted. Returns an error when the queue is full,
+// the listener goes away or the sender shuts down.
+func (p *Peer) waitInQueue(s *listenerSession) error {
+	p.mu.Lock()
+	if len(p.waiting) >= p.QueueLimit {
+		p.mu.Unlock()
+
+		p.dlog("queue full, refusing listener %s", s.peerID)
+		reject := Reject{Reason: "sender full", RetryAfter: QUEUE_RETRY_AFTER}
+		_, _ = s.conn.Write(MarshallReject(&reject).Serialize())
+		return &RejectError{reject}
+	}
+
+	s.admitted = make(chan struct{})
+	p.waiting = append(p.waiting, s)
+	position := len(p.waiting)
+	p.mu.Unlock()
+
+	p.dlog("sender full, queued listener %s at position %d", s.peerID, position)
+
+	ticker := time.NewTicker(QUEUE_UPDATE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		reject := Reject{Reason: "sender full", RetryAfter: QUEUE_RETRY_AFTER, Position: position}
+		if _, err := s.conn.Write(MarshallReject(&reject).Serialize()); err != nil {
+			p.leaveQueue(s)
+			return err
+		}
+
+		select {
+		case <-s.admitted:
+			p.dlog("admitted queued listener %s", s.peerID)
+			return nil
+		case <-p.shutdown:
+			p.leaveQueue(s)
+			return fmt.Errorf("sender shutting down")
+		case <-ticker.C:
+			position = p.queuePosition(s)
+			if position == 0 {
+				//Admitted between the tick and the check
+				<-s.admitted
+				return nil
+			}
+		}
+	}
+}
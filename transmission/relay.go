@@ -0,0 +1,138 @@
+package transmission
+
+import (
+	"fmt"
+	"net"
+)
+
+// Serve the pieces this listener has verified to other listeners and announce it on the local network.
+// Must be called once the metadata and p.have are in place.
+func (p *Peer) startRelay(opts Options) error {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.State = relay
+	p.selfConn = l
+	p.Port = l.Addr().(*net.TCPAddr).Port
+	p.portStr = fmt.Sprint(p.Port)
+	p.shutdown = make(chan struct{})
+	p.ready = opts.Ready
+
+	p.AutomaticShutdownDelay = opts.AutomaticShutdownDelay
+	if p.AutomaticShutdownDelay == 0 {
+		p.AutomaticShutdownDelay = DefaultAutomaticShutdownDelay
+	}
+
+	p.ListenerLimit = opts.ListenerLimit
+	if p.ListenerLimit == 0 {
+		p.ListenerLimit = 4
+	}
+
+	p.QueueLimit = opts.QueueLimit
+	if p.QueueLimit == 0 {
+		p.QueueLimit = DEFAULT_QUEUE_LIMIT
+	}
+	p.mu.Unlock()
+
+	p.dlog("relaying on %s", l.Addr().String())
+
+	if p.ready != nil {
+		p.ready(l.Addr())
+	}
+	p.emit(Event{Kind: EventReady, Address: l.Addr().String()})
+
+	p.broadcast()
+	go p.serve()
+
+	return nil
+}
+
+// Whether this peer can serve the piece at index
+func (p *Peer) holds(index int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.servable(index)
+}
+
+// A relay that downloaded selected files only stores pieces lying entirely within them.
+// In Merkle mode it also needs the piece's proof, which a piece resumed from an earlier run may lack.
+// Must be called with p.mu held.
+func (p *Peer) servable(index int) bool {
+	if p.have == nil {
+		return true
+	}
+
+	begin, end := p.Metadata.pieceBounds(index)
+	if !p.have.Has(index) || !p.OpenFile.covers(begin, end) {
+		return false
+	}
+
+	if p.tree != nil {
+		_, ok := p.tree.proof(index)
+		return ok
+	}
+
+	return true
+}
+
+// Copy of the pieces this peer can serve. Must be called with p.mu held.
+func (p *Peer) bitfieldLocked() Bitfield {
+	numPieces := p.Metadata.NumPieces()
+	if p.have == nil {
+		have := NewBitfield(numPieces)
+		for i := range numPieces {
+			have.Set(i)
+		}
+		return have
+	}
+
+	have := NewBitfield(numPieces)
+	for i := range numPieces {
+		if p.servable(i) {
+			have.Set(i)
+		}
+	}
+	return have
+}
+
+// Send the session a bitfield of the pieces this peer can serve and a have message for every piece gained afterwards
+func (p *Peer) subscribe(s *listenerSession) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	//Taking the snapshot and subscribing together means no piece is missed in between
+	p.mu.Lock()
+	have := p.bitfieldLocked()
+	if p.subscribers == nil {
+		p.subscribers = make(map[*listenerSession]bool)
+	}
+	p.subscribers[s] = true
+	p.mu.Unlock()
+
+	_, err := s.conn.Write(MarshallBitfield(p.Metadata.InfoHash(), have).Serialize())
+	return err
+}
+
+// Tell subscribed listeners about a newly verified piece
+func (p *Peer) announceHave(index int) {
+	if !p.holds(index) {
+		return
+	}
+
+	p.mu.RLock()
+	sessions := make([]*listenerSession, 0, len(p.subscribers))
+	for s := range p.subscribers {
+		sessions = append(sessions, s)
+	}
+	p.mu.RUnlock()
+
+	for _, s := range sessions {
+		if _, err := s.write(haveMessage(index)); err != nil {
+			p.dlog("could not send have %d to %s: %v", index, s.peerID, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Extension of the sidecar file that records download progress next to the download
+const RESUME_STATE_EXTENSION = ".nin-state"
+
+// Persisted progress of a download. Pieces are keyed by the info hash of the metadata,
+// so a state file left behind by a different transfer with the same name is ignored.
+type resumeState struct {
+	InfoHash [20]byte
+	Have     Bitfield
+	//Piece hashes learned from verified proofs in Merkle mode, nil for pieces not yet downloaded
+	Leaves [][]byte
+}
+
+// Path of the sidecar state file for the download described by the metadata
+func resumeStatePath(downloadPath string, metadata *Metadata) string {
+	return filepath.Join(downloadPath, filepath.Base(metadata.Name)+RESUME_STATE_EXTENSION)
+}
+
+// Load the pieces recorded in the state file. A missing or mismatched state file yields an empty bitfield.
+// In Merkle mode the piece hashes of the recorded pieces are restored into the tree.
+func loadResumeState(path string, metadata *Metadata, tree *merkleTree) (Bitfield, error) {
+	have := NewBitfield(metadata.NumPieces())
+
+	byt, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return have, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state resumeState
+	if err := gob.NewDecoder(bytes.NewReader(byt)).Decode(&state); err != nil {
+		//A corrupt state file is not fatal, the download simply starts over
+		return have, nil
+	}
+
+	if state.InfoHash != metadata.InfoHash() || len(state.Have) != len(have) {
+		return have, nil
+	}
+
+	if tree != nil {
+		for i := range metadata.NumPieces() {
+			if !state.Have.Has(i) {
+				continue
+			}
+
+			//Without its hash the piece cannot be checked, so it is downloaded again
+			if i >= len(state.Leaves) || len(state.Leaves[i]) != metadata.HashAlgorithm.Size() {
+				state.Have.Clear(i)
+				continue
+			}
+
+			tree.restore(i, state.Leaves[i])
+		}
+	}
+
+	return state.Have, nil
+}
+
+// Atomically write the state file
+func saveResumeState(path string, metadata *Metadata, have Bitfield, tree *merkleTree) error {
+	var buf bytes.Buffer
+
+	state := resumeState{
+		InfoHash: metadata.InfoHash(),
+		Have:     have,
+	}
+
+	if tree != nil {
+		state.Leaves = make([][]byte, metadata.NumPieces())
+		for i := range state.Leaves {
+			if have.Has(i) {
+				state.Leaves[i] = tree.leaf(i)
+			}
+		}
+	}
+
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Re-hash every piece the state file claims is present and clear the ones that no longer match
+func verifyExistingPieces(vf *VirtualFile, metadata *Metadata, tree *merkleTree, have Bitfield) error {
+	buf := make([]byte, metadata.PieceLength)
+
+	for i := range metadata.NumPieces() {
+		if !have.Has(i) {
+			continue
+		}
+
+		begin, end := metadata.pieceBounds(i)
+
+		//Part of the piece was dropped because it belongs to a file that was not selected
+		if !vf.covers(begin, end) {
+			have.Clear(i)
+			continue
+		}
+
+		n, err := vf.ReadAt(buf[:end-begin], begin)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var expected []byte
+		if tree != nil {
+			expected = tree.leaf(i)
+		} else {
+			expected = metadata.Pieces[i]
+		}
+
+		hash := metadata.HashAlgorithm.Sum(buf[:n])
+		if int64(n) != end-begin || !bytes.Equal(hash, expected) {
+			have.Clear(i)
+		}
+	}
+
+	return nil
+}
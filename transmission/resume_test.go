@@ -0,0 +1,219 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a folder of files filled with random data and return its path
+func writeTestTree(t testing.TB, sizes ...int) string {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "tree")
+	for i, size := range sizes {
+		path := filepath.Join(root, fmt.Sprintf("dir%d", i%2), fmt.Sprintf("file%d.bin", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, size)
+		if _, err := rand.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// Fail the test if the files under got do not match the files under want
+func compareTrees(t *testing.T, want, got string) {
+	t.Helper()
+
+	err := filepath.Walk(want, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(want, path)
+		if err != nil {
+			return err
+		}
+
+		buf1, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		buf2, err := os.ReadFile(filepath.Join(got, relative))
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(buf1, buf2) {
+			return fmt.Errorf("%s differs from the original", relative)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeStateRoundTrip(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatalf("an error as occured while generating metadata %v\n", err)
+	}
+	defer vf.Close()
+
+	have := NewBitfield(len(meta.Pieces))
+	have.Set(0)
+	have.Set(2)
+
+	path := filepath.Join(t.TempDir(), "state"+RESUME_STATE_EXTENSION)
+	if err := saveResumeState(path, meta, have, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadResumeState(path, meta, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(loaded, have) {
+		t.Fatalf("expected bitfield %08b got %08b", have, loaded)
+	}
+
+	//A state file for different content must be ignored
+	other := *meta
+	other.Pieces = meta.Pieces[1:]
+	loaded, err = loadResumeState(path, &other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Count(len(other.Pieces)) != 0 {
+		t.Fatalf("expected state of other content to be ignored")
+	}
+}
+
+func TestVerifyExistingPieces(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatalf("an error as occured while generating metadata %v\n", err)
+	}
+	defer vf.Close()
+
+	downloadPath := t.TempDir()
+	lf := VirtualFile{
+		rootPath:     meta.Name,
+		downloadPath: downloadPath,
+		files:        meta.Folders,
+		pieces:       meta.Pieces,
+		totalSize:    meta.FileLength,
+		handles:      make([]fileHandle, len(meta.Folders)),
+		single:       meta.Single,
+	}
+	defer lf.Close()
+
+	//Copy every piece but corrupt piece 1
+	have := NewBitfield(len(meta.Pieces))
+	buf := make([]byte, meta.PieceLength)
+	for i := range meta.Pieces {
+		begin, end := meta.pieceBounds(i)
+		if _, err := vf.ReadAt(buf[:end-begin], begin); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 1 {
+			buf[10] ^= 0xff
+		}
+
+		if _, err := lf.WriteAt(buf[:end-begin], begin); err != nil {
+			t.Fatal(err)
+		}
+
+		have.Set(i)
+	}
+
+	if err := verifyExistingPieces(&lf, meta, nil, have); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range meta.Pieces {
+		if have.Has(i) == (i == 1) {
+			t.Fatalf("unexpected verification result for piece %d", i)
+		}
+	}
+}
+
+func TestListenResumesPartialDownload(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	meta := p.Metadata
+	downloadPath := t.TempDir()
+
+	//Simulate an interrupted download that wrote the first two pieces
+	lf := VirtualFile{
+		rootPath:     meta.Name,
+		downloadPath: downloadPath,
+		files:        meta.Folders,
+		pieces:       meta.Pieces,
+		totalSize:    meta.FileLength,
+		handles:      make([]fileHandle, len(meta.Folders)),
+		single:       meta.Single,
+	}
+
+	have := NewBitfield(len(meta.Pieces))
+	buf := make([]byte, meta.PieceLength)
+	for i := range 2 {
+		begin, end := meta.pieceBounds(i)
+		if _, err := p.OpenFile.ReadAt(buf[:end-begin], begin); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := lf.WriteAt(buf[:end-begin], begin); err != nil {
+			t.Fatal(err)
+		}
+
+		have.Set(i)
+	}
+	lf.Close()
+
+	statePath := resumeStatePath(downloadPath, meta)
+	if err := saveResumeState(statePath, meta, have, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("expected state file to be removed after completion")
+	}
+}
@@ -0,0 +1,174 @@
+package transmission
+
+import (
+	"slices"
+	"sync"
+)
+
+// Most connections a piece is requested on at once during the endgame
+const ENDGAME_DUPLICATES = 2
+
+// Hands out the pieces that still need downloading to the connections of a listener.
+// A piece is either pending, requested on one or more connections, or finished.
+// Once nothing is pending, idle connections also request pieces that are still in flight elsewhere,
+// so a slow or vanished peer does not hold up the last few pieces (endgame).
+type pieceScheduler struct {
+	mu sync.Mutex
+
+	//Pending pieces in the order they should be requested. Pieces handed back are retried last.
+	pending []int
+
+	//Connections each unfinished piece has been requested on
+	requested map[int][]*remotePeer
+
+	//Closed and replaced whenever pieces are handed back, so idle connections can wait for work
+	wake chan struct{}
+}
+
+func newPieceScheduler(numPieces int, have Bitfield) *pieceScheduler {
+	s := &pieceScheduler{
+		requested: make(map[int][]*remotePeer),
+		wake:      make(chan struct{}),
+	}
+
+	for i := range numPieces {
+		if !have.Has(i) {
+			s.pending = append(s.pending, i)
+		}
+	}
+
+	return s
+}
+
+// A nil bitfield means the peer holds every piece. Must be called with s.mu held.
+func peerHolds(peer *remotePeer, index int) bool {
+	return peer.have == nil || peer.have.Has(index)
+}
+
+// Take the next piece for the peer to request.
+// When there is nothing for this peer ok is false and wait is closed once the pending set changes.
+func (s *pieceScheduler) next(peer *remotePeer) (index int, ok bool, wait <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, piece := range s.pending {
+		if peerHolds(peer, piece) {
+			if i == 0 {
+				s.pending = s.pending[1:]
+			} else {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			}
+
+			s.requested[piece] = append(s.requested[piece], peer)
+			return piece, true, nil
+		}
+	}
+
+	if len(s.pending) == 0 {
+		for piece, peers := range s.requested {
+			if len(peers) < ENDGAME_DUPLICATES && peerHolds(peer, piece) && !slices.Contains(peers, peer) {
+				s.requested[piece] = append(peers, peer)
+				return piece, true, nil
+			}
+		}
+	}
+
+	return 0, false, s.wake
+}
+
+// Hand back a piece the peer failed to deliver. It becomes pending again unless
+// it was finished or is still being fetched by another connection.
+func (s *pieceScheduler) put(peer *remotePeer, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.release(peer, index)
+}
+
+// Must be called with s.mu held
+func (s *pieceScheduler) release(peer *remotePeer, index int) {
+	peers, ok := s.requested[index]
+	if !ok {
+		return
+	}
+
+	peers = slices.DeleteFunc(peers, func(p *remotePeer) bool { return p == peer })
+	if len(peers) > 0 {
+		s.requested[index] = peers
+	} else {
+		delete(s.requested, index)
+		s.pending = append(s.pending, index)
+	}
+
+	s.notify()
+}
+
+// Record that a peer turned out not to hold a piece and hand the piece back.
+// Returns false for a peer that claims to hold every piece, since it cannot be excluded.
+func (s *pieceScheduler) unavailable(peer *remotePeer, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer.have == nil {
+		return false
+	}
+
+	peer.have.Clear(index)
+	s.release(peer, index)
+
+	return true
+}
+
+// Record that a peer has gained a piece
+func (s *pieceScheduler) gained(peer *remotePeer, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer.have == nil {
+		return
+	}
+
+	peer.have.Set(index)
+	s.notify()
+}
+
+// Mark a verified piece as finished. Returns false when another connection already delivered it.
+func (s *pieceScheduler) finish(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.requested[index]; !ok {
+		return false
+	}
+
+	delete(s.requested, index)
+	return true
+}
+
+// Find a pending piece none of the given peers hold, so the download can never finish
+func (s *pieceScheduler) unservable(peers []*remotePeer) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, piece := range s.pending {
+		held := false
+		for _, peer := range peers {
+			if peerHolds(peer, piece) {
+				held = true
+				break
+			}
+		}
+
+		if !held {
+			return piece, true
+		}
+	}
+
+	return 0, false
+}
+
+// Wake connections waiting for work. Must be called with s.mu held.
+func (s *pieceScheduler) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
@@ -0,0 +1,136 @@
+package transmission
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Largest amount of plaintext sealed into a single record
+const MAX_RECORD_SIZE = 64 * 1024
+
+var ErrRecordTooLarge = fmt.Errorf("encrypted record exceeds maximum size")
+var ErrDecryptFailed = fmt.Errorf("could not decrypt message, the code phrase is probably wrong")
+
+// secureConn encrypts and authenticates everything written to the underlying connection.
+// Data is split into records of <length><sealed data>, where length is a uint32 of the sealed data.
+// Each direction has its own key and a counter nonce, so records cannot be replayed, reordered or reflected.
+type secureConn struct {
+	net.Conn
+
+	rmu        sync.Mutex
+	readAEAD   cipher.AEAD
+	readNonce  uint64
+	pending    []byte
+	readHeader [4]byte
+
+	wmu        sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeNonce uint64
+}
+
+func newSecureConn(conn net.Conn, sessionKey []byte, role pakeRole) (*secureConn, error) {
+	senderToListener, err := deriveRecordCipher(sessionKey, "nin sender to listener")
+	if err != nil {
+		return nil, err
+	}
+
+	listenerToSender, err := deriveRecordCipher(sessionKey, "nin listener to sender")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &secureConn{Conn: conn}
+
+	if role == pakeRoleSender {
+		sc.writeAEAD, sc.readAEAD = senderToListener, listenerToSender
+	} else {
+		sc.writeAEAD, sc.readAEAD = listenerToSender, senderToListener
+	}
+
+	return sc, nil
+}
+
+func deriveRecordCipher(sessionKey []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, sessionKey, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (sc *secureConn) Write(p []byte) (int, error) {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), MAX_RECORD_SIZE)]
+
+		record := make([]byte, 4, 4+len(chunk)+sc.writeAEAD.Overhead())
+		record = sc.writeAEAD.Seal(record, counterNonce(sc.writeNonce, sc.writeAEAD.NonceSize()), chunk, nil)
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(record)-4))
+		sc.writeNonce++
+
+		if _, err := sc.Conn.Write(record); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (sc *secureConn) Read(p []byte) (int, error) {
+	sc.rmu.Lock()
+	defer sc.rmu.Unlock()
+
+	if len(sc.pending) == 0 {
+		if _, err := io.ReadFull(sc.Conn, sc.readHeader[:]); err != nil {
+			return 0, err
+		}
+
+		length := binary.BigEndian.Uint32(sc.readHeader[:])
+		if length > uint32(MAX_RECORD_SIZE+sc.readAEAD.Overhead()) {
+			return 0, ErrRecordTooLarge
+		}
+
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(sc.Conn, sealed); err != nil {
+			return 0, err
+		}
+
+		plain, err := sc.readAEAD.Open(sealed[:0], counterNonce(sc.readNonce, sc.readAEAD.NonceSize()), sealed, nil)
+		if err != nil {
+			return 0, ErrDecryptFailed
+		}
+
+		sc.readNonce++
+		sc.pending = plain
+	}
+
+	n := copy(p, sc.pending)
+	sc.pending = sc.pending[n:]
+
+	return n, nil
+}
+
+func counterNonce(counter uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
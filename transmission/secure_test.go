@@ -0,0 +1,138 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSpake2SharedKey(t *testing.T) {
+	sender, err := newSpake2("1234-otter-plaza-cedar", pakeRoleSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := newSpake2("1234-otter-plaza-cedar", pakeRoleListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1, err := sender.SessionKey(listener.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key2, err := listener.SessionKey(sender.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key1, key2) {
+		t.Fatalf("expected both sides to derive the same key")
+	}
+}
+
+func TestSpake2WrongCode(t *testing.T) {
+	sender, err := newSpake2("1234-otter-plaza-cedar", pakeRoleSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := newSpake2("1234-otter-plaza-maple", pakeRoleListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1, err := sender.SessionKey(listener.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key2, err := listener.SessionKey(sender.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(key1, key2) {
+		t.Fatalf("expected different codes to derive different keys")
+	}
+
+	if _, err := sender.SessionKey([]byte{1, 2, 3}); err != ErrPakeInvalidMessage {
+		t.Fatalf("expected %v got %v", ErrPakeInvalidMessage, err)
+	}
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender, err := newSecureConn(c1, key, pakeRoleSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := newSecureConn(c2, key, pakeRoleListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Larger than a single record
+	payload := make([]byte, 3*MAX_RECORD_SIZE+17)
+	rand.Read(payload)
+	msg := Message{ID: MessagePiece, Payload: payload}
+
+	go func() {
+		sender.Write(msg.Serialize())
+	}()
+
+	got, err := DeserializeMessageFromReader(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != MessagePiece || !bytes.Equal(got.Payload, payload) {
+		t.Fatalf("message did not survive the encrypted round trip")
+	}
+
+	go func() {
+		listener.Write(requestPiece(7))
+	}()
+
+	got, err = DeserializeMessageFromReader(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index, err := parsePieceRequest(got.Payload); got.ID != MessageRequestPiece || err != nil || index != 7 {
+		t.Fatalf("message did not survive the encrypted round trip")
+	}
+}
+
+func TestSecureConnWrongKey(t *testing.T) {
+	key1 := make([]byte, 32)
+	key2 := make([]byte, 32)
+	rand.Read(key1)
+	rand.Read(key2)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender, _ := newSecureConn(c1, key1, pakeRoleSender)
+	listener, _ := newSecureConn(c2, key2, pakeRoleListener)
+
+	go func() {
+		sender.Write(senderListenerAck(&Handshake{}))
+	}()
+
+	_, err := io.ReadFull(listener, make([]byte, 5))
+	if err != ErrDecryptFailed {
+		t.Fatalf("expected %v got %v", ErrDecryptFailed, err)
+	}
+}
@@ -0,0 +1,169 @@
+package transmission
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var ErrNothingSelected = errors.New("no files match the selection")
+var ErrSelectionSingleFile = errors.New("files can only be selected from a shared folder")
+
+// Reports whether a slash separated path matches a pattern.
+// ** matches any number of directories and a pattern without a slash matches the file name at any depth,
+// so 'docs/**' selects everything under docs and '*.mp4' every mp4 file.
+func matchPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			//Try every number of directories ** could stand for
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Which files to download. A file is selected when it matches an include pattern, or there are none,
+// and matches no exclude pattern.
+func selectFiles(files []FileInfo, include, exclude []string) []bool {
+	selected := make([]bool, len(files))
+
+	for i, f := range files {
+		name := filepath.ToSlash(f.Path)
+
+		selected[i] = len(include) == 0
+		for _, pattern := range include {
+			if matchPattern(pattern, name) {
+				selected[i] = true
+				break
+			}
+		}
+
+		for _, pattern := range exclude {
+			if matchPattern(pattern, name) {
+				selected[i] = false
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// Pieces overlapping at least one selected file. A nil selection wants every piece.
+func wantedPieces(meta *Metadata, selected []bool) Bitfield {
+	wanted := NewBitfield(meta.NumPieces())
+
+	if selected == nil {
+		for i := range meta.NumPieces() {
+			wanted.Set(i)
+		}
+		return wanted
+	}
+
+	for i, f := range meta.Folders {
+		if !selected[i] || f.Size == 0 {
+			continue
+		}
+
+		first := f.CummulativeOffset / int64(meta.PieceLength)
+		last := (f.CummulativeOffset + f.Size - 1) / int64(meta.PieceLength)
+		for piece := first; piece <= last; piece++ {
+			wanted.Set(int(piece))
+		}
+	}
+
+	return wanted
+}
+
+// Decide which files of the received metadata to download. Returns nil when every file is wanted.
+func (p *Peer) chooseFiles(opts Options) ([]bool, error) {
+	if len(opts.Include) == 0 && len(opts.Exclude) == 0 && opts.PickFiles == nil {
+		return nil, nil
+	}
+
+	if p.Metadata.Single {
+		return nil, ErrSelectionSingleFile
+	}
+
+	if err := validatePatterns(opts.Include); err != nil {
+		return nil, err
+	}
+
+	if err := validatePatterns(opts.Exclude); err != nil {
+		return nil, err
+	}
+
+	selected := selectFiles(p.Metadata.Folders, opts.Include, opts.Exclude)
+
+	if opts.PickFiles != nil {
+		var candidates []FileInfo
+		for i, f := range p.Metadata.Folders {
+			if selected[i] && f.Kind == FileKindFile {
+				candidates = append(candidates, f)
+			}
+		}
+
+		picked, err := opts.PickFiles(candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, f := range p.Metadata.Folders {
+			selected[i] = selected[i] && slices.Contains(picked, f.Path)
+		}
+	}
+
+	count := 0
+	for _, ok := range selected {
+		if ok {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil, ErrNothingSelected
+	}
+
+	p.dlog("downloading %d of %d files", count, len(selected))
+
+	return selected, nil
+}
@@ -0,0 +1,138 @@
+package transmission
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"docs/**", "docs/a.txt", true},
+		{"docs/**", "docs/sub/dir/a.txt", true},
+		{"docs/**", "other/a.txt", false},
+		{"*.mp4", "movie.mp4", true},
+		{"*.mp4", "videos/holiday/movie.mp4", true},
+		{"*.mp4", "videos/movie.mkv", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/root.go", true},
+		{"docs/*.txt", "docs/a.txt", true},
+		{"docs/*.txt", "docs/sub/a.txt", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	files := []FileInfo{
+		{Path: filepath.Join("docs", "guide.txt")},
+		{Path: filepath.Join("docs", "intro.mp4")},
+		{Path: filepath.Join("src", "main.go")},
+	}
+
+	selected := selectFiles(files, []string{"docs/**"}, []string{"*.mp4"})
+	if !selected[0] || selected[1] || selected[2] {
+		t.Fatalf("expected only the guide to be selected got %v", selected)
+	}
+
+	selected = selectFiles(files, nil, []string{"*.mp4"})
+	if !selected[0] || selected[1] || !selected[2] {
+		t.Fatalf("expected everything but the video to be selected got %v", selected)
+	}
+
+	if err := validatePatterns([]string{"[a-"}); err == nil {
+		t.Fatalf("expected malformed pattern to be rejected")
+	}
+}
+
+func TestWantedPieces(t *testing.T) {
+	pieceLength := int64(PIECELENGTH)
+
+	meta := &Metadata{
+		PieceLength: int32(pieceLength),
+		Pieces:      make([][]byte, 4),
+		Folders: []FileInfo{
+			{Path: "a", Size: pieceLength + 10, CummulativeOffset: 0},
+			{Path: "b", Size: pieceLength, CummulativeOffset: pieceLength + 10},
+			{Path: "c", Size: pieceLength, CummulativeOffset: 2*pieceLength + 10},
+		},
+	}
+
+	//b straddles pieces 1 and 2
+	wanted := wantedPieces(meta, []bool{false, true, false})
+	if wanted.Has(0) || !wanted.Has(1) || !wanted.Has(2) || wanted.Has(3) {
+		t.Fatalf("expected pieces 1 and 2 got %08b", wanted)
+	}
+
+	if wantedPieces(meta, nil).Count(4) != 4 {
+		t.Fatalf("expected every piece without a selection")
+	}
+}
+
+func TestListenSelectedFiles(t *testing.T) {
+	//file0 and file2 are in dir0, file1 and file3 in dir1
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024, 900*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	senderAddress := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    senderAddress,
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+		Include:          []string{"dir0/**"},
+		Exclude:          []string{"file2.*"},
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	got := filepath.Join(downloadPath, filepath.Base(root))
+
+	want, err := os.ReadFile(filepath.Join(root, "dir0", "file0.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(got, "dir0", "file0.bin"))
+	if err != nil || !bytes.Equal(want, buf) {
+		t.Fatalf("expected the selected file to be downloaded (%v)", err)
+	}
+
+	for _, name := range []string{filepath.Join("dir0", "file2.bin"), filepath.Join("dir1", "file1.bin"), filepath.Join("dir1", "file3.bin")} {
+		if _, err := os.Stat(filepath.Join(got, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be written (%v)", name, err)
+		}
+	}
+
+	//The picker narrows the selection further
+	l = new(Peer)
+	err = l.Listen(Options{
+		SenderAddress:    senderAddress,
+		MaxPieceRetries:  4,
+		DownloadFilePath: t.TempDir(),
+		PickFiles: func(files []FileInfo) ([]string, error) {
+			return nil, nil
+		},
+	})
+	if !errors.Is(err, ErrNothingSelected) {
+		t.Fatalf("expected %v got %v", ErrNothingSelected, err)
+	}
+}
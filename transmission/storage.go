@@ -0,0 +1,271 @@
+package transmission
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReadOnly = errors.New("storage is read only")
+
+// The payload of a transfer: every file's bytes one after the other, in the order of the metadata.
+// Offsets are positions within the payload, whatever the files are stored in.
+//
+// VirtualFile is the default, it stores the payload in files laid out like the sender's.
+// A listener given another Storage writes whole pieces into it and leaves the disk alone.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	//Name of the content and the length of the payload
+	Stat() (fs.FileInfo, error)
+}
+
+// Describes a payload
+type payloadInfo struct {
+	name string
+	size int64
+}
+
+func (i payloadInfo) Name() string       { return i.name }
+func (i payloadInfo) Size() int64        { return i.size }
+func (i payloadInfo) Mode() fs.FileMode  { return 0 }
+func (i payloadInfo) ModTime() time.Time { return time.Time{} }
+func (i payloadInfo) IsDir() bool        { return false }
+func (i payloadInfo) Sys() any           { return nil }
+
+func (vf *VirtualFile) Stat() (fs.FileInfo, error) {
+	name := vf.name
+	if name == "" {
+		name = filepath.Base(vf.rootPath)
+	}
+
+	return payloadInfo{name, vf.totalSize}, nil
+}
+
+// Storage that keeps the payload in memory. Close leaves the payload readable.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	name string
+	data []byte
+}
+
+// Memory storage holding data, which it takes ownership of. Writes past the end grow it.
+func NewMemoryStorage(name string, data []byte) *MemoryStorage {
+	return &MemoryStorage{name: name, data: data}
+}
+
+func (m *MemoryStorage) ReadAt(p []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if offset < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", offset)
+	}
+
+	if offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (m *MemoryStorage) WriteAt(p []byte, offset int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if offset < 0 {
+		return 0, fmt.Errorf("write at negative offset %d", offset)
+	}
+
+	if end := offset + int64(len(p)); end > int64(len(m.data)) {
+		if end > int64(cap(m.data)) {
+			grown := make([]byte, end, max(end, 2*int64(cap(m.data))))
+			copy(grown, m.data)
+			m.data = grown
+		}
+		m.data = m.data[:end]
+	}
+
+	return copy(m.data[offset:], p), nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+func (m *MemoryStorage) Stat() (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return payloadInfo{m.name, int64(len(m.data))}, nil
+}
+
+// Copy of the payload written so far
+func (m *MemoryStorage) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]byte(nil), m.data...)
+}
+
+// Generate metadata for the file or directory at path within fsys, e.g. an embed.FS or a zip archive.
+// path is slash separated, "." is the whole of fsys and then needs opts.Name.
+// Links can not be read through an fs.FS, so they are skipped whatever opts.Symlinks says.
+func GenerateMetadataFromFS(fsys fs.FS, path string, opts MetadataOptions) (*Metadata, *VirtualFile, error) {
+	if !fs.ValidPath(path) {
+		return nil, nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
+	}
+
+	if path == "." && opts.Name == "" {
+		return nil, nil, fmt.Errorf("a name is needed to send the root of a file system")
+	}
+
+	vf := newVirtualFile(path, opts)
+	vf.fsys = fsys
+
+	return generateMetadata(vf)
+}
+
+// Find the entries to send within vf.fsys
+func (vf *VirtualFile) scanFS() error {
+	info, err := fs.Stat(vf.fsys, vf.rootPath)
+	if err != nil {
+		return err
+	}
+
+	if vf.name == "" {
+		vf.name = path.Base(vf.rootPath)
+	}
+
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", vf.rootPath)
+		}
+
+		vf.single = true
+		vf.appendEntry(".", vf.rootPath, info, FileKindFile, "")
+		return nil
+	}
+
+	return fs.WalkDir(vf.fsys, vf.rootPath, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == vf.rootPath {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		relative := strings.TrimPrefix(name, vf.rootPath+"/")
+		if vf.rootPath == "." {
+			relative = name
+		}
+
+		switch {
+		case info.IsDir():
+			vf.appendEntry(filepath.FromSlash(relative), name, info, FileKindDir, "")
+		case info.Mode().IsRegular():
+			vf.appendEntry(filepath.FromSlash(relative), name, info, FileKindFile, "")
+		}
+
+		//Links, devices, sockets and pipes are left out
+		return nil
+	})
+}
+
+// What the payload's files are read from and written to
+type fileHandle interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Open the source of the file at index for reading
+func (vf *VirtualFile) openSource(fileIndex int) (fileHandle, error) {
+	if vf.fsys == nil {
+		return os.Open(vf.sources[fileIndex])
+	}
+
+	file, err := vf.fsys.Open(vf.sources[fileIndex])
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsHandle{fsys: vf.fsys, name: vf.sources[fileIndex], file: file}, nil
+}
+
+// A file opened from an fs.FS. Files that can neither read at an offset nor seek, like compressed
+// files in a zip archive, are read in order and reopened to go back.
+type fsHandle struct {
+	fsys fs.FS
+	name string
+	file fs.File
+	//Offset the next read starts at when the file is read in order
+	position int64
+}
+
+func (h *fsHandle) ReadAt(p []byte, offset int64) (int, error) {
+	if r, ok := h.file.(io.ReaderAt); ok {
+		return r.ReadAt(p, offset)
+	}
+
+	if s, ok := h.file.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		h.position = offset
+	}
+
+	if offset < h.position {
+		file, err := h.fsys.Open(h.name)
+		if err != nil {
+			return 0, err
+		}
+
+		h.file.Close()
+		h.file, h.position = file, 0
+	}
+
+	if offset > h.position {
+		skipped, err := io.CopyN(io.Discard, h.file, offset-h.position)
+		h.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(h.file, p)
+	h.position += int64(n)
+
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (h *fsHandle) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("%s: %w", h.name, ErrReadOnly)
+}
+
+func (h *fsHandle) Close() error {
+	return h.file.Close()
+}
@@ -0,0 +1,217 @@
+package transmission
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	m := NewMemoryStorage("payload", nil)
+
+	//Pieces land out of order
+	if _, err := m.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WriteAt([]byte("hello "), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(m.Bytes()); got != "hello world" {
+		t.Fatalf("expected hello world got %q", got)
+	}
+
+	info, err := m.Stat()
+	if err != nil || info.Name() != "payload" || info.Size() != 11 {
+		t.Fatalf("expected payload of 11 bytes got %v (%v)", info, err)
+	}
+
+	buf := make([]byte, 8)
+	n, err := m.ReadAt(buf, 6)
+	if n != 5 || err != io.EOF || string(buf[:n]) != "world" {
+		t.Fatalf("expected a short read of world got %q (%v)", buf[:n], err)
+	}
+
+	if _, err := m.ReadAt(buf, 11); err != io.EOF {
+		t.Fatalf("expected io.EOF past the end got %v", err)
+	}
+
+	if _, err := m.WriteAt([]byte{1}, -1); err == nil {
+		t.Fatal("expected a write at a negative offset to be refused")
+	}
+}
+
+func testFS(t *testing.T) fstest.MapFS {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(24))
+	content := func(size int) []byte {
+		b := make([]byte, size)
+		r.Read(b)
+		return b
+	}
+
+	return fstest.MapFS{
+		"site/index.html":      {Data: content(40 * 1024), Mode: 0644},
+		"site/empty.txt":       {Data: nil, Mode: 0644},
+		"site/assets/app.js":   {Data: content(70 * 1024), Mode: 0644},
+		"site/assets/logo.png": {Data: content(9 * 1024), Mode: 0644},
+		"other.txt":            {Data: []byte("not sent"), Mode: 0644},
+	}
+}
+
+func TestSendFromFSToMemory(t *testing.T) {
+	fsys := testFS(t)
+	p := initializeSender(t, Options{FilePath: "site", Source: fsys, PieceLength: MIN_PIECE_LENGTH})
+	defer p.Shutdown()
+
+	//A listener saving to disk recreates the folder
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	for _, name := range []string{"index.html", "empty.txt", "assets/app.js", "assets/logo.png"} {
+		got, err := os.ReadFile(filepath.Join(downloadPath, "site", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, fsys["site/"+name].Data) {
+			t.Fatalf("%s differs from the source", name)
+		}
+	}
+
+	//A listener writing into memory gets the payload, the files in path order
+	unused := filepath.Join(t.TempDir(), "unused")
+	storage := NewMemoryStorage("site", nil)
+	m := new(Peer)
+	err = m.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: unused,
+		Storage:          storage,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	var want []byte
+	for _, name := range []string{"assets/app.js", "assets/logo.png", "empty.txt", "index.html"} {
+		want = append(want, fsys["site/"+name].Data...)
+	}
+
+	if !bytes.Equal(storage.Bytes(), want) {
+		t.Fatal("the payload in memory differs from the source")
+	}
+
+	if _, err := os.Stat(unused); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be written to disk")
+	}
+}
+
+func TestGenerateMetadataFromZip(t *testing.T) {
+	fsys := testFS(t)
+
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for name, file := range fsys {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(file.Data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, PieceLength: MIN_PIECE_LENGTH}
+
+	want, wantVF, err := GenerateMetadataFromFS(fsys, "site", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wantVF.Close()
+
+	meta, vf, err := GenerateMetadataFromFS(zr, "site", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	if meta.Name != "site" || meta.ContentID() != want.ContentID() || !bytes.Equal(meta.Checksum, want.Checksum) {
+		t.Fatal("expected the archive to describe the same content as the folder")
+	}
+
+	//Compressed files only read in order, going back reopens them
+	for i := meta.NumPieces() - 1; i >= 0; i-- {
+		got, err := MarshallPiece(vf, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := MarshallPiece(wantVF, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got.Payload, expected.Payload) {
+			t.Fatalf("piece %d read from the archive differs", i)
+		}
+	}
+
+	if _, err := vf.WriteAt([]byte{1}, 0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected content from an fs.FS to be read only got %v", err)
+	}
+}
+
+func TestGenerateMetadataFromFSRoot(t *testing.T) {
+	fsys := testFS(t)
+
+	if _, _, err := GenerateMetadataFromFS(fsys, ".", MetadataOptions{}); err == nil {
+		t.Fatal("expected the root of a file system to need a name")
+	}
+
+	meta, vf, err := GenerateMetadataFromFS(fsys, ".", MetadataOptions{Name: "everything"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	info, err := vf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Name != "everything" || info.Name() != "everything" || info.Size() != meta.FileLength {
+		t.Fatalf("expected everything of %d bytes got %s of %d", meta.FileLength, info.Name(), info.Size())
+	}
+
+	//A single file keeps its base name
+	meta, vf, err = GenerateMetadataFromFS(fsys, "site/index.html", MetadataOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vf.Close()
+
+	if !meta.Single || meta.Name != "index.html" || meta.FileLength != int64(len(fsys["site/index.html"].Data)) {
+		t.Fatalf("expected the single file index.html got %+v", meta.Manifest())
+	}
+}
@@ -0,0 +1,539 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Number of pieces a streaming sender keeps in memory, 32 MiB with the default piece length
+const STREAM_BUFFER_PIECES = 64
+
+var ErrStreamFolder = errors.New("a shared folder cannot be written to a stream")
+
+// Pieces read from a streaming sender's input that not every listener has received yet.
+// The input is only read while there is room, so a slow listener slows the producer down instead of
+// the sender holding the whole stream in memory.
+type streamBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	pieceLength int
+	hash        HashAlgorithm
+
+	//Index of the oldest piece still held in memory
+	base   int
+	pieces [][]byte
+	//Hash of every piece read so far
+	hashes [][]byte
+	length int64
+
+	//Set once the input ends, err is set when it could not be read
+	done bool
+	err  error
+
+	closed bool
+
+	//Next piece each listener will ask for
+	subscribers map[*listenerSession]int
+}
+
+func newStreamBuffer(pieceLength int, hash HashAlgorithm) *streamBuffer {
+	b := &streamBuffer{
+		pieceLength: pieceLength,
+		hash:        hash,
+		subscribers: make(map[*listenerSession]int),
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+// Wake everything waiting on the buffer when the sender shuts down
+func (b *streamBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// Lowest piece a subscriber still needs. Must be called with b.mu held.
+func (b *streamBuffer) lowest() int {
+	lowest := b.base
+	first := true
+
+	for _, next := range b.subscribers {
+		if first || next < lowest {
+			lowest = next
+			first = false
+		}
+	}
+
+	return lowest
+}
+
+// Metadata describing a stream. Pieces and length are sent as the input is read.
+func streamMetadata(name string, hash HashAlgorithm, pieceLength int) *Metadata {
+	return &Metadata{
+		Name:          filepath.Base(name),
+		PieceLength:   int32(pieceLength),
+		HashAlgorithm: hash,
+		Single:        true,
+		Stream:        true,
+	}
+}
+
+// Read the input into pieces until it ends. Reading starts once the first listener subscribes,
+// so it sees the stream from the start.
+func (p *Peer) produceStream(r io.Reader) {
+	b := p.stream
+
+	b.mu.Lock()
+	for len(b.subscribers) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	b.mu.Unlock()
+
+	for {
+		buf := make([]byte, b.pieceLength)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if !p.addStreamPiece(buf[:n]) {
+				return
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			p.endStream(nil)
+			return
+		}
+
+		if err != nil {
+			p.endStream(err)
+			return
+		}
+	}
+}
+
+// Hold on to a piece and announce its hash. Blocks while the buffer is full and
+// returns false if the sender shuts down meanwhile.
+func (p *Peer) addStreamPiece(data []byte) bool {
+	b := p.stream
+
+	b.mu.Lock()
+	for len(b.pieces) >= STREAM_BUFFER_PIECES && !b.closed {
+		//Drop the oldest piece once every listener has received it
+		if b.base < b.lowest() {
+			b.pieces = b.pieces[1:]
+			b.base++
+			continue
+		}
+
+		b.cond.Wait()
+	}
+
+	if b.closed {
+		b.mu.Unlock()
+		return false
+	}
+
+	index := b.base + len(b.pieces)
+	hash := b.hash.Sum(data)
+
+	b.pieces = append(b.pieces, data)
+	b.hashes = append(b.hashes, hash)
+	b.length += int64(len(data))
+
+	subscribers := make([]*listenerSession, 0, len(b.subscribers))
+	for s := range b.subscribers {
+		subscribers = append(subscribers, s)
+	}
+
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	p.dlog("read stream piece %d", index)
+
+	msg := streamHashMessage(index, hash)
+	for _, s := range subscribers {
+		if _, err := s.write(msg); err != nil {
+			p.dlog("could not announce stream piece %d to %s: %v", index, s.peerID, err)
+		}
+	}
+
+	return true
+}
+
+func (p *Peer) endStream(err error) {
+	b := p.stream
+
+	b.mu.Lock()
+	b.done = true
+	b.err = err
+
+	subscribers := make([]*listenerSession, 0, len(b.subscribers))
+	for s := range b.subscribers {
+		subscribers = append(subscribers, s)
+	}
+
+	msg := b.endMessage()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	if err != nil {
+		p.dlog("reading the stream failed: %v", err)
+	} else {
+		p.dlog("stream ended after %d pieces", len(b.hashes))
+	}
+
+	for _, s := range subscribers {
+		_, _ = s.write(msg)
+	}
+}
+
+// Message telling listeners the stream is over. Must be called with b.mu held.
+func (b *streamBuffer) endMessage() []byte {
+	if b.err != nil {
+		return MarshallError(ErrorStreamFailed, b.err.Error()).Serialize()
+	}
+
+	return streamEndMessage(len(b.hashes), b.length)
+}
+
+// Send the session the hashes of every piece read so far and subscribe it to those that follow
+func (p *Peer) subscribeStream(s *listenerSession) error {
+	b := p.stream
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	b.mu.Lock()
+	if b.base > 0 {
+		b.mu.Unlock()
+
+		_, _ = s.conn.Write(MarshallError(ErrorPieceUnavailable, "the stream has moved past the start").Serialize())
+		return fmt.Errorf("%s subscribed after the stream moved on", s.peerID)
+	}
+
+	b.subscribers[s] = 0
+
+	var out bytes.Buffer
+	for i, hash := range b.hashes {
+		out.Write(streamHashMessage(i, hash))
+	}
+
+	if b.done {
+		out.Write(b.endMessage())
+	}
+
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	_, err := s.conn.Write(out.Bytes())
+	return err
+}
+
+// Stop holding pieces back for a listener that went away. The sender shuts down once the
+// stream is over and its last listener has left, as nobody else can receive it from the start.
+func (p *Peer) leaveStream(s *listenerSession) {
+	b := p.stream
+
+	b.mu.Lock()
+	_, subscribed := b.subscribers[s]
+	delete(b.subscribers, s)
+	finished := subscribed && b.done && len(b.subscribers) == 0
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	if finished {
+		p.dlog("stream delivered, shutting down")
+		go p.Shutdown()
+	}
+}
+
+// Answer a piece request, waiting for the input to reach the piece if needed
+func (p *Peer) serveStreamPiece(s *listenerSession, index int) error {
+	b := p.stream
+
+	b.mu.Lock()
+	for index >= b.base+len(b.pieces) && !b.done && !b.closed {
+		b.cond.Wait()
+	}
+
+	if index < b.base || index >= b.base+len(b.pieces) {
+		b.mu.Unlock()
+
+		_, err := s.write(MarshallError(ErrorPieceUnavailable, fmt.Sprintf("stream piece %d is not available", index)).Serialize())
+		return err
+	}
+
+	data := b.pieces[index-b.base]
+	if next, ok := b.subscribers[s]; ok && index+1 > next {
+		b.subscribers[s] = index + 1
+		b.cond.Broadcast()
+	}
+	b.mu.Unlock()
+
+	msg, err := marshallPieceBlock(index, int64(index)*int64(b.pieceLength), data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	p.emit(Event{Kind: EventPieceSent, PeerID: s.peerID, Address: s.raw.RemoteAddr().String(), Piece: index, Bytes: int64(len(data))})
+	return nil
+}
+
+// Download a single file or a stream in order and write it to opts.Output,
+// or to a file in the download path when no output is set
+func (p *Peer) receiveToWriter(peer *remotePeer, opts Options) error {
+	if !p.Metadata.Single {
+		return ErrStreamFolder
+	}
+
+	w := opts.Output
+	if w == nil && opts.Storage != nil {
+		defer opts.Storage.Close()
+		w = io.NewOffsetWriter(opts.Storage, 0)
+	}
+
+	if w == nil {
+		if opts.DownloadFilePath == "" {
+			opts.DownloadFilePath = "./"
+		}
+
+		if err := os.MkdirAll(opts.DownloadFilePath, 0755); err != nil {
+			return err
+		}
+
+		f, err := os.Create(filepath.Join(opts.DownloadFilePath, filepath.Base(p.Metadata.Name)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	//Without pipelining the peer only expects one outstanding request per connection
+	window := p.RequestWindow
+	if !peer.handshake.Capabilities.Has(CapPipelining) {
+		window = 1
+	}
+
+	total := p.Metadata.FileLength
+	if p.Metadata.Stream {
+		total = -1
+	}
+
+	p.emit(Event{Kind: EventDownloadStarted, PeerID: p.SenderID, Address: p.SenderAddress, Total: total})
+
+	//A single file from a sender that computed checksums is checked as it is written
+	var checksum *checksummer
+	if !p.Metadata.Stream && len(p.Metadata.Checksum) > 0 {
+		checksum = newChecksummer(nil, p.Metadata.newChecksum)
+		w = io.MultiWriter(w, checksum)
+	}
+
+	received, err := p.receiveInOrder(peer, w, window)
+	if err != nil {
+		return err
+	}
+
+	if _, err := peer.conn.Write(listenerFinishedAck()); err != nil {
+		return err
+	}
+
+	name := filepath.Base(p.Metadata.Name)
+	if checksum != nil && !bytes.Equal(checksum.Sum(), p.Metadata.Checksum) {
+		p.emit(Event{Kind: EventFileCompleted, Path: name, Bytes: received, Checksum: p.Metadata.Checksum, Err: ErrChecksumMismatch})
+		return &IntegrityError{Corrupt: []string{name}}
+	}
+
+	p.emit(Event{Kind: EventFileCompleted, Path: name, Bytes: received, Checksum: p.Metadata.Checksum})
+	p.emit(Event{Kind: EventDownloadFinished, PeerID: p.SenderID, Address: p.SenderAddress, Done: received, Total: received})
+
+	return nil
+}
+
+// Request pieces in order, keeping up to window outstanding, and write each verified piece to w.
+// For a stream the piece hashes arrive while downloading and the piece count is only known at the end.
+// Returns the number of bytes written.
+func (p *Peer) receiveInOrder(peer *remotePeer, w io.Writer, window int) (int64, error) {
+	conn := peer.conn
+	//Pieces whose hash is known and can be requested
+	var hashes [][]byte
+	total := p.Metadata.NumPieces()
+	available := total
+	var length int64 = p.Metadata.FileLength
+	var received int64
+
+	//Bytes expected in all, unknown for a stream
+	expected := length
+	if p.Metadata.Stream {
+		total, available = -1, 0
+		expected = -1
+
+		msg := Message{ID: MessageRequestStream}
+		if _, err := conn.Write(msg.Serialize()); err != nil {
+			return received, err
+		}
+	}
+
+	next, written, outstanding := 0, 0, 0
+
+	for total < 0 || written < total {
+		for outstanding < window && next < available {
+			if _, err := conn.Write(requestPiece(next)); err != nil {
+				return received, err
+			}
+			next++
+			outstanding++
+		}
+
+		//A stream may go quiet for a long time while the sender waits on its input
+		deadline := time.Time{}
+		if outstanding > 0 {
+			deadline = time.Now().Add(30 * time.Second)
+		}
+
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return received, err
+		}
+
+		msg, err := DeserializeMessageFromReader(conn)
+		if err != nil {
+			return received, err
+		}
+
+		switch msg.ID {
+		case MessageStreamHash:
+			index, hash, err := parseStreamHash(msg.Payload, p.Metadata.HashAlgorithm.Size())
+			if err != nil {
+				return received, err
+			}
+
+			if index != len(hashes) {
+				return received, fmt.Errorf("expected hash for stream piece %d, got %d", len(hashes), index)
+			}
+
+			hashes = append(hashes, hash)
+			available++
+
+		case MessageStreamEnd:
+			count, streamLength, err := parseStreamEnd(msg.Payload)
+			if err != nil {
+				return received, err
+			}
+
+			if count != len(hashes) {
+				return received, fmt.Errorf("stream ended after %d pieces, %d were announced", count, len(hashes))
+			}
+
+			total = count
+			length = streamLength
+
+		case MessageError:
+			return received, p.readProtocolError(msg)
+
+		case MessagePiece:
+			piece, err := UnmarshallPiece(msg)
+			if err != nil {
+				return received, err
+			}
+
+			if int(piece.Index) != written {
+				return received, fmt.Errorf("expected piece %d, got piece %d", written, piece.Index)
+			}
+			p.emit(Event{Kind: EventPieceReceived, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: written, Bytes: int64(len(piece.Buf))})
+
+			var verified bool
+			if p.Metadata.Stream {
+				verified = bytes.Equal(p.Metadata.HashAlgorithm.Sum(piece.Buf), hashes[written])
+			} else {
+				verified = p.verifyPiece(piece)
+			}
+
+			if !verified {
+				err := fmt.Errorf("piece at index %d does not match", written)
+				p.emit(Event{Kind: EventPieceFailed, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: written, Err: err})
+				return received, err
+			}
+
+			_, err = w.Write(piece.Buf)
+			size := len(piece.Buf)
+			piece.Release()
+			if err != nil {
+				return received, err
+			}
+
+			written++
+			outstanding--
+			received += int64(size)
+			p.emit(Event{Kind: EventPieceVerified, PeerID: peer.handshake.PeerID, Address: peer.address, Piece: written - 1, Bytes: int64(size), Done: received, Total: expected})
+
+		default:
+			return received, fmt.Errorf("unexpected message %d", msg.ID)
+		}
+	}
+
+	if received != length {
+		return received, fmt.Errorf("received %d bytes, expected %d", received, length)
+	}
+
+	return received, conn.SetReadDeadline(time.Time{})
+}
+
+// <index><hash>
+func streamHashMessage(index int, hash []byte) []byte {
+	msg := Message{ID: MessageStreamHash}
+
+	payload := make([]byte, 4+len(hash))
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	copy(payload[4:], hash)
+
+	msg.Payload = payload
+
+	return msg.Serialize()
+}
+
+func parseStreamHash(payload []byte, size int) (int, []byte, error) {
+	if len(payload) != 4+size {
+		return 0, nil, fmt.Errorf("malformed stream hash message")
+	}
+
+	hash := append([]byte(nil), payload[4:]...)
+
+	return int(binary.BigEndian.Uint32(payload)), hash, nil
+}
+
+// <piece count><length>
+func streamEndMessage(count int, length int64) []byte {
+	msg := Message{ID: MessageStreamEnd}
+
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload, uint32(count))
+	binary.BigEndian.PutUint64(payload[4:], uint64(length))
+
+	msg.Payload = payload
+
+	return msg.Serialize()
+}
+
+func parseStreamEnd(payload []byte) (int, int64, error) {
+	if len(payload) != 12 {
+		return 0, 0, fmt.Errorf("malformed stream end message")
+	}
+
+	return int(binary.BigEndian.Uint32(payload)), int64(binary.BigEndian.Uint64(payload[4:])), nil
+}
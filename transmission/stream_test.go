@@ -0,0 +1,140 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start a sender streaming the data through a pipe, written in uneven chunks
+func initializeStreamSender(t *testing.T, data []byte) *Peer {
+	t.Helper()
+
+	r, w := io.Pipe()
+	go func() {
+		for chunk := data; len(chunk) > 0; {
+			n := min(len(chunk), 10000)
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return
+			}
+			chunk = chunk[n:]
+		}
+		w.Close()
+	}()
+
+	return initializeSender(t, Options{Stream: r, StreamName: "backup.tar"})
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestStreamToWriter(t *testing.T) {
+	//Small pieces so the stream is longer than the sender's buffer
+	defer func(pieceLength int) { PIECELENGTH = pieceLength }(PIECELENGTH)
+	PIECELENGTH = 16 * 1024
+
+	data := randomBytes(t, STREAM_BUFFER_PIECES*PIECELENGTH*3+1234)
+	p := initializeStreamSender(t, data)
+
+	var out bytes.Buffer
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress: net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		Output:        &out,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("expected %d streamed bytes got %d", len(data), out.Len())
+	}
+
+	//The sender stops once its only listener has the whole stream
+	select {
+	case <-p.shutdown:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the sender to shut down after the stream")
+	}
+}
+
+func TestStreamToFile(t *testing.T) {
+	data := randomBytes(t, 1300*1024)
+	p := initializeStreamSender(t, data)
+	defer p.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(downloadPath, "backup.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("streamed file differs from the original")
+	}
+}
+
+func TestSingleFileToWriter(t *testing.T) {
+	root := writeTestTree(t, 1300*1024)
+	path := filepath.Join(root, "dir0", "file0.bin")
+
+	p := initializeSender(t, Options{FilePath: path})
+	defer p.Shutdown()
+
+	var out bytes.Buffer
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress: net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		Output:        &out,
+		RequestWindow: 2,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("expected %d bytes got %d", len(want), out.Len())
+	}
+}
+
+func TestFolderToWriter(t *testing.T) {
+	root := writeTestTree(t, 1024, 2048)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress: net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		Output:        io.Discard,
+	})
+	if err != ErrStreamFolder {
+		t.Fatalf("expected %v got %v", ErrStreamFolder, err)
+	}
+}
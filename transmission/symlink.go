@@ -0,0 +1,208 @@
+package transmission
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a sender does with the symbolic links it finds in a shared folder
+type SymlinkPolicy uint8
+
+const (
+	//Leave links out of the transfer
+	SymlinkSkip SymlinkPolicy = iota
+	//Send what a link points to as if it were in the folder
+	SymlinkFollow
+	//Send the link itself, the listener recreates it
+	SymlinkPreserve
+)
+
+var (
+	ErrUnknownSymlinkPolicy = errors.New("unknown symlink policy")
+	ErrSymlinkLoop          = errors.New("symlink leads back into a folder it is in")
+	ErrUnsafeSymlink        = errors.New("symlink points outside the download directory")
+)
+
+var symlinkPolicyNames = []struct {
+	policy SymlinkPolicy
+	name   string
+}{
+	{SymlinkSkip, "skip"},
+	{SymlinkFollow, "follow"},
+	{SymlinkPreserve, "preserve"},
+}
+
+func (s SymlinkPolicy) String() string {
+	for _, p := range symlinkPolicyNames {
+		if p.policy == s {
+			return p.name
+		}
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// Parse a policy name such as follow. An empty name skips links.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	if name == "" {
+		return SymlinkSkip, nil
+	}
+
+	for _, p := range symlinkPolicyNames {
+		if p.name == strings.ToLower(name) {
+			return p.policy, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownSymlinkPolicy, name)
+}
+
+// Add every entry below the directory at path. ancestors holds the directories from the root down to path,
+// so following a link back into one of them is caught instead of recursing forever.
+func (vf *VirtualFile) walk(path string, ancestors []fs.FileInfo) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+
+		info, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			switch vf.symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkPreserve:
+				target, err := os.Readlink(child)
+				if err != nil {
+					return err
+				}
+
+				if err := vf.addEntry(child, info, FileKindSymlink, target); err != nil {
+					return err
+				}
+				continue
+			case SymlinkFollow:
+				info, err = os.Stat(child)
+				if err != nil {
+					return fmt.Errorf("following %s: %w", child, err)
+				}
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			for _, ancestor := range ancestors {
+				if os.SameFile(ancestor, info) {
+					return fmt.Errorf("%w: %s", ErrSymlinkLoop, child)
+				}
+			}
+
+			if err := vf.addEntry(child, info, FileKindDir, ""); err != nil {
+				return err
+			}
+
+			if err := vf.walk(child, append(ancestors, info)); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := vf.addEntry(child, info, FileKindFile, ""); err != nil {
+				return err
+			}
+		}
+
+		//Devices, sockets and pipes have no content that could be sent
+	}
+
+	return nil
+}
+
+// Create the links received in the metadata. A link is refused when its target is absolute or
+// resolves outside the download directory, once every other link it could pass through exists.
+// Must be called with vf.mu held.
+func (vf *VirtualFile) restoreSymlinks() error {
+	root := vf.downloadPath
+	if !vf.single {
+		root = filepath.Join(vf.downloadPath, filepath.Base(vf.rootPath))
+	}
+
+	var links []int
+	for i, f := range vf.files {
+		if f.Kind != FileKindSymlink || !vf.isSelected(i) {
+			continue
+		}
+
+		if !localSymlink(f.Path, f.LinkTarget) {
+			return fmt.Errorf("%w: %s -> %s", ErrUnsafeSymlink, f.Path, f.LinkTarget)
+		}
+
+		path := vf.filePath(i)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		//A link left behind by an earlier download of the same content
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Symlink(f.LinkTarget, path); err != nil {
+			return err
+		}
+
+		links = append(links, i)
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	//A link can only escape through other links, so they are checked once all of them exist
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	var unsafe error
+	for _, i := range links {
+		relative, err := filepath.Rel(root, vf.filePath(i))
+		if err != nil {
+			return err
+		}
+
+		//Opening resolves every link on the way, the last one included, without leaving the root
+		file, err := dir.Open(relative)
+		if err == nil {
+			file.Close()
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			os.Remove(vf.filePath(i))
+			if unsafe == nil {
+				unsafe = fmt.Errorf("%w: %s -> %s", ErrUnsafeSymlink, vf.files[i].Path, vf.files[i].LinkTarget)
+			}
+		}
+	}
+
+	return unsafe
+}
+
+// Reports whether a link at path, relative to the download, points somewhere inside the download
+// when read without following any other link
+func localSymlink(path, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+
+	return filepath.IsLocal(filepath.Join(filepath.Dir(path), target))
+}
@@ -0,0 +1,136 @@
+package transmission
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateMetadataSymlinks(t *testing.T) {
+	root := writeTestTree(t, 1024)
+	if err := os.Symlink(filepath.Join("dir0", "file0.bin"), filepath.Join(root, "link.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("dir0", filepath.Join(root, "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy SymlinkPolicy
+		want   map[string]FileKind
+		length int64
+	}{
+		{SymlinkSkip, map[string]FileKind{"dir0": FileKindDir, "dir0/file0.bin": FileKindFile}, 1024},
+		{SymlinkPreserve, map[string]FileKind{
+			"dir0": FileKindDir, "dir0/file0.bin": FileKindFile, "alias": FileKindSymlink, "link.bin": FileKindSymlink,
+		}, 1024},
+		{SymlinkFollow, map[string]FileKind{
+			"dir0": FileKindDir, "dir0/file0.bin": FileKindFile, "alias": FileKindDir, "alias/file0.bin": FileKindFile, "link.bin": FileKindFile,
+		}, 3 * 1024},
+	}
+
+	for _, test := range tests {
+		meta, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, Symlinks: test.policy})
+		if err != nil {
+			t.Fatalf("%s: %v", test.policy, err)
+		}
+		vf.Close()
+
+		kinds := make(map[string]FileKind)
+		for _, f := range meta.Folders {
+			kinds[filepath.ToSlash(f.Path)] = f.Kind
+
+			if f.Kind == FileKindSymlink && f.Path == "alias" && f.LinkTarget != "dir0" {
+				t.Fatalf("%s: expected alias to point to dir0 got %q", test.policy, f.LinkTarget)
+			}
+		}
+
+		if len(kinds) != len(test.want) || meta.FileLength != test.length {
+			t.Fatalf("%s: expected %v and %d bytes got %v and %d", test.policy, test.want, test.length, kinds, meta.FileLength)
+		}
+
+		for path, kind := range test.want {
+			if kinds[path] != kind {
+				t.Fatalf("%s: expected %s to be kind %d got %v", test.policy, path, kind, kinds)
+			}
+		}
+	}
+}
+
+func TestGenerateMetadataSymlinkLoop(t *testing.T) {
+	root := writeTestTree(t, 1024)
+	if err := os.Symlink("..", filepath.Join(root, "dir0", "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, Symlinks: SymlinkFollow})
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected a symlink loop got %v", err)
+	}
+
+	//The same tree can still be sent when the link is kept as a link
+	_, vf, err := GenerateMetadataWithOptions(root, MetadataOptions{Hash: DEFAULT_HASH_ALGORITHM, Symlinks: SymlinkPreserve})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vf.Close()
+}
+
+func TestListenPreservesSymlinks(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+	if err := os.Symlink(filepath.Join("..", "dir1", "file1.bin"), filepath.Join(root, "dir0", "link.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := initializeSender(t, Options{FilePath: root, Symlinks: "preserve"})
+	defer p.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	got := filepath.Join(downloadPath, filepath.Base(root))
+	compareTrees(t, root, got)
+
+	target, err := os.Readlink(filepath.Join(got, "dir0", "link.bin"))
+	if err != nil || target != filepath.Join("..", "dir1", "file1.bin") {
+		t.Fatalf("expected the link to be recreated got %q (%v)", target, err)
+	}
+}
+
+func TestRestoreSymlinksRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []FileInfo
+	}{
+		{"parent", []FileInfo{{Path: "up", Kind: FileKindSymlink, LinkTarget: filepath.Join("..", "outside")}}},
+		{"absolute", []FileInfo{{Path: "etc", Kind: FileKindSymlink, LinkTarget: "/etc"}}},
+		{"through another link", []FileInfo{
+			{Path: filepath.Join("d1", "d2", "l"), Kind: FileKindSymlink, LinkTarget: filepath.Join("..", "..")},
+			{Path: filepath.Join("d1", "d2", "m"), Kind: FileKindSymlink, LinkTarget: "l/../../.."},
+		}},
+	}
+
+	for _, test := range tests {
+		downloadPath := t.TempDir()
+		vf := &VirtualFile{rootPath: "tree", files: test.files, downloadPath: downloadPath}
+
+		if err := vf.restoreSymlinks(); !errors.Is(err, ErrUnsafeSymlink) {
+			t.Fatalf("%s: expected an unsafe symlink got %v", test.name, err)
+		}
+
+		last := test.files[len(test.files)-1]
+		if _, err := os.Lstat(filepath.Join(downloadPath, "tree", last.Path)); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected %s not to be created got %v", test.name, last.Path, err)
+		}
+	}
+}
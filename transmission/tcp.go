@@ -2,25 +2,35 @@ package transmission
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/schollz/peerdiscovery"
-	"github.com/schollz/progressbar/v3"
 )
 
 var Debug = 1
 
 const DefaultAutomaticShutdownDelay = 60 * time.Second
 
+const DEFAULT_REQUEST_WINDOW = 8
+
+var ErrUnexpectedMessage = errors.New("unexpected message")
+
+var ErrZipSource = errors.New("only folders on the local file system can be zipped")
+
 type PeerState int8
 
 func (p PeerState) String() string {
@@ -45,9 +55,42 @@ const (
 	dead
 )
 
-type pieceWorker struct {
-	index int
-	piece [20]byte
+// Connection from a listener as seen by the sender
+type listenerSession struct {
+	//Replaced by an encrypted connection once the key exchange completes
+	conn net.Conn
+	//Connection as accepted, used to track the listener's slot
+	raw net.Conn
+
+	//Closed when a queued listener is given a slot
+	admitted chan struct{}
+
+	//Set once the session holds a listener slot
+	joined bool
+
+	//What was agreed during the handshake
+	peerID       string
+	version      uint16
+	capabilities Capability
+	//Only looking at the metadata, holds no listener slot
+	inspect bool
+	//Set once the session counts against MAX_INSPECT_SESSIONS
+	inspectCounted bool
+
+	//Serializes writes once have messages may be sent from other goroutines
+	wmu sync.Mutex
+}
+
+func (s *listenerSession) encrypted() bool {
+	_, ok := s.conn.(*secureConn)
+	return ok
+}
+
+func (s *listenerSession) write(b []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	return s.conn.Write(b)
 }
 
 type Peer struct {
@@ -59,13 +102,20 @@ type Peer struct {
 	mu sync.RWMutex
 
 	OpenFile *VirtualFile
-	ZipMode  bool
+	//Where a listener writes the payload when it is not OpenFile
+	storage Storage
+	ZipMode bool
 	//Folder were the zip file will be stored
 	ZipFolder         string
 	ZipDeleteComplete bool
 
 	Metadata *Metadata
 
+	//Peer ID of the sender and what it agreed to during the handshake
+	SenderID           string
+	SenderVersion      uint16
+	SenderCapabilities Capability
+
 	SenderAddress         string
 	ConnectedSenderPort   string
 	ConnectedSenderPortV6 string
@@ -79,10 +129,38 @@ type Peer struct {
 	ListenerLimit int
 	Sender        net.Conn
 
+	//Number of piece requests kept outstanding on each connection to the sender
+	RequestWindow int
+
+	//Verified pieces a relaying listener can serve. nil on a sender, which holds every piece.
+	have Bitfield
+	//Set while connecting only to read the metadata
+	inspecting bool
+
+	//Pieces read so far when sending a stream
+	stream *streamBuffer
+
+	//Piece hash tree in Merkle mode. Complete on a sender, filled in as pieces are verified on a listener.
+	tree *merkleTree
+
+	//Listeners told about every piece the relay gains
+	subscribers map[*listenerSession]bool
+
+	//Listeners waiting for a free slot, in arrival order
+	waiting    []*listenerSession
+	QueueLimit int
+	//Sessions only inspecting the metadata
+	inspectors int
+	//Number of connections each admitted listener has open, keyed by peer ID
+	peers map[string]int
+
 	MulticastAddress string
 
 	DownloadFilePath string
 
+	//Shared code phrase the session key is derived from
+	code string
+
 	//Time is seconds that determines how long the server will idle(no listener present) before it closes.
 	//Default == 1 minutes
 	AutomaticShutdownDelay time.Duration
@@ -93,7 +171,14 @@ type Peer struct {
 
 	shutdown chan struct{}
 
-	bar *progressbar.ProgressBar
+	//Told about everything that happens during the transfer
+	observer Observer
+	emu      sync.Mutex
+
+	//Called with the address the peer accepts connections on
+	ready func(addr net.Addr)
+	//Connections a listener opened to its peers, closed when its context is cancelled
+	dialed connSet
 
 	//used internally
 	selfConn net.Listener
@@ -110,27 +195,107 @@ type Options struct {
 	AutomaticShutdownDelay time.Duration
 	ZipFolder              string
 	ZipDeleteComplete      bool
+	//Code phrase used to encrypt the transfer. When empty the transfer is not encrypted.
+	Code string
+	//Number of listeners that may wait for a free slot once ListenerLimit is reached
+	QueueLimit int
+	//Number of piece requests kept outstanding on each connection to the sender
+	RequestWindow int
+	//Number of connections a listener opens to the sender
+	Connections int
+	//Patterns choosing which files of a shared folder to download, e.g. docs/** or *.mp4.
+	//With no include patterns every file is included.
+	Include []string
+	Exclude []string
+	//Called with the files left after Include and Exclude. Returns the paths to download.
+	PickFiles func(files []FileInfo) ([]string, error)
+	//Send whatever is read from Stream instead of FilePath. Listeners see it as a single file called StreamName.
+	Stream     io.Reader
+	StreamName string
+	//Piece hash algorithm used by a sender: sha256, blake3 or sha1. Empty means sha256.
+	Hash string
+	//Length of the pieces a sender splits the content into. Zero is PIECELENGTH, AUTO_PIECE_LENGTH picks one from the total size.
+	PieceLength int
+	//Send only the root of the piece hash tree in the metadata and a proof with every piece,
+	//so listeners of very large transfers can start right away. The content may have at most MAX_MERKLE_PIECES pieces.
+	Merkle bool
+	//What a sender does with symbolic links inside a shared folder: skip, follow or preserve. Empty means skip.
+	Symlinks string
+	//Write a single file or stream to Output in order instead of saving it to DownloadFilePath
+	Output io.Writer
+	//Serve verified pieces to other listeners while downloading and after finishing
+	Relay bool
+	//Addresses of further senders or relays to download pieces from
+	Peers []string
+	//Called once a sender, or a relaying listener, accepts connections, with the address it listens on
+	Ready func(addr net.Addr)
+	//Receives progress and lifecycle events
+	Observer Observer
+	//Send FilePath read from Source instead of the local file system, e.g. an embed.FS or a zip archive.
+	//FilePath is then slash separated, "." sends all of Source under the name SourceName.
+	Source     fs.FS
+	SourceName string
+	//Reserve disk space for every selected file before downloading instead of growing sparse files
+	Preallocate bool
+	//Write the downloaded payload into Storage instead of files under DownloadFilePath. Pieces are written whole
+	//at their offset in the payload and Storage is closed once the download ends. Nothing is resumed and
+	//directories, empty files and links are not created.
+	Storage Storage
 }
 
 func (p *Peer) broadcast() {
 
 	p.dlog("starting sender server")
 
-	go p.broadcastOnLocalNetwork(false)
-	go p.broadcastOnLocalNetwork(true)
+	payload := p.announcement().encode()
+	go p.broadcastOnLocalNetwork(payload, false)
+	go p.broadcastOnLocalNetwork(payload, true)
 
 }
 
 func (p *Peer) Send(opts Options) error {
+	return p.SendContext(context.Background(), opts)
+}
+
+// Serve the content until the peer shuts down or ctx is cancelled.
+// Cancelling closes every listener connection and the shared files, then returns ctx.Err().
+func (p *Peer) SendContext(ctx context.Context, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	err := p.initSender(opts)
 	if err != nil {
 		return err
 	}
+
+	//Shut down from here rather than context.AfterFunc, so returning waits for the files to be closed
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+
+		select {
+		case <-ctx.Done():
+			p.Shutdown()
+		case <-p.shutdown:
+		}
+	}()
+	defer func() { <-watcher }()
+
 	p.broadcast()
 
-	time.Sleep(500 * time.Millisecond)
-	p.run(LOCAL_DEFAULT_ADDRESS)
-	return nil
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-p.shutdown:
+		return ctx.Err()
+	}
+
+	if err := p.run(LOCAL_DEFAULT_ADDRESS); err != nil {
+		p.Shutdown()
+		return err
+	}
+
+	return ctx.Err()
 }
 
 func (p *Peer) initSender(opts Options) error {
@@ -152,23 +317,89 @@ func (p *Peer) initSender(opts Options) error {
 	}
 
 	p.AutomaticShutdownDelay = opts.AutomaticShutdownDelay
+	p.ready = opts.Ready
+	p.observer = opts.Observer
 
-	if opts.ZipFolder != "" {
-		opts.FilePath, err = ZipFolder(opts.ZipFolder, opts.FilePath)
-		if err != nil {
-			return err
-		}
+	algorithm, err := ParseHashAlgorithm(opts.Hash)
+	if err != nil {
+		return err
 	}
 
-	//Generate metadata from file
-	meta, vf, err := GenerateMetadata(opts.FilePath)
+	symlinks, err := ParseSymlinkPolicy(opts.Symlinks)
 	if err != nil {
 		return err
 	}
 
-	p.Metadata = meta
+	if opts.PieceLength == 0 {
+		opts.PieceLength = PIECELENGTH
+	}
+
+	if err := checkPieceLength(opts.PieceLength); err != nil && opts.PieceLength != AUTO_PIECE_LENGTH {
+		return err
+	}
+
+	if opts.Stream != nil {
+		if opts.StreamName == "" {
+			opts.StreamName = "stdin"
+		}
+
+		//The length of a stream is unknown, so the automatic piece length is the default
+		pieceLength := opts.PieceLength
+		if pieceLength == AUTO_PIECE_LENGTH {
+			pieceLength = PIECELENGTH
+		}
+
+		p.Metadata = streamMetadata(opts.StreamName, algorithm, pieceLength)
+		p.stream = newStreamBuffer(pieceLength, algorithm)
+		go p.produceStream(opts.Stream)
+	} else {
+		if opts.ZipFolder != "" {
+			if opts.Source != nil {
+				return ErrZipSource
+			}
+
+			opts.FilePath, err = ZipFolder(opts.ZipFolder, opts.FilePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		metadataOptions := MetadataOptions{
+			Hash:        algorithm,
+			Merkle:      opts.Merkle,
+			PieceLength: opts.PieceLength,
+			Symlinks:    symlinks,
+		}
+
+		//Generate metadata from file
+		var meta *Metadata
+		var vf *VirtualFile
+		if opts.Source != nil {
+			metadataOptions.Name = opts.SourceName
+			meta, vf, err = GenerateMetadataFromFS(opts.Source, opts.FilePath, metadataOptions)
+		} else {
+			meta, vf, err = GenerateMetadataWithOptions(opts.FilePath, metadataOptions)
+		}
+		if err != nil {
+			return err
+		}
+
+		//Fail now rather than when the first listener asks for the metadata
+		if _, err := MarshallMetadata(meta); err != nil {
+			vf.Close()
+			return err
+		}
+
+		p.Metadata = meta
+		p.OpenFile = vf
+
+		if meta.Merkle {
+			p.tree = buildMerkleTree(algorithm, vf.pieces)
+		}
+	}
+
 	p.MulticastAddress = opts.MulticastAddress
-	p.OpenFile = vf
+	p.code = normalizeCode(opts.Code)
 
 	p.ZipDeleteComplete = opts.ZipDeleteComplete
 
@@ -180,121 +411,161 @@ func (p *Peer) initSender(opts Options) error {
 
 	p.ListenerLimit = opts.ListenerLimit
 
+	if opts.QueueLimit == 0 {
+		opts.QueueLimit = DEFAULT_QUEUE_LIMIT
+	}
+
+	p.QueueLimit = opts.QueueLimit
+
 	p.shutdown = make(chan struct{})
 
 	return nil
 }
 
-func (p *Peer) Listen(opts Options) (err error) {
+func (p *Peer) Listen(opts Options) error {
+	return p.ListenContext(context.Background(), opts)
+}
+
+// Download what the sender offers until it is complete or ctx is cancelled.
+// Cancelling closes the connections to every peer, saves the progress so the download can be resumed,
+// closes the files and returns ctx.Err(). A relaying listener stops relaying as well.
+func (p *Peer) ListenContext(ctx context.Context, opts Options) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
 	p.State = receiver
+	p.mu.Unlock()
 
-	if opts.SenderAddress == "" {
-		p.dlog("attempting to discover peers")
-
-		var discoveries []peerdiscovery.Discovered
-		var wg sync.WaitGroup
-		var dmu sync.Mutex
-
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-
-			//Ipv4 discoveries
-			ipv4Discoveries, err1 := peerdiscovery.Discover(peerdiscovery.Settings{
-				Limit:            1,
-				Payload:          []byte("ok"),
-				TimeLimit:        2 * time.Second,
-				Delay:            20 * time.Millisecond,
-				MulticastAddress: p.MulticastAddress,
-			})
-
-			if err == nil && len(ipv4Discoveries) > 0 {
-				dmu.Lock()
-				err = err1
-				discoveries = append(discoveries, ipv4Discoveries...)
-				dmu.Unlock()
-			}
+	p.observer = opts.Observer
 
-		}()
-		go func() {
-			defer wg.Done()
-
-			//Ipv4 discoveries
-			ipv4Discoveries, err1 := peerdiscovery.Discover(peerdiscovery.Settings{
-				Limit:            1,
-				Payload:          []byte("ok"),
-				TimeLimit:        2 * time.Second,
-				Delay:            20 * time.Millisecond,
-				MulticastAddress: p.MulticastAddress,
-				IPVersion:        peerdiscovery.IPv6,
-			})
-
-			if err == nil && len(ipv4Discoveries) > 0 {
-				dmu.Lock()
-				err = err1
-				discoveries = append(discoveries, ipv4Discoveries...)
-				dmu.Unlock()
-			}
+	stopWatching := context.AfterFunc(ctx, func() {
+		p.dialed.close()
+
+		p.mu.RLock()
+		relaying := p.State == relay
+		p.mu.RUnlock()
+
+		if relaying {
+			p.Shutdown()
+		}
+	})
+	defer stopWatching()
 
-		}()
-		wg.Wait()
+	//Report the cancellation rather than whatever it interrupted, such as a closed connection
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
 
+	p.code = normalizeCode(opts.Code)
+	p.MulticastAddress = opts.MulticastAddress
+
+	//Peers other than the one metadata is requested from
+	var candidates []discoveredPeer
+	if opts.SenderAddress == "" {
+		found, err := p.discoverPeers(ctx)
 		if err != nil {
 			return err
 		}
 
-		wasDiscovered := false
+		p.SenderAddress = found[0].address
+		candidates = found[1:]
+	} else {
+		p.SenderAddress = opts.SenderAddress
+	}
 
-		if err == nil && len(discoveries) > 0 {
-			p.dlog("all discovered peers %+v\n", discoveries)
+	for _, address := range opts.Peers {
+		candidates = append(candidates, discoveredPeer{address: address})
+	}
 
-			for i, discovered := range discoveries {
-				if !bytes.HasPrefix(discovered.Payload, []byte("hello")) {
-					p.dlog("skipping discovery %d", i)
-					continue
-				}
+	id, err := generatePeerID(receiver)
+	if err != nil {
+		return err
+	}
+	p.id = id
+	p.MaxPieceRetries = opts.MaxPieceRetries
 
-				port := string(bytes.TrimPrefix(discovered.Payload, []byte("hello")))
+	p.RequestWindow = opts.RequestWindow
+	if p.RequestWindow <= 0 {
+		p.RequestWindow = DEFAULT_REQUEST_WINDOW
+	}
 
-				if port == "" {
-					continue
-				}
+	primary, err := p.openPeerConn(ctx, p.SenderAddress)
+	if err != nil {
+		return err
+	}
 
-				address := net.JoinHostPort(discovered.Address, port)
-				err := PingServer(address)
-				if err == nil {
-					p.SenderAddress = address
-					wasDiscovered = true
-					break
-				}
-			}
+	peers := []*remotePeer{primary}
+	defer func() {
+		for _, peer := range peers {
+			peer.conn.Close()
 		}
+	}()
 
-		if !wasDiscovered {
-			return fmt.Errorf("no peers found")
-		}
-	} else {
-		p.SenderAddress = opts.SenderAddress
+	p.Sender = primary.conn
+	p.SenderID = primary.handshake.PeerID
+	p.SenderVersion = primary.handshake.Version
+	p.SenderCapabilities = primary.handshake.Capabilities
+	p.dlog("sender %s agreed to version %d with [%s]", p.SenderID, p.SenderVersion, p.SenderCapabilities)
+
+	if err := p.listenerRequestMetadata(primary.conn); err != nil {
+		p.dlog("an error occurred requesting metadata: %v\n", err)
+		return err
 	}
 
-	p.id, _ = generatePeerID(receiver)
-	p.MaxPieceRetries = opts.MaxPieceRetries
+	p.emit(Event{Kind: EventMetadataReceived, PeerID: p.SenderID, Address: p.SenderAddress, Total: p.Metadata.FileLength, Metadata: p.Metadata})
 
-	conn, err := p.connectToSender()
+	//Streams can only be received in order from the sender
+	if p.Metadata.Stream || opts.Output != nil {
+		return p.receiveToWriter(primary, opts)
+	}
+
+	//Only download the files the user asked for
+	selected, err := p.chooseFiles(opts)
 	if err != nil {
 		return err
 	}
 
-	if err := p.listenerSenderHandshake(conn); err != nil {
-		p.dlog("an error occurred sending sender handshake: %v\n", err)
-		conn.Close()
+	if err := p.requestBitfield(primary); err != nil {
 		return err
 	}
 
-	if err := p.listenerRequestMetadata(conn); err != nil {
-		p.dlog("an error occurred requesting metadata: %v\n", err)
-		conn.Close()
-		return err
+	//Extra connections share the same peer ID, so the sender counts them as a single listener
+	for i := 1; i < opts.Connections; i++ {
+		extra, err := p.openPeerConn(ctx, p.SenderAddress)
+		if err != nil {
+			p.dlog("could not open extra connection %d: %v", i, err)
+			break
+		}
+
+		extra.have = primary.have
+		peers = append(peers, extra)
+	}
+
+	//Fetch pieces from every other peer offering the same content
+	contentID := p.Metadata.ContentID()
+	for _, candidate := range candidates {
+		if candidate.Content != "" && candidate.Content != contentID {
+			p.dlog("skipping %s, offering different content", candidate.address)
+			continue
+		}
+
+		peer, err := p.openPeerConn(ctx, candidate.address)
+		if err != nil {
+			p.dlog("could not connect to %s: %v", candidate.address, err)
+			continue
+		}
+
+		if err := p.requestBitfield(peer); err != nil {
+			p.dlog("skipping %s: %v", candidate.address, err)
+			peer.conn.Close()
+			continue
+		}
+
+		peers = append(peers, peer)
 	}
 
 	//Create file from metadata information
@@ -303,149 +574,276 @@ func (p *Peer) Listen(opts Options) (err error) {
 	}
 
 	// Ensure the download directory exists
-	if err := os.MkdirAll(opts.DownloadFilePath, 0755); err != nil {
-		return err
+	if opts.Storage == nil {
+		if err := os.MkdirAll(opts.DownloadFilePath, 0755); err != nil {
+			return err
+		}
 	}
 
 	p.DownloadFilePath = opts.DownloadFilePath
 
 	//Build Recevier virtual file from metadata
 	p.initializeListenVirtualFile()
+	p.OpenFile.selected = selected
+	defer p.OpenFile.Close()
+
+	if opts.Preallocate && opts.Storage == nil {
+		if err := p.OpenFile.Preallocate(); err != nil {
+			return err
+		}
+	}
+
+	//Pick up where an interrupted download left off
+	var statePath string
+	have := NewBitfield(p.Metadata.NumPieces())
+	if opts.Storage != nil {
+		p.storage = opts.Storage
+		defer opts.Storage.Close()
+	} else {
+		statePath = resumeStatePath(p.DownloadFilePath, p.Metadata)
+		have, err = loadResumeState(statePath, p.Metadata, p.tree)
+		if err != nil {
+			return err
+		}
+
+		if err := verifyExistingPieces(p.OpenFile, p.Metadata, p.tree, have); err != nil {
+			return err
+		}
+	}
 
-	workers := make(chan pieceWorker, len(p.Metadata.Pieces))
+	p.mu.Lock()
+	p.have = have
+	p.mu.Unlock()
+
+	//Files are checked against their checksum as their last piece lands
+	checker := newFileChecker(p.OpenFile, p.payload(), p.Metadata)
+	checker.onFile = func(f FileInfo, err error) {
+		p.emit(Event{Kind: EventFileCompleted, Path: p.Metadata.displayPath(f), Bytes: f.Size, Checksum: f.Checksum, Err: err})
+	}
+
+	if opts.Relay {
+		if err := p.startRelay(opts); err != nil {
+			return err
+		}
+		defer p.Shutdown()
+	}
+
+	//Pieces already present or outside the selected files are never requested
+	wanted := wantedPieces(p.Metadata, selected)
+	skip := NewBitfield(p.Metadata.NumPieces())
+
+	remaining := 0
+	var total, resumed int64
+	for idx := range p.Metadata.NumPieces() {
+		if !wanted.Has(idx) {
+			skip.Set(idx)
+			continue
+		}
+
+		begin, end := p.Metadata.pieceBounds(idx)
+		total += end - begin
+
+		if have.Has(idx) {
+			skip.Set(idx)
+			resumed += end - begin
+			continue
+		}
+
+		remaining++
+	}
+
+	if resumed > 0 {
+		numWanted := wanted.Count(p.Metadata.NumPieces())
+		p.dlog("resuming download, %d of %d pieces already present", numWanted-remaining, numWanted)
+	}
+
+	sched := newPieceScheduler(p.Metadata.NumPieces(), skip)
 	result := make(chan PieceBlock)
-	errChan := make(chan error, 1)
+	errChan := make(chan peerError, len(peers))
+	done := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(done) })
+	defer stop()
+
+	active := make(map[*remotePeer]bool)
+	for _, peer := range peers {
+		//Without pipelining the peer only expects one outstanding request per connection
+		window := p.RequestWindow
+		if !peer.handshake.Capabilities.Has(CapPipelining) {
+			window = 1
+		}
 
-	for idx, piece := range p.Metadata.Pieces {
-		workers <- pieceWorker{index: idx, piece: piece}
+		active[peer] = true
+		go func(peer *remotePeer, window int) {
+			errChan <- peerError{peer, p.download(peer, window, sched, result, done)}
+		}(peer, window)
 	}
 
-	go func() {
-		p.download(workers, conn, result, errChan)
+	saved := resumed
+	p.emit(Event{Kind: EventDownloadStarted, PeerID: p.SenderID, Address: p.SenderAddress, Done: saved, Total: total})
+
+	//Persist progress periodically so an interrupted download can be resumed
+	lastSave := time.Now()
+	defer func() {
+		if remaining > 0 && statePath != "" {
+			p.mu.RLock()
+			err := saveResumeState(statePath, p.Metadata, have, p.tree)
+			p.mu.RUnlock()
+
+			if err != nil {
+				p.dlog("an error occurred saving download state: %v\n", err)
+			}
+		}
 	}()
 
-	p.bar = progressbar.NewOptions64(p.Metadata.FileLength,
-		progressbar.OptionSetDescription("Downloading file..."),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(40),
-		progressbar.OptionThrottle(5*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stderr, "\nDownload completed!\n")
-		}),
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionFullWidth(),
-		progressbar.OptionSetRenderBlankState(true),
-		progressbar.OptionSetPredictTime(true),
-	)
-	done := 0
-
-	for done < int(p.Metadata.FileLength) {
+	for remaining > 0 {
 		select {
 		case res := <-result:
-			n, err := p.OpenFile.WriteAt(int64(res.Offset), res.Buf)
+			n, err := p.payload().WriteAt(res.Buf, int64(res.Offset))
+			res.Release()
 			if err != nil {
-				return nil
+				return err
 			}
 
-			done += n
-			p.bar.Add(n)
-		case err := <-errChan:
+			//Only mark the piece once it is on disk, a relay serves whatever is marked
+			p.mu.Lock()
+			have.Set(int(res.Index))
+			p.mu.Unlock()
+
+			if opts.Relay {
+				go p.announceHave(int(res.Index))
+			}
+
+			if err := checker.pieceDone(int(res.Index), have); err != nil {
+				return err
+			}
+
+			remaining--
+			saved += int64(n)
+			p.emit(Event{Kind: EventPieceVerified, Piece: int(res.Index), Bytes: int64(n), Done: saved, Total: total})
+
+			if statePath != "" && time.Since(lastSave) > time.Second {
+				p.mu.RLock()
+				err := saveResumeState(statePath, p.Metadata, have, p.tree)
+				p.mu.RUnlock()
+
+				if err != nil {
+					return err
+				}
+				lastSave = time.Now()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case res := <-errChan:
+			//Pieces in flight on a failed connection were handed back, the others carry on
+			delete(active, res.peer)
+			p.dlog("download connection to %s closed: %v", res.peer.address, res.err)
+
+			if len(active) == 0 {
+				return res.err
+			}
+
+			if index, ok := sched.unservable(slices.Collect(maps.Keys(active))); ok {
+				if res.err == nil {
+					res.err = fmt.Errorf("no connected peer holds piece %d", index)
+				}
+				return res.err
+			}
+		}
+
+	}
+
+	//Report every corrupt file, including those resumed from an earlier run.
+	//The download stays resumable and the sender is not told it finished.
+	if err := checker.finish(have); err != nil {
+		if statePath != "" {
+			p.mu.RLock()
+			saveErr := saveResumeState(statePath, p.Metadata, have, p.tree)
+			p.mu.RUnlock()
+
+			if saveErr != nil {
+				p.dlog("an error occurred saving download state: %v\n", saveErr)
+			}
+		}
+		return err
+	}
+
+	if opts.Storage == nil {
+		if err := p.OpenFile.restoreAttributes(); err != nil {
 			return err
 		}
 
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
-	_, err = conn.Write(listenerFinishedAck())
+	_, err = primary.conn.Write(listenerFinishedAck())
 	if err != nil {
 		return err
 	}
 
-	close(workers)
-	conn.Close()
-	p.OpenFile.Close()
+	p.emit(Event{Kind: EventDownloadFinished, PeerID: p.SenderID, Address: p.SenderAddress, Done: saved, Total: total})
+
+	if opts.Relay {
+		//Let go of the peers we downloaded from so they are free to shut down
+		stop()
+		for _, peer := range peers {
+			peer.conn.Close()
+		}
+
+		p.dlog("download complete, relaying to other listeners on port %s", p.portStr)
+		p.autoShutdown()
+	}
+
 	return nil
 }
 
 func (p *Peer) Shutdown() {
 	p.mu.Lock()
-	if p.State != dead {
-		close(p.shutdown)
+	if p.State == dead {
+		p.mu.Unlock()
+		return
+	}
+
+	p.State = dead
+	close(p.shutdown)
+	if p.selfConn != nil {
 		p.selfConn.Close()
-		p.wg.Wait()
-		p.OpenFile.Close()
-		p.cleanupZip()
-		p.State = dead
+	}
+	if p.stream != nil {
+		p.stream.close()
+	}
+	//Unblock handlers still waiting on a listener
+	for _, c := range p.Listeners {
+		c.Close()
 	}
 	p.mu.Unlock()
-}
 
-func (p *Peer) connectToSender() (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", p.SenderAddress, 30*time.Second)
-	if err != nil {
-		p.dlog("error connecting to sender %v", err)
-		return nil, err
+	//Connection handlers take the lock when they exit, so wait for them without holding it
+	p.wg.Wait()
+	if p.OpenFile != nil {
+		p.OpenFile.Close()
 	}
+	p.cleanupZip()
 
-	p.dlog("connected to sender on port %s", conn.RemoteAddr().String())
-
-	return conn, err
+	p.emit(Event{Kind: EventShutdown})
 }
 
-func (p *Peer) download(workers chan pieceWorker, conn net.Conn, result chan PieceBlock, errChan chan error) {
-	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		p.dlog("an error has occured while listening %v\n", err)
-		errChan <- err
+func (p *Peer) connectToPeer(ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		p.dlog("error connecting to peer %v", err)
+		return nil, err
 	}
 
-	for work := range workers {
-		p.dlog("requesting piece %d", work.index)
-		_, err := conn.Write(requestPiece(work.index))
-		if err != nil {
-			p.dlog("an error has occured while listening %v\n", err)
-			errChan <- err
-		}
-
-		//Expect to read a piece
-		msg, err := DeserializeMessageFromReader(conn)
-		if err != nil {
-			p.dlog("an error has occured while listening %v\n", err)
-			errChan <- err
-		}
-		p.dlog("received piece %d", work.index)
-
-		if msg.ID != MessagePiece {
-			p.dlog("message is not a piece")
-			errChan <- err
-		}
-
-		resPiece, err := UnmarshallPiece(msg)
-		if err != nil {
-			p.dlog("an error has occured while listening %v\n", err)
-			errChan <- err
-		}
-
-		if !p.verifyPiece(resPiece) {
-			if p.MaxPieceRetries != 0 {
-				p.dlog("piece at index %d does not match retrying....", resPiece.Index)
-				workers <- work
-				p.mu.Lock()
-				p.MaxPieceRetries--
-				p.mu.Unlock()
-				continue
-			}
-
-			p.dlog("piece at index %d does not match", resPiece.Index)
-			errChan <- fmt.Errorf("piece at index %d does not match", resPiece.Index)
-		}
+	p.dlog("connected to peer on port %s", conn.RemoteAddr().String())
 
-		result <- *resPiece
-		conn.SetDeadline(time.Time{})
-	}
+	return conn, err
 }
 
-func (p *Peer) run(host string) {
+// Accept listeners on host until the peer shuts down
+func (p *Peer) run(host string) error {
 	//Idea: I dont think we need for this logic
 	network := "tcp"
 	addr := net.JoinHostPort(host, p.portStr)
@@ -455,7 +853,7 @@ func (p *Peer) run(host string) {
 			var tcpIP *net.IPAddr
 			tcpIP, err := net.ResolveIPAddr("ip", host)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			ip = tcpIP.IP
 		}
@@ -475,25 +873,39 @@ func (p *Peer) run(host string) {
 	l, err := net.Listen(network, addr)
 	if err != nil {
 		p.dlog(err.Error())
-		panic(err)
+		return err
 	}
 
-	fmt.Fprintln(os.Stdout, "Ready to begin sending file")
-	fmt.Fprintf(os.Stdout, "Listening on %s\n", l.Addr().String())
-
 	p.mu.Lock()
+	//Shut down before the server started
+	if p.State == dead {
+		p.mu.Unlock()
+		l.Close()
+		return nil
+	}
+
 	p.selfConn = l
 	p.mu.Unlock()
 
+	if p.ready != nil {
+		p.ready(l.Addr())
+	}
+	p.emit(Event{Kind: EventReady, Address: l.Addr().String()})
+
 	go p.autoShutdown()
 
+	p.serve()
+	return nil
+}
+
+// Accept listeners until the peer shuts down
+func (p *Peer) serve() {
 	for {
 		conn, err := p.selfConn.Accept()
 		if err != nil {
 			select {
 			case <-p.shutdown:
 				p.dlog("closing server")
-				fmt.Fprintln(os.Stderr, "Closing server....")
 				p.Shutdown()
 				return
 			default:
@@ -502,26 +914,31 @@ func (p *Peer) run(host string) {
 			}
 		}
 
-		fmt.Fprintf(os.Stdout, "Received connection from %s\n", conn.RemoteAddr().String())
 		p.dlog("%s has connected", conn.RemoteAddr().String())
 
 		p.wg.Add(1)
 		go func(conn net.Conn) {
+			session := &listenerSession{conn: conn, raw: conn}
+
+			//Why the connection ended, nil when the listener hung up
+			var reason error
+
 			defer func() {
-				conn.Close()
+				session.conn.Close()
 				p.wg.Done()
-				p.mu.Lock()
-				for i, c := range p.Listeners {
-					if c == conn {
-						p.Listeners = append(p.Listeners[:i], p.Listeners[i+1:]...)
-						break
-					}
+				p.release(session)
+				p.admitNext()
+				if p.stream != nil {
+					p.leaveStream(session)
 				}
-				p.mu.Unlock()
 
 				p.mu.RLock()
 				p.dlog("listener %s disconnected, remaining listeners: %d", conn.RemoteAddr(), len(p.Listeners))
 				p.mu.RUnlock()
+
+				if session.peerID != "" && !session.inspect {
+					p.emit(Event{Kind: EventListenerDisconnected, PeerID: session.peerID, Address: conn.RemoteAddr().String(), Err: reason})
+				}
 			}()
 
 			for {
@@ -529,8 +946,11 @@ func (p *Peer) run(host string) {
 				p.mu.RLock()
 				p.dlog("listener length: %d", len(p.Listeners))
 				p.mu.RUnlock()
-				if err := p.messageProcessor(conn); err != nil {
+				if err := p.messageProcessor(session); err != nil {
 					p.dlog("listener %s error or EOF: %v", conn.RemoteAddr(), err)
+					if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+						reason = err
+					}
 					return
 				}
 			}
@@ -543,14 +963,19 @@ func (p *Peer) autoShutdown() {
 	timer := time.NewTimer(p.AutomaticShutdownDelay)
 
 	for {
-		<-timer.C
+		select {
+		case <-p.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 
 		p.mu.RLock()
 		if len(p.Listeners) == 0 {
 			p.mu.RUnlock()
 
-			fmt.Fprintln(os.Stdout, "server idled for too long, shutting down....")
 			p.dlog("server idled for too long, shutting down....")
+			p.emit(Event{Kind: EventIdle})
 			timer.Stop()
 			p.Shutdown()
 			return
@@ -562,14 +987,15 @@ func (p *Peer) autoShutdown() {
 
 }
 
-func (p *Peer) broadcastOnLocalNetwork(useipv6 bool) {
+func (p *Peer) broadcastOnLocalNetwork(payload []byte, useipv6 bool) {
 	p.dlog("broadcasting on local network")
 	// look for peers first
 	settings := peerdiscovery.Settings{
 		Limit:     -1,
-		Payload:   []byte("hello" + p.portStr),
+		Payload:   payload,
 		Delay:     20 * time.Millisecond,
 		TimeLimit: -1,
+		StopChan:  p.shutdown,
 	}
 	if useipv6 {
 		settings.IPVersion = peerdiscovery.IPv6
@@ -585,32 +1011,175 @@ func (p *Peer) broadcastOnLocalNetwork(useipv6 bool) {
 	}
 }
 
-// Read an acknowledgement message from the sender
-func (p *Peer) listenerSenderHandshake(conn net.Conn) error {
+// Read an acknowledgement message from the sender and return what it agreed to.
+// When the sender uses a code phrase a key exchange runs first and the returned connection is encrypted.
+func (p *Peer) listenerSenderHandshake(conn net.Conn) (net.Conn, *Handshake, error) {
 	p.dlog("perform listener sender handshake message")
 	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	defer conn.SetReadDeadline(time.Time{})
+	defer conn.SetDeadline(time.Time{})
+
+	hello := Handshake{
+		Version:      PROTOCOL_VERSION,
+		PeerID:       p.id,
+		Capabilities: p.capabilities(),
+		Inspect:      p.inspecting,
+	}
 
-	_, err := conn.Write(listenerSenderHandshake())
+	_, err := conn.Write(listenerSenderHandshake(&hello))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	msg, err := DeserializeMessageFromReader(conn)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	//Wait in the sender's queue until a slot frees up
+	for msg.ID == MessageReject {
+		reject, err := UnmarshallReject(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if reject.Position == 0 {
+			return nil, nil, &RejectError{*reject}
+		}
+
+		p.dlog("%s, position %d in queue", reject.Reason, reject.Position)
+		p.emit(Event{Kind: EventQueued, Position: reject.Position})
+		if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+			return nil, nil, err
+		}
+
+		msg, err = DeserializeMessageFromReader(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if msg.ID == MessageError {
+		return nil, nil, p.readProtocolError(msg)
+	}
+
+	if msg.ID == MessagePake {
+		if p.code == "" {
+			return nil, nil, ErrCodeRequired
+		}
+
+		conn, err = p.listenerKeyExchange(conn, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		//A wrong code phrase surfaces here as a record that fails to decrypt
+		msg, err = DeserializeMessageFromReader(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if p.code != "" {
+		return nil, nil, ErrCodeNotUsed
 	}
 
 	if msg.ID == MessageListenerAcknowledgement {
-		p.Sender = conn
-		return nil
+		ack, err := UnmarshallHandshake(msg.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ack.Version < MIN_PROTOCOL_VERSION {
+			return nil, nil, fmt.Errorf("sender speaks protocol version %d, older than the minimum %d", ack.Version, MIN_PROTOCOL_VERSION)
+		}
+
+		if p.code != "" && !ack.Capabilities.Has(CapEncryption) {
+			return nil, nil, ErrCodeNotUsed
+		}
+
+		p.dlog("handshake with %s complete, version %d, capabilities [%s]", ack.PeerID, ack.Version, ack.Capabilities)
+
+		return conn, ack, nil
 	} else {
-		p.dlog("panicing sender acknowledgment not received")
-		panic("supposed to receive sender acknowledgement")
+		p.dlog("sender acknowledgment not received")
+		return nil, nil, fmt.Errorf("%w %d, expected the sender's acknowledgement", ErrUnexpectedMessage, msg.ID)
+	}
+}
+
+// Convert a MessageError from the other side into an error for the caller
+func (p *Peer) readProtocolError(msg *Message) error {
+	perr, err := UnmarshallError(msg)
+	if err != nil {
+		return err
+	}
+
+	p.dlog("sender refused the handshake: %v", perr)
+	return perr
+}
+
+// Answer the sender's key exchange message and switch to an encrypted connection
+func (p *Peer) listenerKeyExchange(conn net.Conn, senderMsg *Message) (net.Conn, error) {
+	p.dlog("performing key exchange with sender")
+
+	pake, err := newSpake2(p.code, pakeRoleListener)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{ID: MessagePake, Payload: pake.Bytes()}
+	if _, err := conn.Write(msg.Serialize()); err != nil {
+		return nil, err
+	}
+
+	key, err := pake.SessionKey(senderMsg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSecureConn(conn, key, pakeRoleListener)
+}
+
+// Start the key exchange with a listener and switch the session to an encrypted connection
+func (p *Peer) senderKeyExchange(s *listenerSession) error {
+	p.dlog("performing key exchange with %s", s.conn.RemoteAddr().String())
+	if err := s.conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+
+	defer s.conn.SetDeadline(time.Time{})
+
+	pake, err := newSpake2(p.code, pakeRoleSender)
+	if err != nil {
+		return err
 	}
+
+	msg := Message{ID: MessagePake, Payload: pake.Bytes()}
+	if _, err := s.conn.Write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	reply, err := DeserializeMessageFromReader(s.conn)
+	if err != nil {
+		return err
+	}
+
+	if reply.ID != MessagePake {
+		return fmt.Errorf("expected key exchange message from listener")
+	}
+
+	key, err := pake.SessionKey(reply.Payload)
+	if err != nil {
+		return err
+	}
+
+	sc, err := newSecureConn(s.conn, key, pakeRoleSender)
+	if err != nil {
+		return err
+	}
+
+	s.conn = sc
+	return nil
 }
 
 // Read file metadata from sender
@@ -620,7 +1189,7 @@ func (p *Peer) listenerRequestMetadata(conn net.Conn) error {
 		return err
 	}
 
-	defer conn.SetReadDeadline(time.Time{})
+	defer conn.SetDeadline(time.Time{})
 
 	_, err := conn.Write(requestMetadata())
 	if err != nil {
@@ -634,45 +1203,112 @@ func (p *Peer) listenerRequestMetadata(conn net.Conn) error {
 
 	if msg.ID == MessageMetadata {
 		p.mu.Lock()
+		defer p.mu.Unlock()
+
 		p.Metadata, err = UnmarshallMetadata(msg)
 		if err != nil {
 			return err
 		}
 
+		if err := p.Metadata.validate(); err != nil {
+			return err
+		}
+
+		if p.Metadata.Merkle {
+			p.tree = newMerkleTree(p.Metadata.HashAlgorithm, p.Metadata.NumPieces(), p.Metadata.Checksum)
+		}
+
 		p.dlog("received metadata from sender")
-		p.mu.Unlock()
 		return nil
+	} else if msg.ID == MessageError {
+		return p.readProtocolError(msg)
 	} else {
-		p.dlog("panicing sender acknowledgment not received")
-		panic("supposed to receive sender acknowledgement")
+		p.dlog("metadata not received")
+		return fmt.Errorf("%w %d, expected metadata", ErrUnexpectedMessage, msg.ID)
 	}
 }
 
-func (p *Peer) messageProcessor(conn net.Conn) error {
+func (p *Peer) messageProcessor(s *listenerSession) error {
+	conn := s.conn
+
 	msg, err := DeserializeMessageFromReader(conn)
 	if err != nil {
 		return err
 	}
 
+	//Only pings and the handshake may arrive unencrypted when the sender uses a code phrase
+	if p.code != "" && !s.encrypted() && msg.ID != MessagePing && msg.ID != MessageListenerSenderHandshake {
+		return ErrCodeRequired
+	}
+
+	//Peers inspecting the metadata were never given a slot, so they may not download
+	if s.inspect && (msg.ID == MessageRequestPiece || msg.ID == MessageRequestBitfield) {
+		_, _ = s.write(MarshallError(ErrorNotAdmitted, "connected to inspect only").Serialize())
+		return fmt.Errorf("%s connected to inspect only", s.peerID)
+	}
+
 	switch msg.ID {
 	case MessageListenerSenderHandshake:
 		p.dlog("listener detected")
 
-		p.mu.RLock()
-		if len(p.Listeners) != p.ListenerLimit {
-			p.mu.RUnlock()
+		hello, err := UnmarshallHandshake(msg.Payload)
+		if err != nil {
+			_, _ = s.write(MarshallError(ErrorMalformedMessage, "malformed handshake").Serialize())
+			return err
+		}
 
-			_, err := conn.Write(senderListenerAck())
-			if err != nil {
+		ack, perr := p.negotiate(hello)
+		if perr != nil {
+			p.dlog("refusing listener %s: %v", hello.PeerID, perr)
+			_, _ = s.write(MarshallError(perr.Code, perr.Reason).Serialize())
+			return perr
+		}
+
+		s.peerID = hello.PeerID
+		s.version = ack.Version
+		s.capabilities = ack.Capabilities
+
+		s.inspect = hello.Inspect
+
+		//Inspecting peers skip the queue, so there may only be a few and only briefly
+		if s.inspect {
+			if !p.admitInspect(s) {
+				p.dlog("too many inspecting peers, refusing %s", s.peerID)
+				reject := Reject{Reason: "too many inspecting peers", RetryAfter: QUEUE_RETRY_AFTER}
+				_, _ = s.write(MarshallReject(&reject).Serialize())
+				return &RejectError{reject}
+			}
+
+			if err := s.raw.SetDeadline(time.Now().Add(INSPECT_TIMEOUT)); err != nil {
+				return err
+			}
+		}
+
+		//Excess listeners wait in a queue until a slot frees up
+		if !s.inspect && !p.admit(s) {
+			if err := p.waitInQueue(s); err != nil {
 				return err
 			}
-			p.mu.Lock()
-			p.Listeners = append(p.Listeners, conn)
-			p.mu.Unlock()
+		}
+
+		if p.code != "" {
+			if err := p.senderKeyExchange(s); err != nil {
+				return err
+			}
+			conn = s.conn
+		}
+
+		_, err = s.write(senderListenerAck(ack))
+		if err != nil {
+			return err
+		}
+
+		if !s.inspect {
+			p.emit(Event{Kind: EventListenerConnected, PeerID: s.peerID, Address: s.raw.RemoteAddr().String()})
 		}
 
 	case MessagePing:
-		_, err := conn.Write(sendPong())
+		_, err := s.write(sendPong())
 		if err != nil {
 			return err
 		}
@@ -683,30 +1319,85 @@ func (p *Peer) messageProcessor(conn net.Conn) error {
 		if err != nil {
 			return err
 		}
-		_, err = conn.Write(msg.Serialize())
+
+		out := msg.Serialize()
+		_, err = s.write(out)
 		if err != nil {
 			return err
 		}
 
+		p.emit(Event{Kind: EventMetadataSent, PeerID: s.peerID, Address: s.raw.RemoteAddr().String(), Bytes: int64(len(out))})
+
+		if s.inspect {
+			return errInspected
+		}
+
+	case MessageRequestBitfield:
+		p.dlog("%s has requested a bitfield", conn.RemoteAddr().String())
+
+		//Have messages follow the bitfield as the relay verifies more pieces
+		if err := p.subscribe(s); err != nil {
+			return err
+		}
+
 	case MessageRequestPiece:
 		p.dlog("%s has requested a piece", conn.RemoteAddr().String())
 
-		idx := parsePieceRequest(msg.Payload)
-		msg, err := MarshallPiece(p.OpenFile, idx)
+		idx, err := parsePieceRequest(msg.Payload)
+		if err != nil {
+			_, _ = s.write(MarshallError(ErrorMalformedMessage, err.Error()).Serialize())
+			return err
+		}
+
+		if p.stream != nil {
+			return p.serveStreamPiece(s, idx)
+		}
+
+		if idx < 0 || idx >= p.Metadata.NumPieces() {
+			_, _ = s.write(MarshallError(ErrorMalformedMessage, "piece index out of range").Serialize())
+			return fmt.Errorf("piece index %d out of range", idx)
+		}
+
+		//A relay only serves pieces it has verified and written
+		if !p.holds(idx) {
+			_, err := s.write(MarshallError(ErrorPieceUnavailable, fmt.Sprintf("piece %d not available yet", idx)).Serialize())
+			return err
+		}
+
+		msg, err := p.marshallPiece(idx)
 		if err != nil {
 			return err
 		}
 
-		_, err = conn.Write(msg.Serialize())
+		_, err = s.write(msg.Serialize())
 		if err != nil {
 			return err
 		}
 
+		begin, end := p.Metadata.pieceBounds(idx)
+		p.emit(Event{Kind: EventPieceSent, PeerID: s.peerID, Address: s.raw.RemoteAddr().String(), Piece: idx, Bytes: end - begin})
+
 		p.dlog("sent piece %d to listener: %s", idx, conn.RemoteAddr().String())
 
+	case MessageRequestStream:
+		if p.stream == nil {
+			_, _ = s.write(MarshallError(ErrorMalformedMessage, "not sending a stream").Serialize())
+			return fmt.Errorf("%s requested a stream, but none is being sent", s.peerID)
+		}
+
+		if err := p.subscribeStream(s); err != nil {
+			return err
+		}
+
 	case MessageListenerFinishedAcknowledgement:
 		p.dlog("%s has finished downloading", conn.RemoteAddr().String())
-		fmt.Fprintf(os.Stdout, "%s has finished downloading\n", conn.RemoteAddr().String())
+		p.emit(Event{Kind: EventListenerFinished, PeerID: s.peerID, Address: s.raw.RemoteAddr().String()})
+
+	case MessagePiece:
+		//Pieces only ever flow from the sender to its listeners
+		msg.Release()
+		_, _ = s.write(MarshallError(ErrorMalformedMessage, "pieces are not accepted by a sender").Serialize())
+		return fmt.Errorf("%s sent a piece to the sender", s.peerID)
 	}
 	return nil
 }
@@ -724,17 +1415,69 @@ func (p *Peer) initializeListenVirtualFile() {
 		downloadPath: p.DownloadFilePath,
 		files:        p.Metadata.Folders,
 		pieces:       p.Metadata.Pieces,
+		pieceLength:  int(p.Metadata.PieceLength),
 		totalSize:    p.Metadata.FileLength,
-		handles:      make([]*os.File, len(p.Metadata.Folders)),
+		handles:      make([]fileHandle, len(p.Metadata.Folders)),
 		single:       p.Metadata.Single,
 	}
 	p.OpenFile = &vf
 }
 
+// Where the payload is read from and written to
+func (p *Peer) payload() Storage {
+	if p.storage != nil {
+		return p.storage
+	}
+
+	return p.OpenFile
+}
+
+// Read a piece for a listener, along with its proof in Merkle mode
+func (p *Peer) marshallPiece(index int) (*Message, error) {
+	var proof [][]byte
+	if p.tree != nil {
+		var ok bool
+		proof, ok = p.tree.proof(index)
+		if !ok {
+			return nil, fmt.Errorf("no proof for piece %d", index)
+		}
+	}
+
+	begin, end := p.Metadata.pieceBounds(index)
+	buf := getPieceBuffer(int(end - begin))
+	defer putPieceBuffer(buf)
+
+	n, err := p.payload().ReadAt(buf, begin)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return marshallPieceBlock(index, begin, buf[:n], proof...)
+}
+
 func (p *Peer) verifyPiece(piece *PieceBlock) bool {
-	hash := sha1.Sum(piece.Buf)
+	index := int(piece.Index)
+	if index < 0 || index >= p.Metadata.NumPieces() {
+		return false
+	}
+
+	//The offset is where the piece is written, so it must be the piece's own
+	begin, end := p.Metadata.pieceBounds(index)
+	if piece.Offset != begin || int64(len(piece.Buf)) != end-begin {
+		return false
+	}
 
-	return bytes.Equal(hash[:], p.Metadata.Pieces[piece.Index][:])
+	hash := p.Metadata.HashAlgorithm.Sum(piece.Buf)
+	if p.tree == nil {
+		return bytes.Equal(hash, p.Metadata.Pieces[index])
+	}
+
+	proof, err := splitProof(piece.Proof, p.Metadata.HashAlgorithm.Size())
+	if err != nil {
+		return false
+	}
+
+	return p.tree.verify(index, hash, proof)
 }
 
 // dlog logs a debugging message if DebugCM > 0.
@@ -759,13 +1502,13 @@ func generatePeerID(state PeerState) (string, error) {
 	return fmt.Sprintf("%s_%x", stateStr, byt), nil
 }
 
-func listenerSenderHandshake() []byte {
-	msg := Message{ID: MessageListenerSenderHandshake}
+func listenerSenderHandshake(h *Handshake) []byte {
+	msg := Message{ID: MessageListenerSenderHandshake, Payload: h.Marshall()}
 	return msg.Serialize()
 }
 
-func senderListenerAck() []byte {
-	msg := Message{ID: MessageListenerAcknowledgement}
+func senderListenerAck(h *Handshake) []byte {
+	msg := Message{ID: MessageListenerAcknowledgement, Payload: h.Marshall()}
 	return msg.Serialize()
 }
 
@@ -783,10 +1526,12 @@ func listenerFinishedAck() []byte {
 	return msg.Serialize()
 }
 
-func parsePieceRequest(byt []byte) int {
-	index := int(binary.BigEndian.Uint32(byt[0:4]))
+func parsePieceRequest(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("malformed piece request")
+	}
 
-	return index
+	return int(binary.BigEndian.Uint32(payload)), nil
 }
 
 func sendPong() []byte {
@@ -794,21 +1539,3 @@ func sendPong() []byte {
 
 	return msg.Serialize()
 }
-
-// // Calculate the size of a piece
-// func (p *Peer) calculatePieceSize(index int) int {
-// 	begin, end := p.calculateBoundsForPiece(index)
-// 	return end - begin
-// }
-
-// // Given the piece length and file length. Find the boundary of a piece at an index
-// func (p *Peer) calculateBoundsForPiece(index int) (begin, end int) {
-// 	begin = index * int(p.Metadata.PieceLength)
-// 	end = begin + int(p.Metadata.PieceLength)
-
-// 	if end > int(p.Metadata.PieceLength) {
-// 		end = int(p.Metadata.FileLength)
-// 	}
-
-// 	return begin, end
-// }
@@ -1,12 +1,23 @@
 package transmission
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	//Set once before any peer starts, peers read it from their own goroutines
+	Debug = 0
+	os.Exit(m.Run())
+}
+
 func initializeSender(t *testing.T, opts Options) *Peer {
 	p := new(Peer)
 
@@ -17,17 +28,23 @@ func initializeSender(t *testing.T, opts Options) *Peer {
 
 	p.broadcast()
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		p.run(LOCAL_DEFAULT_ADDRESS)
 	}()
 
+	//Tests that fail early still stop the sender before the next one starts
+	t.Cleanup(func() {
+		p.Shutdown()
+		<-done
+	})
+
 	time.Sleep(500 * time.Millisecond)
 	return p
 }
 
 func TestStartAndListen(t *testing.T) {
-	Debug = 0
-
 	p := initializeSender(t, Options{FilePath: "./testdata/books"})
 
 	l := new(Peer)
@@ -162,3 +179,962 @@ func TestStartAndListenCompressed(t *testing.T) {
 	os.RemoveAll("./download_test")
 	time.Sleep(1 * time.Minute)
 }
+
+func TestStartAndListenEncrypted(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+	code, err := GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := initializeSender(t, Options{FilePath: root, Code: code})
+	defer p.Shutdown()
+
+	senderAddress := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+	downloadPath := t.TempDir()
+
+	l := new(Peer)
+	err = l.Listen(Options{
+		SenderAddress:    senderAddress,
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+		Code:             code,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	//Wrong code
+	l = new(Peer)
+	err = l.Listen(Options{
+		SenderAddress:    senderAddress,
+		DownloadFilePath: t.TempDir(),
+		Code:             codeTag(code) + "-wrong-code-phrase",
+	})
+	if err != ErrDecryptFailed {
+		t.Fatalf("expected %v got %v", ErrDecryptFailed, err)
+	}
+
+	//Missing code
+	l = new(Peer)
+	err = l.Listen(Options{
+		SenderAddress:    senderAddress,
+		DownloadFilePath: t.TempDir(),
+	})
+	if !errors.Is(err, ErrCodeRequired) {
+		t.Fatalf("expected %v got %v", ErrCodeRequired, err)
+	}
+
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || perr.Code != ErrorCodeRequired {
+		t.Fatalf("expected a protocol error got %v", err)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	a := announcement{Port: "9009", CodeTag: "4821"}
+
+	parsed, ok := parseAnnouncement(a.encode())
+	if !ok || parsed != a {
+		t.Fatalf("expected %+v got %+v", a, parsed)
+	}
+
+	a = announcement{Port: "9011", Relay: true, Content: "deadbeef"}
+	parsed, ok = parseAnnouncement(a.encode())
+	if !ok || parsed != a {
+		t.Fatalf("expected %+v got %+v", a, parsed)
+	}
+
+	parsed, ok = parseAnnouncement([]byte("hello9010"))
+	if !ok || parsed.Port != "9010" || parsed.CodeTag != "" {
+		t.Fatalf("expected plain announcement got %+v", parsed)
+	}
+
+	if _, ok := parseAnnouncement([]byte("ok")); ok {
+		t.Fatalf("expected listener payload to be rejected")
+	}
+}
+
+// Open a connection to the sender and send a handshake
+func dialHandshake(t *testing.T, address string, peerID string) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := Handshake{Version: PROTOCOL_VERSION, PeerID: peerID, Capabilities: CapHashSHA1 | CapHashSHA256 | CapHashBLAKE3 | CapMerkle}
+	if _, err := conn.Write(listenerSenderHandshake(&hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestSenderSurvivesMalformedPieceRequest(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	senderAddress := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	conn := dialHandshake(t, senderAddress, "receiver_malformed")
+	defer conn.Close()
+
+	msg, err := DeserializeMessageFromReader(conn)
+	if err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected the listener to be acknowledged got %+v %v", msg, err)
+	}
+
+	//A piece request without its index
+	if _, err := conn.Write(frame(1, MessageRequestPiece, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = DeserializeMessageFromReader(conn)
+	if err != nil || msg.ID != MessageError {
+		t.Fatalf("expected an error message got %+v %v", msg, err)
+	}
+
+	if perr, err := UnmarshallError(msg); err != nil || perr.Code != ErrorMalformedMessage {
+		t.Fatalf("expected a malformed message error got %+v %v", perr, err)
+	}
+
+	//The sender keeps serving other listeners
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	if err := l.Listen(Options{SenderAddress: senderAddress, DownloadFilePath: downloadPath}); err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+}
+
+// Pieces only flow from the sender, one sent to it is refused
+func TestSenderRefusesPieces(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	conn := dialHandshake(t, net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr), "receiver_piece")
+	defer conn.Close()
+
+	if msg, err := DeserializeMessageFromReader(conn); err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected the listener to be acknowledged got %+v %v", msg, err)
+	}
+
+	piece, err := marshallPieceBlock(0, 0, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(piece.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessageFromReader(conn)
+	if err != nil || msg.ID != MessageError {
+		t.Fatalf("expected an error message got %+v %v", msg, err)
+	}
+
+	if perr, err := UnmarshallError(msg); err != nil || perr.Code != ErrorMalformedMessage {
+		t.Fatalf("expected a malformed message error got %+v %v", perr, err)
+	}
+
+	if _, err := DeserializeMessageFromReader(conn); err == nil {
+		t.Fatal("expected the sender to hang up")
+	}
+}
+
+func TestSenderQueue(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root, ListenerLimit: 1, QueueLimit: 1})
+	defer p.Shutdown()
+
+	senderAddress := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	first := dialHandshake(t, senderAddress, "receiver_first")
+	msg, err := DeserializeMessageFromReader(first)
+	if err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected first listener to be acknowledged got %+v %v", msg, err)
+	}
+
+	second := dialHandshake(t, senderAddress, "receiver_second")
+	defer second.Close()
+	msg, err = DeserializeMessageFromReader(second)
+	if err != nil || msg.ID != MessageReject {
+		t.Fatalf("expected second listener to be queued got %+v %v", msg, err)
+	}
+
+	reject, err := UnmarshallReject(msg)
+	if err != nil || reject.Position != 1 {
+		t.Fatalf("expected position 1 got %+v %v", reject, err)
+	}
+
+	//The queue only holds one listener
+	third := dialHandshake(t, senderAddress, "receiver_third")
+	defer third.Close()
+	msg, err = DeserializeMessageFromReader(third)
+	if err != nil || msg.ID != MessageReject {
+		t.Fatalf("expected third listener to be rejected got %+v %v", msg, err)
+	}
+
+	reject, err = UnmarshallReject(msg)
+	if err != nil || reject.Position != 0 || reject.RetryAfter != QUEUE_RETRY_AFTER {
+		t.Fatalf("expected refusal with retry hint got %+v %v", reject, err)
+	}
+
+	//Freeing the slot admits the queued listener
+	first.Close()
+	msg, err = DeserializeMessageFromReader(second)
+	if err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected queued listener to be acknowledged got %+v %v", msg, err)
+	}
+}
+
+func TestListenSenderFull(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root, ListenerLimit: 1, QueueLimit: 1})
+	defer p.Shutdown()
+
+	senderAddress := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	//Occupy the slot and the queue
+	first := dialHandshake(t, senderAddress, "receiver_first")
+	defer first.Close()
+	DeserializeMessageFromReader(first)
+
+	second := dialHandshake(t, senderAddress, "receiver_second")
+	defer second.Close()
+	DeserializeMessageFromReader(second)
+
+	l := new(Peer)
+	err := l.Listen(Options{SenderAddress: senderAddress, DownloadFilePath: t.TempDir()})
+
+	var rerr *RejectError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrSenderFull) {
+		t.Fatalf("expected sender full got %v", err)
+	}
+}
+
+func TestStartAndListenPipelined(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024, 2500*1024)
+	p := initializeSender(t, Options{FilePath: root, ListenerLimit: 1})
+	defer p.Shutdown()
+
+	downloadPath := t.TempDir()
+
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+		RequestWindow:    4,
+		Connections:      3,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	if !l.SenderCapabilities.Has(CapPipelining) {
+		t.Fatalf("expected pipelining to be negotiated got [%s]", l.SenderCapabilities)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+}
+
+func TestAdmitSharesSlotBetweenConnections(t *testing.T) {
+	p := &Peer{ListenerLimit: 1}
+
+	newSession := func(peerID string) *listenerSession {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() {
+			c1.Close()
+			c2.Close()
+		})
+
+		return &listenerSession{conn: c1, raw: c1, peerID: peerID}
+	}
+
+	first := newSession("receiver_a")
+	extra := newSession("receiver_a")
+	other := newSession("receiver_b")
+
+	if !p.admit(first) || !p.admit(extra) {
+		t.Fatalf("expected both connections of the same listener to be admitted")
+	}
+
+	if p.admit(other) {
+		t.Fatalf("expected a second listener to be refused")
+	}
+
+	p.release(first)
+	if p.admit(other) {
+		t.Fatalf("expected the slot to stay taken while a connection remains")
+	}
+
+	p.release(extra)
+	if !p.admit(other) {
+		t.Fatalf("expected the slot to be free once every connection is released")
+	}
+}
+
+func TestPieceScheduler(t *testing.T) {
+	have := NewBitfield(4)
+	have.Set(1)
+
+	sched := newPieceScheduler(4, have)
+
+	//A peer holding only piece 2 is handed piece 2 even though 0 is ahead of it
+	partial := &remotePeer{have: NewBitfield(4)}
+	partial.have.Set(2)
+
+	index, ok, _ := sched.next(partial)
+	if !ok || index != 2 {
+		t.Fatalf("expected piece 2 got %d (%v)", index, ok)
+	}
+
+	_, ok, wait := sched.next(partial)
+	if ok {
+		t.Fatalf("expected no work for the partial peer")
+	}
+
+	full := &remotePeer{}
+	if index, ok := sched.unservable([]*remotePeer{partial}); !ok || index != 0 {
+		t.Fatalf("expected piece 0 to be unservable got %d (%v)", index, ok)
+	}
+
+	if _, ok := sched.unservable([]*remotePeer{partial, full}); ok {
+		t.Fatalf("expected a full peer to serve every piece")
+	}
+
+	//A have message widens what the peer is asked for
+	sched.gained(partial, 3)
+	select {
+	case <-wait:
+	default:
+		t.Fatalf("expected waiting connections to be woken")
+	}
+
+	if index, ok, _ := sched.next(partial); !ok || index != 3 {
+		t.Fatalf("expected piece 3 got %d (%v)", index, ok)
+	}
+
+	//A peer that turns out not to hold a piece hands it back
+	if !sched.unavailable(partial, 3) || partial.have.Has(3) {
+		t.Fatalf("expected piece 3 to be handed back and cleared")
+	}
+
+	if sched.unavailable(full, 0) {
+		t.Fatalf("expected a full peer not to be excluded")
+	}
+
+	//Failed pieces are handed back for the other connections
+	sched.put(partial, 2)
+
+	var got []int
+	for {
+		index, ok, _ := sched.next(full)
+		if !ok || slices.Contains(got, index) {
+			break
+		}
+		got = append(got, index)
+	}
+
+	slices.Sort(got)
+	if !slices.Equal(got, []int{0, 2, 3}) {
+		t.Fatalf("expected pieces 0, 2 and 3 got %v", got)
+	}
+}
+
+func TestPieceSchedulerEndgame(t *testing.T) {
+	sched := newPieceScheduler(1, NewBitfield(1))
+
+	slow := &remotePeer{}
+	fast := &remotePeer{}
+	idle := &remotePeer{}
+
+	if index, ok, _ := sched.next(slow); !ok || index != 0 {
+		t.Fatalf("expected piece 0 got %d (%v)", index, ok)
+	}
+
+	//Nothing is pending, so the piece in flight on the slow peer is requested again
+	if index, ok, _ := sched.next(fast); !ok || index != 0 {
+		t.Fatalf("expected piece 0 to be duplicated got %d (%v)", index, ok)
+	}
+
+	if _, ok, _ := sched.next(idle); ok {
+		t.Fatalf("expected at most %d requests for a piece", ENDGAME_DUPLICATES)
+	}
+
+	if !sched.finish(0) {
+		t.Fatalf("expected first delivery to finish the piece")
+	}
+
+	if sched.finish(0) {
+		t.Fatalf("expected duplicate delivery to be dropped")
+	}
+
+	//A finished piece is not handed back when the slow peer fails
+	sched.put(slow, 0)
+	if _, ok, _ := sched.next(idle); ok {
+		t.Fatalf("expected no work once the piece is finished")
+	}
+}
+
+func TestRelayAnnouncesHave(t *testing.T) {
+	meta := &Metadata{PieceLength: int32(PIECELENGTH), Pieces: make([][]byte, 4)}
+	relayPeer := &Peer{Metadata: meta, OpenFile: &VirtualFile{}, have: NewBitfield(4)}
+	relayPeer.have.Set(0)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	s := &listenerSession{conn: c1, raw: c1}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- relayPeer.subscribe(s)
+	}()
+
+	msg, err := DeserializeMessageFromReader(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash, have, err := UnmarshallBitfield(msg)
+	if err != nil || infoHash != meta.InfoHash() || !have.Has(0) || have.Has(1) {
+		t.Fatalf("expected bitfield holding piece 0 got %v (%v)", have, err)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	relayPeer.mu.Lock()
+	relayPeer.have.Set(2)
+	relayPeer.mu.Unlock()
+
+	announced := make(chan struct{})
+	go func() {
+		defer close(announced)
+		relayPeer.announceHave(2)
+	}()
+	defer func() { <-announced }()
+
+	msg, err = DeserializeMessageFromReader(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.ID != MessageHave {
+		t.Fatalf("expected a have message got message %d", msg.ID)
+	}
+
+	if index, err := parseHave(msg.Payload, 4); err != nil || index != 2 {
+		t.Fatalf("expected have for piece 2 got %d (%v)", index, err)
+	}
+
+	//Disconnected listeners are no longer told about new pieces
+	relayPeer.release(s)
+	if len(relayPeer.subscribers) != 0 {
+		t.Fatalf("expected subscriber to be removed")
+	}
+}
+
+func TestListenFromMultipleSenders(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024, 2500*1024)
+	first := initializeSender(t, Options{FilePath: root})
+	defer first.Shutdown()
+	second := initializeSender(t, Options{FilePath: root})
+	defer second.Shutdown()
+
+	if first.Metadata.ContentID() != second.Metadata.ContentID() {
+		t.Fatalf("expected identical content to share a content id")
+	}
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, first.portStr),
+		Peers:            []string{net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, second.portStr)},
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+		RequestWindow:    2,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+}
+
+// Retries are shared by every connection, once they are used up none of them retries a bad piece
+func TestListenRetriesExhaustedAcrossConnections(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+	p := initializeSender(t, Options{FilePath: root, PieceLength: MIN_PIECE_LENGTH})
+	defer p.Shutdown()
+
+	//Every piece the sender serves fails to match its hash
+	for _, piece := range p.Metadata.Pieces {
+		piece[0] ^= 0xff
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	l := new(Peer)
+	err := l.ListenContext(ctx, Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: t.TempDir(),
+		MaxPieceRetries:  2,
+		Connections:      2,
+		RequestWindow:    2,
+	})
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the download to fail once the retries are used up got %v", err)
+	}
+
+	if l.MaxPieceRetries != 0 {
+		t.Fatalf("expected the retries to stop at zero got %d", l.MaxPieceRetries)
+	}
+}
+
+// Wait until a relaying listener holds every piece and return its address
+func waitForRelay(t *testing.T, p *Peer) string {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.RLock()
+		complete := p.State == relay && p.Metadata != nil && p.have.Count(p.Metadata.NumPieces()) == p.Metadata.NumPieces()
+		port := p.portStr
+		p.mu.RUnlock()
+
+		if complete {
+			return net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, port)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("relay did not finish downloading")
+	return ""
+}
+
+func TestListenFromRelay(t *testing.T) {
+	testListenFromRelay(t, false)
+}
+
+// The relay has to pass on the proofs it received along with the pieces
+func TestListenFromMerkleRelay(t *testing.T) {
+	testListenFromRelay(t, true)
+}
+
+func testListenFromRelay(t *testing.T, merkle bool) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+	p := initializeSender(t, Options{FilePath: root, Merkle: merkle})
+
+	//Stop the relay and wait for it should the test fail before it shuts down on its own
+	ctx, cancel := context.WithCancel(context.Background())
+	relayErr := make(chan error, 1)
+	relayDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-relayDone
+	}()
+
+	relayPeer := new(Peer)
+	go func() {
+		defer close(relayDone)
+		relayErr <- relayPeer.ListenContext(ctx, Options{
+			SenderAddress:          net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+			MaxPieceRetries:        4,
+			DownloadFilePath:       t.TempDir(),
+			Relay:                  true,
+			AutomaticShutdownDelay: 2 * time.Second,
+		})
+	}()
+
+	relayAddress := waitForRelay(t, relayPeer)
+
+	//The relay lets go of the sender once it starts seeding
+	for {
+		p.mu.RLock()
+		idle := len(p.Listeners) == 0
+		p.mu.RUnlock()
+
+		if idle {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	//Every piece has to come from the relay once the sender is gone
+	p.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    relayAddress,
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	if l.SenderID != relayPeer.id {
+		t.Fatalf("expected to download from relay %s got %s", relayPeer.id, l.SenderID)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+
+	select {
+	case err := <-relayErr:
+		if err != nil {
+			t.Fatalf("relay returned %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("relay did not shut down once idle")
+	}
+}
+
+func TestListenFromPartialRelayAndSender(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024, 900*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//A relay that only holds the even pieces
+	have := NewBitfield(len(meta.Pieces))
+	for i := 0; i < len(meta.Pieces); i += 2 {
+		have.Set(i)
+	}
+
+	relayPeer := &Peer{Metadata: meta, OpenFile: vf, have: have}
+	relayPeer.id, _ = generatePeerID(relay)
+	if err := relayPeer.startRelay(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer relayPeer.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err = l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, relayPeer.portStr),
+		Peers:            []string{net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)},
+		MaxPieceRetries:  4,
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+}
+
+func TestRelayRefusesMissingPiece(t *testing.T) {
+	root := writeTestTree(t, 1200*1024)
+
+	meta, vf, err := GenerateMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relayPeer := &Peer{Metadata: meta, OpenFile: vf, have: NewBitfield(len(meta.Pieces))}
+	relayPeer.id, _ = generatePeerID(relay)
+	if err := relayPeer.startRelay(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer relayPeer.Shutdown()
+
+	conn := dialHandshake(t, net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, relayPeer.portStr), "receiver_a")
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if msg, err := DeserializeMessageFromReader(conn); err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected an acknowledgement got %+v (%v)", msg, err)
+	}
+
+	if _, err := conn.Write(requestPiece(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessageFromReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.ID != MessageError {
+		t.Fatalf("expected an error message got message %d", msg.ID)
+	}
+
+	perr, err := UnmarshallError(msg)
+	if err != nil || perr.Code != ErrorPieceUnavailable {
+		t.Fatalf("expected piece unavailable got %+v (%v)", perr, err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+	p := initializeSender(t, Options{FilePath: root, ListenerLimit: 1, QueueLimit: 1})
+	defer p.Shutdown()
+
+	address := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	//Take the only slot, inspecting must still work
+	holder := dialHandshake(t, address, "receiver_a")
+	defer holder.Close()
+
+	if msg, err := DeserializeMessageFromReader(holder); err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected an acknowledgement got %+v (%v)", msg, err)
+	}
+
+	l := new(Peer)
+	meta, err := l.Inspect(Options{SenderAddress: address})
+	if err != nil {
+		t.Fatalf("an error as occurred while inspecting %v\n", err)
+	}
+
+	if meta.ContentID() != p.Metadata.ContentID() || len(meta.Folders) != len(p.Metadata.Folders) {
+		t.Fatalf("expected the sender's metadata got %+v", meta)
+	}
+
+	p.mu.RLock()
+	listeners := len(p.Listeners)
+	p.mu.RUnlock()
+
+	if listeners != 1 {
+		t.Fatalf("expected inspecting not to take a listener slot, got %d listeners", listeners)
+	}
+
+	//An inspecting peer may not download
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	hello := Handshake{Version: PROTOCOL_VERSION, PeerID: "receiver_b", Capabilities: CapHashSHA1 | CapHashSHA256 | CapHashBLAKE3 | CapMerkle, Inspect: true}
+	if _, err := conn.Write(listenerSenderHandshake(&hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := DeserializeMessageFromReader(conn); err != nil || msg.ID != MessageListenerAcknowledgement {
+		t.Fatalf("expected an acknowledgement got %+v (%v)", msg, err)
+	}
+
+	if _, err := conn.Write(requestPiece(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DeserializeMessageFromReader(conn)
+	if err != nil || msg.ID != MessageError {
+		t.Fatalf("expected an error got %+v (%v)", msg, err)
+	}
+
+	if perr, err := UnmarshallError(msg); err != nil || perr.Code != ErrorNotAdmitted {
+		t.Fatalf("expected not admitted got %+v (%v)", perr, err)
+	}
+}
+
+// Inspecting peers are capped and hung up on once they have the metadata
+func TestInspectSessionsLimited(t *testing.T) {
+	root := writeTestTree(t, 300*1024)
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	address := net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr)
+
+	inspect := func(peerID string) (net.Conn, *Message) {
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		hello := Handshake{Version: PROTOCOL_VERSION, PeerID: peerID, Capabilities: CapHashSHA1 | CapHashSHA256 | CapHashBLAKE3 | CapMerkle, Inspect: true}
+		if _, err := conn.Write(listenerSenderHandshake(&hello)); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := DeserializeMessageFromReader(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, msg
+	}
+
+	var open []net.Conn
+	for i := range MAX_INSPECT_SESSIONS {
+		conn, msg := inspect(fmt.Sprintf("receiver_%d", i))
+		defer conn.Close()
+
+		if msg.ID != MessageListenerAcknowledgement {
+			t.Fatalf("expected an acknowledgement got %+v", msg)
+		}
+		open = append(open, conn)
+	}
+
+	conn, msg := inspect("receiver_extra")
+	conn.Close()
+
+	if msg.ID != MessageReject {
+		t.Fatalf("expected the extra inspecting peer to be rejected got %+v", msg)
+	}
+
+	if reject, err := UnmarshallReject(msg); err != nil || reject.Position != 0 {
+		t.Fatalf("expected a rejection without a queue position got %+v (%v)", reject, err)
+	}
+
+	//The metadata ends the session and frees its place
+	if _, err := open[0].Write(requestMetadata()); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := DeserializeMessageFromReader(open[0]); err != nil || msg.ID != MessageMetadata {
+		t.Fatalf("expected metadata got %+v (%v)", msg, err)
+	}
+
+	if _, err := DeserializeMessageFromReader(open[0]); err == nil {
+		t.Fatal("expected the sender to hang up after the metadata")
+	}
+
+	//The sender gives up the place just after hanging up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.RLock()
+		inspectors := p.inspectors
+		p.mu.RUnlock()
+
+		if inspectors < MAX_INSPECT_SESSIONS {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a place to free up, %d peers still inspecting", inspectors)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l := new(Peer)
+	if _, err := l.Inspect(Options{SenderAddress: address}); err != nil {
+		t.Fatalf("expected inspecting to work once a place freed up got %v", err)
+	}
+}
+
+// Pieces are read and written at the sender's piece length, not the package default
+func TestListenPieceLength(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024, 1200*1024)
+
+	for _, pieceLength := range []int{64 * 1024, 2 * 1024 * 1024, AUTO_PIECE_LENGTH} {
+		p := initializeSender(t, Options{FilePath: root, PieceLength: pieceLength})
+
+		if pieceLength != AUTO_PIECE_LENGTH && int(p.Metadata.PieceLength) != pieceLength {
+			t.Fatalf("expected piece length %d got %d", pieceLength, p.Metadata.PieceLength)
+		}
+
+		downloadPath := t.TempDir()
+		l := new(Peer)
+		err := l.Listen(Options{
+			SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+			DownloadFilePath: downloadPath,
+		})
+		p.Shutdown()
+		if err != nil {
+			t.Fatalf("an error as occurred while listening %v\n", err)
+		}
+
+		compareTrees(t, root, filepath.Join(downloadPath, filepath.Base(root)))
+	}
+
+	p := new(Peer)
+	if err := p.initSender(Options{FilePath: root, PieceLength: 1000}); err != ErrInvalidPieceLength {
+		t.Fatalf("expected %v got %v", ErrInvalidPieceLength, err)
+	}
+}
+
+func TestListenPreservesAttributes(t *testing.T) {
+	root := writeTestTree(t, 700*1024, 300*1024)
+	script := filepath.Join(root, "dir0", "run.sh")
+	empty := filepath.Join(root, "dir1", "empty.txt")
+	emptyDir := filepath.Join(root, "cache", "nested")
+
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Dir(emptyDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(emptyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	for _, path := range []string{script, empty, emptyDir, filepath.Join(root, "dir0", "file0.bin"), filepath.Join(root, "cache")} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := initializeSender(t, Options{FilePath: root})
+	defer p.Shutdown()
+
+	downloadPath := t.TempDir()
+	l := new(Peer)
+	err := l.Listen(Options{
+		SenderAddress:    net.JoinHostPort(LOCAL_DEFAULT_ADDRESS, p.portStr),
+		DownloadFilePath: downloadPath,
+	})
+	if err != nil {
+		t.Fatalf("an error as occurred while listening %v\n", err)
+	}
+
+	got := filepath.Join(downloadPath, filepath.Base(root))
+	compareTrees(t, root, got)
+
+	tests := []struct {
+		path  string
+		mode  os.FileMode
+		isDir bool
+	}{
+		{filepath.Join("dir0", "run.sh"), 0755, false},
+		{filepath.Join("dir1", "empty.txt"), 0600, false},
+		{filepath.Join("dir0", "file0.bin"), 0644, false},
+		{filepath.Join("cache", "nested"), 0700, true},
+		{"cache", 0755, true},
+	}
+
+	for _, test := range tests {
+		info, err := os.Stat(filepath.Join(got, test.path))
+		if err != nil {
+			t.Fatalf("expected %s to be recreated (%v)", test.path, err)
+		}
+
+		if info.IsDir() != test.isDir || info.Mode().Perm() != test.mode {
+			t.Fatalf("expected %s with mode %v got %v", test.path, test.mode, info.Mode())
+		}
+
+		if !info.ModTime().Equal(modTime) {
+			t.Fatalf("expected %s modified at %v got %v", test.path, modTime, info.ModTime())
+		}
+	}
+}
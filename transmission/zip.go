@@ -13,7 +13,7 @@ var ErrNotFolder = fmt.Errorf("cannot zip single file")
 
 // Zip all files in provide path and return path to zip folder
 func ZipFolder(destination string, source string) (string, error) {
-	fmt.Fprintf(os.Stdout, "Zipping folder %s\n", source)
+	fmt.Fprintf(os.Stderr, "Zipping folder %s\n", source)
 	info, err := os.Stat(source)
 	if err != nil {
 		return "", err
@@ -65,7 +65,7 @@ func ZipFolder(destination string, source string) (string, error) {
 				return err
 			}
 
-			fmt.Fprintf(os.Stdout, "Added %s to zip file\n", path)
+			fmt.Fprintf(os.Stderr, "Added %s to zip file\n", path)
 		}
 
 		return nil